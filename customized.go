@@ -9,8 +9,8 @@ import (
 
 // CustomizedConfig holds the configuration for a CustomizedRoutine
 type CustomizedConfig struct {
-	Value   int  `json:"value"`
-	Suspend bool `json:"suspend"`
+	Value   int  `json:"value" validate:"min=0,max=1000" description:"Amount added to the count on each iteration"`
+	Suspend bool `json:"suspend" description:"Keep the count unchanged until resumed"`
 }
 
 // CustomizedOutput holds the output data for a CustomizedRoutine
@@ -48,13 +48,18 @@ func (r *CustomizedRoutine) Job(ctrl *routine.RoutineControl[*CustomizedConfig,
 	}
 	time.Sleep(100 * time.Millisecond)
 
+	// Leave a note in the routine log every hundred iterations
+	if config.Value != 0 && (newOutput.Count/config.Value)%100 == 0 {
+		ctrl.Logf("count reached %d", newOutput.Count)
+	}
+
 	return &newOutput, nil
 }
 
 // GenIdentity implements the identity generation for CustomizedRoutine
 func (r *CustomizedRoutine) GenIdentity(config *CustomizedConfig) string {
-	// Generate ID with nano timestamp and config value
-	return fmt.Sprintf("CR-%d-%d", time.Now().UnixNano(), config.Value)
+	// Generate ID with a ULID, unique even for routines started in the same instant, and config value
+	return fmt.Sprintf("CR-%s-%d", routine.NewULID(), config.Value)
 }
 
 // SerializeConfig implements config serialization for CustomizedRoutine
@@ -74,6 +79,11 @@ func (r *CustomizedRoutine) DeserializeConfig(configStr string) (*CustomizedConf
 	return &cfg, nil
 }
 
+// ValidateConfig implements config validation for CustomizedRoutine using its validate tags
+func (r *CustomizedRoutine) ValidateConfig(config *CustomizedConfig) []routine.FieldError {
+	return routine.ValidateTags(config)
+}
+
 // SerializeOutput implements output serialization for CustomizedRoutine
 func (r *CustomizedRoutine) SerializeOutput(output *CustomizedOutput) string {
 	if output == nil {
@@ -110,11 +120,13 @@ func NewCustomizedRoutine() *routine.Routine[*CustomizedConfig, *CustomizedOutpu
 
 	// Convert the CustomizedRoutine to a Routine
 	return &routine.Routine[*CustomizedConfig, *CustomizedOutput]{
+		Type:              "customized",
 		Job:               customized.Job,
 		GenIdentity:       customized.GenIdentity,
 		SerializeConfig:   customized.SerializeConfig,
 		DeserializeConfig: customized.DeserializeConfig,
 		SerializeOutput:   customized.SerializeOutput,
+		ValidateConfig:    customized.ValidateConfig,
 		Suspend:           customized.Suspend,
 		Resume:            customized.Resume,
 	}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"main/routine"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 )
 
 // No global flags - all state is now maintained in the RoutineScheduler instance
@@ -12,8 +19,52 @@ func main() {
 	// Parse command line flags
 	interactiveFlag := flag.Bool("interactive", true, "Run in interactive mode with UI")
 	portFlag := flag.Int("port", 8080, "Port to run the server on")
+	auditFlag := flag.String("audit-log", "", "Path of the JSON lines audit log (disabled when empty)")
+	authFlag := flag.String("auth-config", "", "Path of the JSON auth config (authentication disabled when empty)")
+	hashFlag := flag.Bool("hash-password", false, "Read a password from stdin, print its hash for the password file and exit")
+	serverConfigFlag := flag.String("server-config", "", "Path of a JSON file with server options; flags override it")
+	addrFlag := flag.String("addr", "", "Address to bind (all interfaces when empty)")
+	unixSocketFlag := flag.String("unix-socket", "", "Listen on this Unix domain socket instead of TCP")
+	tlsCertFlag := flag.String("tls-cert", "", "TLS certificate file, reloaded when it changes")
+	tlsKeyFlag := flag.String("tls-key", "", "TLS private key file, reloaded when it changes")
+	devCertFlag := flag.Bool("dev-cert", false, "Serve TLS with a generated self-signed certificate")
+	http2Flag := flag.Bool("http2", true, "Enable HTTP/2 (h2 over TLS, h2c otherwise)")
+	idTemplateFlag := flag.String("id-template", "", `Template for routine IDs, e.g. "{{.Type}}-{{.Labels.env}}-{{.ULID}}"`)
+	idempotencyFlag := flag.Duration("idempotency-window", routine.DefaultIdempotencyWindow, "How long /start results are replayed for a repeated Idempotency-Key")
+	maxRunningFlag := flag.Int("max-running", 0, "Maximum number of routines running at once (0 for no limit)")
+	maxRunningPerTypeFlag := flag.String("max-running-per-type", "", "Per-type running limits as type=n,type=n")
+	queueStartsFlag := flag.Bool("queue-starts", false, "Queue starts beyond a running limit instead of rejecting them")
+	maxQueuedFlag := flag.Int("max-queued", 0, "Maximum number of queued routines (0 for no limit)")
+	executionFlag := flag.String("execution", "goroutine", "How routines run: goroutine (one each) or pool (shared workers)")
+	workersFlag := flag.Int("workers", 0, "Number of pool workers in pool execution (0 for GOMAXPROCS)")
+	intervalFlag := flag.Duration("interval", 0, "Pause between two iterations of a routine")
+	retentionFlag := flag.Duration("retention", routine.DefaultRetention, "How long tombstones of finished routines are kept")
+	maxTombstonesFlag := flag.Int("max-tombstones", routine.DefaultMaxTombstones, "Maximum number of finished routines kept as tombstones")
+	ratePerTypeFlag := flag.String("rate-per-type", "", "Per-type iteration rate limits as type=rate[:burst],... e.g. fetch=10/s:5")
+	rulesFlag := flag.String("rules", "", "Path of a JSON array of output rules to load at startup")
+	notifyURLFlag := flag.String("notify-url", "", "Webhook URL receiving the notifications of rules (logged when empty)")
+	leaderLockFlag := flag.String("leader-lock", "", "Lock file electing the one replica that runs routines (disabled when empty)")
+	replicaIDFlag := flag.String("replica-id", "", "Name of this replica in leader election (hostname-pid when empty)")
+	advertiseURLFlag := flag.String("advertise-url", "", "URL followers forward requests to when this replica leads (this host's port when empty)")
+	electionIntervalFlag := flag.Duration("election-interval", routine.DefaultElectionInterval, "How often replicas try to take or renew leadership")
+	assetsDirFlag := flag.String("assets-dir", "", "Serve dashboard files from this directory instead of the embedded copy (e.g. routine/static)")
 	flag.Parse()
 
+	// The password is read from stdin so it stays out of the shell history and process list
+	if *hashFlag {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && (err != io.EOF || password == "") {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		hash, err := routine.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatalf("Failed to hash password: %v", err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
 	// Use the specified port or default to 8080
 	port := *portFlag
 
@@ -27,11 +78,186 @@ func main() {
 	routineInstance := NewCustomizedRoutine()
 	scheduler := routine.NewRoutineScheduler[*CustomizedConfig, *CustomizedOutput](port, routineInstance, *interactiveFlag)
 
+	// Server options come from the config file first, then any flag given explicitly
+	if *serverConfigFlag != "" {
+		serverOptions, err := routine.LoadServerOptions(*serverConfigFlag)
+		if err != nil {
+			log.Fatalf("Failed to load server config: %v", err)
+		}
+		scheduler.Server = *serverOptions
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			scheduler.Server.Addr = *addrFlag
+		case "unix-socket":
+			scheduler.Server.UnixSocket = *unixSocketFlag
+		case "tls-cert":
+			scheduler.Server.TLSCert = *tlsCertFlag
+		case "tls-key":
+			scheduler.Server.TLSKey = *tlsKeyFlag
+		case "dev-cert":
+			scheduler.Server.DevCert = *devCertFlag
+		case "http2":
+			scheduler.Server.HTTP2 = *http2Flag
+		}
+	})
+
+	// Serve the dashboard from disk while developing it
+	if *assetsDirFlag != "" {
+		scheduler.AssetsDir = *assetsDirFlag
+		log.Printf("Serving dashboard assets from %s", *assetsDirFlag)
+	}
+
+	scheduler.IdempotencyWindow = *idempotencyFlag
+
+	switch mode := routine.ExecutionMode(*executionFlag); mode {
+	case routine.ExecGoroutine, routine.ExecPool:
+		scheduler.Mode = mode
+	default:
+		log.Fatalf("Invalid execution mode %q", *executionFlag)
+	}
+	scheduler.Workers = *workersFlag
+	scheduler.Interval = *intervalFlag
+	scheduler.Retention = *retentionFlag
+	scheduler.MaxTombstones = *maxTombstonesFlag
+
+	// Cap concurrently running routines
+	limits := routine.Limits{Global: *maxRunningFlag, Queue: *queueStartsFlag, MaxQueued: *maxQueuedFlag}
+	if *maxRunningPerTypeFlag != "" {
+		limits.PerType = make(map[string]int)
+		for _, pair := range strings.Split(*maxRunningPerTypeFlag, ",") {
+			routineType, value, _ := strings.Cut(pair, "=")
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				log.Fatalf("Invalid per-type limit %q", pair)
+			}
+			limits.PerType[strings.TrimSpace(routineType)] = limit
+		}
+	}
+	routine.SetLimits(limits)
+
+	// Throttle iterations of whole routine types
+	if *ratePerTypeFlag != "" {
+		rateLimits := routine.RateLimits{PerType: make(map[string]routine.RateLimit)}
+		for _, pair := range strings.Split(*ratePerTypeFlag, ",") {
+			routineType, value, _ := strings.Cut(pair, "=")
+			rateStr, burstStr, hasBurst := strings.Cut(value, ":")
+			rate, err := routine.ParseRate(rateStr)
+			if err != nil {
+				log.Fatalf("Invalid per-type rate %q: %v", pair, err)
+			}
+			limit := routine.RateLimit{Rate: rate}
+			if hasBurst {
+				if limit.Burst, err = strconv.Atoi(burstStr); err != nil {
+					log.Fatalf("Invalid per-type burst %q", pair)
+				}
+			}
+			rateLimits.PerType[strings.TrimSpace(routineType)] = limit
+		}
+		if err := routine.SetRateLimits(rateLimits); err != nil {
+			log.Fatalf("Invalid rate limits: %v", err)
+		}
+	}
+
+	// Act on routine outputs, e.g. suspend routines whose count grows too large
+	if *rulesFlag != "" {
+		rules, err := routine.LoadRules(*rulesFlag)
+		if err != nil {
+			log.Fatalf("Failed to load rules: %v", err)
+		}
+		if err := scheduler.SetRules(rules); err != nil {
+			log.Fatalf("Invalid rules: %v", err)
+		}
+		log.Printf("Loaded %d rules from %s", len(rules), *rulesFlag)
+	}
+	if *notifyURLFlag != "" {
+		scheduler.Notifier = &routine.WebhookNotifier{URL: *notifyURLFlag}
+	}
+
+	// Run routines on one replica only when several share a lock file
+	if *leaderLockFlag != "" {
+		advertise := *advertiseURLFlag
+		if advertise == "" && scheduler.Server.UnixSocket == "" {
+			scheme := "http"
+			if scheduler.Server.UseTLS() {
+				scheme = "https"
+			}
+			advertise = fmt.Sprintf("%s://localhost:%d", scheme, port)
+		}
+		scheduler.Election = &routine.Election{
+			Elector:  &routine.FileLockElector{Path: *leaderLockFlag},
+			ID:       *replicaIDFlag,
+			URL:      advertise,
+			Interval: *electionIntervalFlag,
+		}
+		// Every replica generates its own development certificate, so none can verify another's
+		if scheduler.Server.DevCert {
+			if u, err := url.Parse(advertise); err == nil && !routine.IsLoopbackHost(u.Hostname()) {
+				log.Printf("Warning: other replicas only skip verifying development certificates on loopback addresses, so they cannot forward to %s", advertise)
+			}
+			scheduler.Election.Transport = routine.DevCertTransport()
+		}
+		log.Printf("Leader election enabled with lock file %s", *leaderLockFlag)
+	}
+
+	// Build routine IDs from a template, e.g. to prefix them with the type or a label
+	if *idTemplateFlag != "" {
+		idTemplate, err := routine.ParseIDTemplate(*idTemplateFlag)
+		if err != nil {
+			log.Fatalf("Invalid ID template: %v", err)
+		}
+		scheduler.IDTemplate = idTemplate
+	}
+
+	// Record control-plane actions if an audit log was requested
+	if *auditFlag != "" {
+		auditLog, err := routine.NewAuditLog(*auditFlag)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		scheduler.Audit = auditLog
+		log.Printf("Writing audit log to %s", *auditFlag)
+	}
+
+	// Require credentials on the control API if an auth config was given
+	if *authFlag != "" {
+		authConfig, err := routine.LoadAuthConfig(*authFlag)
+		if err != nil {
+			log.Fatalf("Failed to load auth config: %v", err)
+		}
+		auth, err := authConfig.Authenticator()
+		if err != nil {
+			log.Fatalf("Failed to set up authentication: %v", err)
+		}
+		scheduler.Auth = auth
+
+		policy, err := authConfig.Policy()
+		if err != nil {
+			log.Fatalf("Failed to set up authorization: %v", err)
+		}
+		scheduler.Policy = policy
+
+		clientCAs, err := authConfig.ClientCAPool()
+		if err != nil {
+			log.Fatalf("Failed to load client CA: %v", err)
+		}
+		scheduler.Server.ClientCAs = clientCAs
+		log.Printf("Authentication enabled from %s", *authFlag)
+	}
+
 	// Start some test routines if in non-interactive mode
 	if !scheduler.InteractiveMode {
 		log.Println("Starting test routines...")
 	}
 
-	// Start the server
+	// Start the server; it returns after a graceful shutdown on SIGINT or SIGTERM
 	scheduler.Serve()
+
+	// Every entry is synced as it is recorded, so closing the audit log is all that is left
+	if scheduler.Audit != nil {
+		if err := scheduler.Audit.Close(); err != nil {
+			log.Printf("Error: closing audit log: %v", err)
+		}
+	}
 }
@@ -0,0 +1,290 @@
+package routine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrLimitReached is returned when a start exceeds a concurrency limit and is not queued
+var ErrLimitReached = errors.New("concurrency limit reached")
+
+// ErrQueueFull is returned when a start would be queued but the admission queue is full
+var ErrQueueFull = errors.New("admission queue is full")
+
+// Limits caps how many routines run at once. Routines waiting for a slot are
+// pending: they are listed with their queue position but run no job and hold
+// no goroutine until admitted.
+type Limits struct {
+	// Global caps running routines of every type together; 0 means no cap
+	Global int `json:"global"`
+	// PerType caps running routines of one type; missing types have no cap
+	PerType map[string]int `json:"per_type,omitempty"`
+	// Queue keeps starts beyond a cap pending until a slot frees;
+	// otherwise they fail with ErrLimitReached
+	Queue bool `json:"queue"`
+	// MaxQueued bounds the number of pending routines; 0 means no bound
+	MaxQueued int `json:"max_queued"`
+}
+
+// admissionTicket is one routine's claim on a running slot
+type admissionTicket struct {
+	routineType string
+	queuedAt    time.Time
+	// priority reads the routine's current priority, which orders the queue
+	priority func() int
+	// start runs the routine once admitted from the queue
+	start func()
+	// admitted is true once the ticket holds a slot; guarded by the controller's mutex
+	admitted bool
+}
+
+// admissionController counts running routines and keeps the queue of pending ones.
+// There is one per process because the limits span every scheduler.
+type admissionController struct {
+	mu            sync.Mutex
+	limits        Limits
+	running       int
+	runningByType map[string]int
+	queue         []*admissionTicket
+}
+
+var admission = &admissionController{runningByType: make(map[string]int)}
+
+// SetLimits replaces the concurrency limits. Raising a limit admits pending
+// routines right away; lowering one never stops running routines.
+func SetLimits(limits Limits) {
+	perType := make(map[string]int, len(limits.PerType))
+	for routineType, limit := range limits.PerType {
+		perType[routineType] = limit
+	}
+	limits.PerType = perType
+
+	admission.mu.Lock()
+	admission.limits = limits
+	admitted := admission.admitLocked()
+	admission.mu.Unlock()
+	startAll(admitted)
+}
+
+// CurrentLimits returns the concurrency limits in effect
+func CurrentLimits() Limits {
+	admission.mu.Lock()
+	defer admission.mu.Unlock()
+	return admission.limits
+}
+
+// fitsLocked reports whether one more routine of the type may run
+func (a *admissionController) fitsLocked(routineType string) bool {
+	if a.limits.Global > 0 && a.running >= a.limits.Global {
+		return false
+	}
+	if limit := a.limits.PerType[routineType]; limit > 0 && a.runningByType[routineType] >= limit {
+		return false
+	}
+	return true
+}
+
+func (a *admissionController) takeSlotLocked(ticket *admissionTicket) {
+	a.running++
+	a.runningByType[ticket.routineType]++
+	ticket.admitted = true
+}
+
+// newAdmissionTicket prepares a ticket; start runs the routine if it is admitted from the queue
+func newAdmissionTicket(routineType string, priority func() int, start func()) *admissionTicket {
+	return &admissionTicket{routineType: routineType, priority: priority, start: start}
+}
+
+// acquire asks for a running slot. The ticket is admitted at once when a slot
+// is free; otherwise it is queued and reported so, and its start function
+// runs when it is admitted later.
+func (a *admissionController) acquire(ticket *admissionTicket) (queued bool, err error) {
+	a.mu.Lock()
+	// The ticket takes its turn in the queue, so it cannot overtake queued routines
+	// competing for the same slot, but it is not held up by routines waiting on
+	// another type's cap either
+	ticket.queuedAt = time.Now()
+	a.queue = append(a.queue, ticket)
+	admitted := a.admitLocked()
+	admitted = slices.DeleteFunc(admitted, func(other *admissionTicket) bool { return other == ticket })
+	if !ticket.admitted {
+		a.queue = slices.DeleteFunc(a.queue, func(other *admissionTicket) bool { return other == ticket })
+		switch {
+		case !a.limits.Queue:
+			err = ErrLimitReached
+		case a.limits.MaxQueued > 0 && len(a.queue) >= a.limits.MaxQueued:
+			err = ErrQueueFull
+		default:
+			a.queue = append(a.queue, ticket)
+			queued = true
+		}
+	}
+	a.mu.Unlock()
+	// Routines the queue should already have admitted start here rather than waiting for a release
+	startAll(admitted)
+	return queued, err
+}
+
+// release frees the slot of a routine that stopped running and admits the next pending ones
+func (a *admissionController) release(ticket *admissionTicket) {
+	a.mu.Lock()
+	a.running--
+	a.runningByType[ticket.routineType]--
+	admitted := a.admitLocked()
+	a.mu.Unlock()
+	startAll(admitted)
+}
+
+// withdraw removes a pending ticket from the queue. It returns false if the
+// ticket was admitted in the meantime, in which case its routine is starting.
+func (a *admissionController) withdraw(ticket *admissionTicket) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ticket.admitted {
+		return false
+	}
+	for i, queued := range a.queue {
+		if queued == ticket {
+			a.queue = append(a.queue[:i], a.queue[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// orderedLocked returns the queue in admission order: by priority with aging,
+// then by arrival
+func (a *admissionController) orderedLocked() []*admissionTicket {
+	ordered := slices.Clone(a.queue)
+	slices.SortStableFunc(ordered, func(x, y *admissionTicket) int {
+		switch {
+		case agedBefore(x.queuedAt, x.priority(), y.queuedAt, y.priority()):
+			return -1
+		case agedBefore(y.queuedAt, y.priority(), x.queuedAt, x.priority()):
+			return 1
+		}
+		return 0
+	})
+	return ordered
+}
+
+// admitLocked gives free slots to queued tickets in admission order. A ticket
+// whose type is at its cap is skipped so it does not hold up routines of other types.
+func (a *admissionController) admitLocked() []*admissionTicket {
+	var admitted []*admissionTicket
+	for _, ticket := range a.orderedLocked() {
+		if !a.fitsLocked(ticket.routineType) {
+			if a.limits.Global > 0 && a.running >= a.limits.Global {
+				break
+			}
+			continue
+		}
+		a.takeSlotLocked(ticket)
+		admitted = append(admitted, ticket)
+	}
+	if len(admitted) > 0 {
+		a.queue = slices.DeleteFunc(a.queue, func(ticket *admissionTicket) bool { return ticket.admitted })
+	}
+	return admitted
+}
+
+// startAll runs the routines admitted from the queue, outside the controller's lock
+func startAll(tickets []*admissionTicket) {
+	for _, ticket := range tickets {
+		ticket.start()
+	}
+}
+
+// positions returns the 1-based admission order of every pending ticket
+func (a *admissionController) positions() map[*admissionTicket]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	positions := make(map[*admissionTicket]int, len(a.queue))
+	for i, ticket := range a.orderedLocked() {
+		positions[ticket] = i + 1
+	}
+	return positions
+}
+
+// AdmissionStatus is a snapshot of the limits and how much of them is in use
+type AdmissionStatus struct {
+	Limits        Limits         `json:"limits"`
+	Running       int            `json:"running"`
+	RunningByType map[string]int `json:"running_by_type"`
+	Queued        int            `json:"queued"`
+	QueuedByType  map[string]int `json:"queued_by_type"`
+}
+
+// Admission returns the current use of the concurrency limits
+func Admission() AdmissionStatus {
+	admission.mu.Lock()
+	defer admission.mu.Unlock()
+	status := AdmissionStatus{
+		Limits:        admission.limits,
+		Running:       admission.running,
+		RunningByType: make(map[string]int),
+		Queued:        len(admission.queue),
+		QueuedByType:  make(map[string]int),
+	}
+	for routineType, running := range admission.runningByType {
+		if running > 0 {
+			status.RunningByType[routineType] = running
+		}
+	}
+	for _, ticket := range admission.queue {
+		status.QueuedByType[ticket.routineType]++
+	}
+	return status
+}
+
+// QueuePosition returns the 1-based position of a pending routine, or 0 if it is not queued
+func (ctrl *RoutineControl[TConfig, TOutput]) QueuePosition() int {
+	if ctrl.ticket == nil {
+		return 0
+	}
+	return admission.positions()[ctrl.ticket]
+}
+
+// handleLimits shows the concurrency limits and their use
+func (s *RoutineScheduler[TConfig, TOutput]) handleLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(Admission())
+}
+
+// handleSetLimits replaces the concurrency limits
+func (s *RoutineScheduler[TConfig, TOutput]) handleSetLimits(w http.ResponseWriter, r *http.Request) {
+	var limits Limits
+	result := NewHandleResult(1, "Failed to set limits")
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		result.SetError(fmt.Errorf("invalid request format: %v", err)).Response(w)
+		return
+	}
+	if limits.Global < 0 || limits.MaxQueued < 0 {
+		result.SetError(errors.New("limits must not be negative")).Response(w)
+		return
+	}
+	for routineType, limit := range limits.PerType {
+		if limit < 0 {
+			result.SetError(fmt.Errorf("limit for type %s must not be negative", routineType)).Response(w)
+			return
+		}
+	}
+
+	audit := auditFrom(r)
+	audit.OldConfig = map[string]string{"limits": limitsJSON(CurrentLimits())}
+	SetLimits(limits)
+	audit.NewConfig = map[string]string{"limits": limitsJSON(limits)}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(Admission())
+}
+
+func limitsJSON(limits Limits) string {
+	data, _ := json.Marshal(limits)
+	return string(data)
+}
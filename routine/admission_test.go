@@ -0,0 +1,192 @@
+package routine
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// admissionStep acquires, releases or withdraws the named ticket and checks
+// the outcome and the routines started from the queue by that step
+type admissionStep struct {
+	op          string // "acquire", "release" or "withdraw"
+	name        string
+	routineType string
+	priority    int
+	queued      bool
+	err         error
+	started     []string
+}
+
+func TestAdmission(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		steps  []admissionStep
+	}{
+		{
+			name: "no limits admit every start",
+			steps: []admissionStep{
+				{op: "acquire", name: "a", routineType: "x"},
+				{op: "acquire", name: "b", routineType: "x"},
+				{op: "acquire", name: "c", routineType: "y"},
+			},
+		},
+		{
+			name:   "a start beyond the global cap fails without a queue",
+			limits: Limits{Global: 1},
+			steps: []admissionStep{
+				{op: "acquire", name: "a", routineType: "x"},
+				{op: "acquire", name: "b", routineType: "y", err: ErrLimitReached},
+				{op: "release", name: "a"},
+				{op: "acquire", name: "c", routineType: "y"},
+			},
+		},
+		{
+			name:   "the queue is bounded",
+			limits: Limits{Global: 1, Queue: true, MaxQueued: 1},
+			steps: []admissionStep{
+				{op: "acquire", name: "a", routineType: "x"},
+				{op: "acquire", name: "b", routineType: "x", queued: true},
+				{op: "acquire", name: "c", routineType: "x", err: ErrQueueFull},
+			},
+		},
+		{
+			name:   "queued starts are admitted by priority, then by arrival",
+			limits: Limits{Global: 1, Queue: true},
+			steps: []admissionStep{
+				{op: "acquire", name: "a", routineType: "x"},
+				{op: "acquire", name: "b", routineType: "x", queued: true},
+				{op: "acquire", name: "c", routineType: "y", queued: true},
+				{op: "acquire", name: "d", routineType: "x", priority: 5, queued: true},
+				{op: "release", name: "a", started: []string{"d"}},
+				{op: "release", name: "d", started: []string{"b"}},
+				{op: "release", name: "b", started: []string{"c"}},
+			},
+		},
+		{
+			name:   "a start of another type is not held up by a type at its cap",
+			limits: Limits{PerType: map[string]int{"x": 1}, Queue: true},
+			steps: []admissionStep{
+				{op: "acquire", name: "x1", routineType: "x"},
+				{op: "acquire", name: "x2", routineType: "x", queued: true},
+				{op: "acquire", name: "y1", routineType: "y"},
+				{op: "release", name: "y1"},
+				{op: "release", name: "x1", started: []string{"x2"}},
+			},
+		},
+		{
+			name:   "type caps and the global cap apply together",
+			limits: Limits{Global: 2, PerType: map[string]int{"x": 1}, Queue: true},
+			steps: []admissionStep{
+				{op: "acquire", name: "x1", routineType: "x"},
+				{op: "acquire", name: "x2", routineType: "x", queued: true},
+				{op: "acquire", name: "y1", routineType: "y"},
+				{op: "acquire", name: "y2", routineType: "y", queued: true},
+				// x2 arrived first and its type has room again
+				{op: "release", name: "x1", started: []string{"x2"}},
+				{op: "release", name: "x2", started: []string{"y2"}},
+			},
+		},
+		{
+			name:   "a start does not overtake queued routines of its type",
+			limits: Limits{PerType: map[string]int{"x": 1}, Queue: true},
+			steps: []admissionStep{
+				{op: "acquire", name: "x1", routineType: "x"},
+				{op: "acquire", name: "x2", routineType: "x", queued: true},
+				{op: "acquire", name: "x3", routineType: "x", queued: true},
+				{op: "release", name: "x1", started: []string{"x2"}},
+			},
+		},
+		{
+			name:   "withdrawn routines are never started",
+			limits: Limits{Global: 1, Queue: true},
+			steps: []admissionStep{
+				{op: "acquire", name: "a", routineType: "x"},
+				{op: "acquire", name: "b", routineType: "x", queued: true},
+				{op: "acquire", name: "c", routineType: "x", queued: true},
+				{op: "withdraw", name: "b"},
+				{op: "release", name: "a", started: []string{"c"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &admissionController{limits: test.limits, runningByType: make(map[string]int)}
+			tickets := make(map[string]*admissionTicket)
+			var started []string
+			for i, step := range test.steps {
+				started = nil
+				switch step.op {
+				case "acquire":
+					name, priority := step.name, step.priority
+					ticket := newAdmissionTicket(step.routineType, func() int { return priority }, func() { started = append(started, name) })
+					tickets[name] = ticket
+					queued, err := a.acquire(ticket)
+					if queued != step.queued || !errors.Is(err, step.err) {
+						t.Fatalf("step %d: acquire %s = (%v, %v), want (%v, %v)", i, name, queued, err, step.queued, step.err)
+					}
+				case "release":
+					a.release(tickets[step.name])
+				case "withdraw":
+					if !a.withdraw(tickets[step.name]) {
+						t.Fatalf("step %d: withdraw %s found it admitted", i, step.name)
+					}
+				}
+				if !slices.Equal(started, step.started) {
+					t.Fatalf("step %d (%s %s): started %v, want %v", i, step.op, step.name, started, step.started)
+				}
+			}
+		})
+	}
+}
+
+func TestAdmissionRaisingLimitAdmitsQueued(t *testing.T) {
+	a := &admissionController{limits: Limits{Global: 1, Queue: true}, runningByType: make(map[string]int)}
+	var started []string
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := a.acquire(newAdmissionTicket("x", func() int { return 0 }, func() { started = append(started, name) })); err != nil {
+			t.Fatalf("acquire %s: %v", name, err)
+		}
+	}
+
+	a.mu.Lock()
+	a.limits.Global = 2
+	admitted := a.admitLocked()
+	a.mu.Unlock()
+	startAll(admitted)
+	if !slices.Equal(started, []string{"b"}) {
+		t.Errorf("started %v, want [b]", started)
+	}
+	if a.running != 2 || len(a.queue) != 1 {
+		t.Errorf("running %d with %d queued, want 2 with 1 queued", a.running, len(a.queue))
+	}
+}
+
+func TestAdmissionWithdrawAdmitted(t *testing.T) {
+	a := &admissionController{limits: Limits{Global: 1, Queue: true}, runningByType: make(map[string]int)}
+	first := newAdmissionTicket("x", func() int { return 0 }, func() {})
+	second := newAdmissionTicket("x", func() int { return 0 }, func() {})
+	a.acquire(first)
+	if queued, _ := a.acquire(second); !queued {
+		t.Fatal("second start should be queued")
+	}
+	a.release(first)
+	if a.withdraw(second) {
+		t.Error("withdraw should report that the admitted routine is starting")
+	}
+}
+
+func TestAdmissionPositions(t *testing.T) {
+	a := &admissionController{limits: Limits{Global: 1, Queue: true}, runningByType: make(map[string]int)}
+	running := newAdmissionTicket("x", func() int { return 0 }, func() {})
+	low := newAdmissionTicket("x", func() int { return 0 }, func() {})
+	high := newAdmissionTicket("x", func() int { return 3 }, func() {})
+	for _, ticket := range []*admissionTicket{running, low, high} {
+		a.acquire(ticket)
+	}
+	positions := a.positions()
+	if len(positions) != 2 || positions[high] != 1 || positions[low] != 2 {
+		t.Errorf("positions = %v, want high first and low second", positions)
+	}
+}
@@ -0,0 +1,70 @@
+package routine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// embeddedAssets holds the dashboard so the binary works from any directory
+//
+//go:embed static
+var embeddedAssets embed.FS
+
+// assetETags caches the ETag of each embedded file, which never changes at runtime
+var assetETags sync.Map // map[string]string
+
+// assetFS returns the filesystem dashboard files are read from
+func (s *RoutineScheduler[TConfig, TOutput]) assetFS() fs.FS {
+	if s.AssetsDir != "" {
+		return os.DirFS(s.AssetsDir)
+	}
+	sub, _ := fs.Sub(embeddedAssets, "static")
+	return sub
+}
+
+// serveAsset writes a dashboard file with cache validation headers
+func (s *RoutineScheduler[TConfig, TOutput]) serveAsset(w http.ResponseWriter, r *http.Request, name string) {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	data, err := fs.ReadFile(s.assetFS(), name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if s.AssetsDir != "" {
+		// Files on disk are being edited, so never let the browser keep a copy
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("ETag", assetETag(data))
+	} else {
+		// Embedded files only change with the binary; revalidate cheaply via the ETag
+		w.Header().Set("Cache-Control", "no-cache")
+		etag, ok := assetETags.Load(name)
+		if !ok {
+			etag, _ = assetETags.LoadOrStore(name, assetETag(data))
+		}
+		w.Header().Set("ETag", etag.(string))
+	}
+
+	// ServeContent answers If-None-Match with 304 and sets the content type from the name
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// assetETag derives a strong ETag from the file content
+func assetETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf(`"%x"`, sum[:16])
+}
+
+// handleStatic serves files under /static/
+func (s *RoutineScheduler[TConfig, TOutput]) handleStatic(w http.ResponseWriter, r *http.Request) {
+	s.serveAsset(w, r, strings.TrimPrefix(r.URL.Path, "/static/"))
+}
@@ -0,0 +1,283 @@
+package routine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is a single record of a control-plane action
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Caller     string    `json:"caller"`
+	RemoteAddr string    `json:"remote_addr"`
+	// ForwardedBy and ForwardedFor are set when a follower forwarded the request:
+	// the follower's replica ID and the caller address it reported
+	ForwardedBy  string            `json:"forwarded_by,omitempty"`
+	ForwardedFor string            `json:"forwarded_for,omitempty"`
+	Action       string            `json:"action"`
+	IDs          []string          `json:"ids,omitempty"`
+	OldConfig    map[string]string `json:"old_config,omitempty"`
+	NewConfig    map[string]string `json:"new_config,omitempty"`
+	// Replayed marks a retry answered with the stored response of an earlier request
+	Replayed bool            `json:"replayed,omitempty"`
+	Status   int             `json:"status"`
+	Result   json.RawMessage `json:"result,omitempty"`
+}
+
+// AuditQuery selects entries from the audit log
+type AuditQuery struct {
+	Since   time.Time
+	Until   time.Time
+	Actions []string
+	Limit   int
+}
+
+// Match reports whether the entry satisfies the query
+func (q AuditQuery) Match(entry *AuditEntry) bool {
+	if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && entry.Time.After(q.Until) {
+		return false
+	}
+	if len(q.Actions) == 0 {
+		return true
+	}
+	for _, action := range q.Actions {
+		if action == entry.Action {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditLog is an append-only log of control-plane actions stored as JSON lines
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewAuditLog opens (or creates) the audit log at the given path
+func NewAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log %s: %v", path, err)
+	}
+	return &AuditLog{path: path, file: file}, nil
+}
+
+// Record appends an entry to the log
+func (a *AuditLog) Record(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(line); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// Query reads the log and returns the entries matching the query.
+// When a limit is set the most recent entries are returned.
+func (a *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Skip a torn or corrupted line rather than failing the whole query
+			continue
+		}
+		if q.Match(&entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+	return entries, nil
+}
+
+// Close closes the underlying file
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+type auditContextKey struct{}
+
+// auditDetails is filled in by handlers with what the action touched
+type auditDetails struct {
+	IDs       []string
+	OldConfig map[string]string
+	NewConfig map[string]string
+	Replayed  bool
+}
+
+// auditFrom returns the audit details attached to the request.
+// It never returns nil so handlers can record unconditionally.
+func auditFrom(r *http.Request) *auditDetails {
+	if details, ok := r.Context().Value(auditContextKey{}).(*auditDetails); ok {
+		return details
+	}
+	return &auditDetails{}
+}
+
+// callerIdentity returns the identity of the caller making the request
+func callerIdentity(r *http.Request) string {
+	if principal := PrincipalFrom(r); principal != nil {
+		return principal.Name
+	}
+	return "anonymous"
+}
+
+// auditRecorder captures the status and body written by a handler
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *auditRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *auditRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// audited wraps a state-changing handler so that every call is recorded
+func (s *RoutineScheduler[TConfig, TOutput]) audited(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Audit == nil {
+			next(w, r)
+			return
+		}
+
+		details := &auditDetails{}
+		r = r.WithContext(context.WithValue(r.Context(), auditContextKey{}, details))
+		rec := &auditRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		entry := &AuditEntry{
+			Time:       time.Now(),
+			Caller:     callerIdentity(r),
+			RemoteAddr: r.RemoteAddr,
+			Action:     action,
+			IDs:        details.IDs,
+			OldConfig:  details.OldConfig,
+			NewConfig:  details.NewConfig,
+			Replayed:   details.Replayed,
+			Status:     rec.status,
+		}
+		if by := r.Header.Get(forwardedHeader); by != "" {
+			entry.ForwardedBy = by
+			entry.ForwardedFor = r.Header.Get("X-Forwarded-For")
+		}
+		if result := bytes.TrimSpace(rec.body.Bytes()); json.Valid(result) {
+			entry.Result = json.RawMessage(result)
+		}
+		if err := s.Audit.Record(entry); err != nil {
+			log.Printf("Error: could not write audit entry: %v", err)
+		}
+	}
+}
+
+// snapshotConfigs captures the current config of each routine as JSON.
+// SerializeConfig is meant for display and may drop fields, so it is only
+// used when the config cannot be marshaled.
+func (s *RoutineScheduler[TConfig, TOutput]) snapshotConfigs(ids []string) map[string]string {
+	configs := make(map[string]string, len(ids))
+	for _, id := range ids {
+		if val, ok := routineMap.Load(id); ok {
+			if ctrl, ok := val.(*RoutineControl[TConfig, TOutput]); ok {
+				config := ctrl.Config.Load().(TConfig)
+				if data, err := json.Marshal(config); err == nil {
+					configs[id] = string(data)
+				} else {
+					configs[id] = s.Routine.SerializeConfig(config)
+				}
+			}
+		}
+	}
+	return configs
+}
+
+// handleAudit returns audit entries filtered by time range and action
+func (s *RoutineScheduler[TConfig, TOutput]) handleAudit(w http.ResponseWriter, r *http.Request) {
+	result := NewHandleResult(0, "Failed to query audit log")
+	if s.Audit == nil {
+		result.SetError(fmt.Errorf("audit log is not enabled")).Response(w)
+		return
+	}
+
+	var q AuditQuery
+	var err error
+	query := r.URL.Query()
+	if since := query.Get("since"); since != "" {
+		if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			result.SetError(fmt.Errorf("invalid since parameter: %v", err)).Response(w)
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if q.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			result.SetError(fmt.Errorf("invalid until parameter: %v", err)).Response(w)
+			return
+		}
+	}
+	if actions := query.Get("action"); actions != "" {
+		q.Actions = strings.Split(actions, ",")
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			result.SetError(fmt.Errorf("invalid limit parameter: %v", err)).Response(w)
+			return
+		}
+	}
+
+	entries, err := s.Audit.Query(q)
+	if err != nil {
+		result.SetError(fmt.Errorf("could not read audit log: %v", err)).Response(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,410 @@
+package routine
+
+import (
+	"container/list"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Principal is an authenticated caller of the control API
+type Principal struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+}
+
+// Authenticator identifies the caller of a request.
+// It returns nil and no error when the request carries no credentials it understands,
+// and an error when credentials are present but invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// ErrInvalidCredentials is returned when a request carries credentials that do not match
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// TokenAuthenticator accepts static bearer tokens
+type TokenAuthenticator struct {
+	// Tokens maps a bearer token to the name of its owner
+	Tokens map[string]string
+}
+
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	auth := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+
+	// Compare against every token so timing does not reveal a partial match
+	var name string
+	for candidate, owner := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			name = owner
+		}
+	}
+	if name == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: name, Method: "token"}, nil
+}
+
+// BasicAuthenticator accepts HTTP basic auth checked against hashed passwords
+type BasicAuthenticator struct {
+	// Users maps a user name to a hash produced by HashPassword
+	Users map[string]string
+
+	// verified caches digests of credentials that already passed, since
+	// the dashboard sends them on every poll and hashing is deliberately slow
+	verified credentialCache
+}
+
+// maxVerifiedCredentials bounds the basic auth cache; the least recently used entries are dropped first
+const maxVerifiedCredentials = 1024
+
+// credentialCache is a bounded LRU set of credential digests; the zero value is empty
+type credentialCache struct {
+	mu      sync.Mutex
+	order   *list.List // Most recently used first
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+// contains reports whether the digest is cached and marks it as recently used
+func (c *credentialCache) contains(digest [sha256.Size]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[digest]
+	if ok {
+		c.order.MoveToFront(element)
+	}
+	return ok
+}
+
+// add caches the digest, dropping the least recently used one when full
+func (c *credentialCache) add(digest [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.order = list.New()
+		c.entries = make(map[[sha256.Size]byte]*list.Element)
+	}
+	if element, ok := c.entries[digest]; ok {
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[digest] = c.order.PushFront(digest)
+	if c.order.Len() > maxVerifiedCredentials {
+		oldest := c.order.Remove(c.order.Back()).([sha256.Size]byte)
+		delete(c.entries, oldest)
+	}
+}
+
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	digest := sha256.Sum256([]byte(user + "\x00" + password))
+	if a.verified.contains(digest) {
+		return &Principal{Name: user, Method: "basic"}, nil
+	}
+
+	hash, found := a.Users[user]
+	if !found {
+		// Still do the expensive work so unknown users are not distinguishable
+		VerifyPassword(dummyPasswordHash(), password)
+		return nil, ErrInvalidCredentials
+	}
+	if !VerifyPassword(hash, password) {
+		return nil, ErrInvalidCredentials
+	}
+	a.verified.add(digest)
+	return &Principal{Name: user, Method: "basic"}, nil
+}
+
+// CertAuthenticator accepts TLS client certificates verified by the server
+type CertAuthenticator struct {
+	// Names maps a certificate common name to a principal name.
+	// When empty, any verified certificate is accepted under its common name.
+	Names map[string]string
+}
+
+func (a *CertAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(a.Names) == 0 {
+		return &Principal{Name: commonName, Method: "mtls"}, nil
+	}
+	name, ok := a.Names[commonName]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: name, Method: "mtls"}, nil
+}
+
+// AuthChain tries each authenticator in turn and uses the first that recognizes the request
+type AuthChain []Authenticator
+
+func (chain AuthChain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, auth := range chain {
+		principal, err := auth.Authenticate(r)
+		if err != nil || principal != nil {
+			return principal, err
+		}
+	}
+	return nil, nil
+}
+
+// AuthConfig describes where credentials come from. It is usually loaded from a JSON file.
+type AuthConfig struct {
+	// Tokens are static bearer tokens
+	Tokens []struct {
+		Token string `json:"token"`
+		User  string `json:"user"`
+	} `json:"tokens"`
+	// PasswordFile holds "user:hash" lines for basic auth
+	PasswordFile string `json:"password_file"`
+	// ClientCA is a PEM bundle used to verify client certificates
+	ClientCA string `json:"client_ca"`
+	// ClientCerts maps certificate common names to user names
+	ClientCerts []struct {
+		CommonName string `json:"common_name"`
+		User       string `json:"user"`
+	} `json:"client_certs"`
+	// Grants maps user names to roles; when empty every authenticated user is an admin
+	Grants map[string][]Grant `json:"grants"`
+	// DefaultGrants apply to authenticated users not listed in Grants
+	DefaultGrants []Grant `json:"default_grants"`
+}
+
+// LoadAuthConfig reads an AuthConfig from a JSON file.
+// Relative file paths inside it are resolved against the config file's directory.
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config AuthConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid auth config %s: %v", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	if config.PasswordFile != "" && !filepath.IsAbs(config.PasswordFile) {
+		config.PasswordFile = filepath.Join(dir, config.PasswordFile)
+	}
+	if config.ClientCA != "" && !filepath.IsAbs(config.ClientCA) {
+		config.ClientCA = filepath.Join(dir, config.ClientCA)
+	}
+	return &config, nil
+}
+
+// Authenticator builds the authenticator chain described by the config
+func (c *AuthConfig) Authenticator() (Authenticator, error) {
+	var chain AuthChain
+
+	if len(c.Tokens) > 0 {
+		tokens := make(map[string]string, len(c.Tokens))
+		for _, t := range c.Tokens {
+			if t.Token == "" || t.User == "" {
+				return nil, errors.New("auth config: token entries need both token and user")
+			}
+			tokens[t.Token] = t.User
+		}
+		chain = append(chain, &TokenAuthenticator{Tokens: tokens})
+	}
+
+	if c.PasswordFile != "" {
+		users, err := LoadPasswordFile(c.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, &BasicAuthenticator{Users: users})
+	}
+
+	if c.ClientCA != "" {
+		names := make(map[string]string, len(c.ClientCerts))
+		for _, cert := range c.ClientCerts {
+			names[cert.CommonName] = cert.User
+		}
+		chain = append(chain, &CertAuthenticator{Names: names})
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New("auth config does not define any credentials")
+	}
+	return chain, nil
+}
+
+// Policy builds the authorization policy described by the config, or nil if it defines no grants
+func (c *AuthConfig) Policy() (*Policy, error) {
+	if len(c.Grants) == 0 && len(c.DefaultGrants) == 0 {
+		return nil, nil
+	}
+	for user, grants := range c.Grants {
+		if err := validateGrants(grants); err != nil {
+			return nil, fmt.Errorf("auth config: grants of %s: %v", user, err)
+		}
+	}
+	if err := validateGrants(c.DefaultGrants); err != nil {
+		return nil, fmt.Errorf("auth config: default grants: %v", err)
+	}
+	return &Policy{Grants: c.Grants, Default: c.DefaultGrants}, nil
+}
+
+// ClientCAPool loads the CA bundle used to verify client certificates, or nil if none is configured
+func (c *AuthConfig) ClientCAPool() (*x509.CertPool, error) {
+	if c.ClientCA == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", c.ClientCA)
+	}
+	return pool, nil
+}
+
+// LoadPasswordFile reads "user:hash" lines. Blank lines and lines starting with # are ignored.
+func LoadPasswordFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" || hash == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, i+1)
+		}
+		users[user] = hash
+	}
+	return users, nil
+}
+
+const (
+	passwordHashScheme     = "pbkdf2-sha256"
+	passwordHashIterations = 600000
+	passwordHashKeyLength  = 32
+)
+
+// dummyPasswordHash is verified against for unknown users
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("")
+	return hash
+})
+
+// HashPassword hashes a password for storage in a password file.
+// The result has the form pbkdf2-sha256$iterations$salt$key.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIterations, passwordHashKeyLength)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword reports whether the password matches a hash produced by HashPassword
+func VerifyPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+type principalContextKey struct{}
+
+// PrincipalFrom returns the authenticated caller of the request, or nil when authentication is disabled
+func PrincipalFrom(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principalContextKey{}).(*Principal)
+	return principal
+}
+
+// publicPaths, along with everything under /static/, can be fetched without
+// credentials so the dashboard can render its login form
+var publicPaths = map[string]bool{
+	"/": true,
+}
+
+// authenticate rejects requests without valid credentials and attaches the caller to the context
+func (s *RoutineScheduler[TConfig, TOutput]) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Auth == nil || publicPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/static/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, err := s.Auth.Authenticate(r)
+		if principal == nil {
+			if err == nil {
+				err = errors.New("authentication required")
+			}
+			// Advertise bearer rather than basic so browsers do not show their own prompt
+			w.Header().Set("WWW-Authenticate", `Bearer realm="routine"`)
+			result := NewHandleResult(0, "Authentication failed")
+			result.SetError(err).Status(http.StatusUnauthorized).Response(w)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal)))
+	})
+}
+
+// handleWhoami returns the authenticated caller
+func (s *RoutineScheduler[TConfig, TOutput]) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	principal := PrincipalFrom(r)
+	if principal == nil {
+		principal = &Principal{Name: "anonymous", Method: "none"}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"principal":   principal,
+		"grants":      s.grantsFor(r),
+		"authEnabled": s.Auth != nil,
+	})
+}
@@ -0,0 +1,214 @@
+package routine
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// cheapHash builds a password hash with few iterations so tests stay fast
+func cheapHash(t *testing.T, password string) string {
+	t.Helper()
+	salt := []byte("0123456789abcdef")
+	key, err := pbkdf2.Key(sha256.New, password, salt, 10, passwordHashKeyLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, 10,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, fmt.Sprintf("%s$%d$", passwordHashScheme, passwordHashIterations)) {
+		t.Errorf("hash %s does not name the scheme and iterations", hash)
+	}
+	if !VerifyPassword(hash, "s3cret") {
+		t.Error("the password does not verify against its hash")
+	}
+	if VerifyPassword(hash, "s3cret ") {
+		t.Error("a different password verifies")
+	}
+	if again, _ := HashPassword("s3cret"); again == hash {
+		t.Error("two hashes of one password share a salt")
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	hash := cheapHash(t, "s3cret")
+	parts := strings.Split(hash, "$")
+	tests := []struct {
+		name, hash, password string
+		want                 bool
+	}{
+		{"match", hash, "s3cret", true},
+		{"wrong password", hash, "secret", false},
+		{"empty password", hash, "", false},
+		{"other scheme", "bcrypt$" + strings.Join(parts[1:], "$"), "s3cret", false},
+		{"missing part", strings.Join(parts[:3], "$"), "s3cret", false},
+		{"bad iterations", strings.Join([]string{parts[0], "x", parts[2], parts[3]}, "$"), "s3cret", false},
+		{"zero iterations", strings.Join([]string{parts[0], "0", parts[2], parts[3]}, "$"), "s3cret", false},
+		{"other iterations", strings.Join([]string{parts[0], "11", parts[2], parts[3]}, "$"), "s3cret", false},
+		{"bad salt", strings.Join([]string{parts[0], parts[1], "!!", parts[3]}, "$"), "s3cret", false},
+		{"bad key", strings.Join([]string{parts[0], parts[1], parts[2], "!!"}, "$"), "s3cret", false},
+		{"empty hash", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := VerifyPassword(test.hash, test.password); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	auth := &TokenAuthenticator{Tokens: map[string]string{"t0k3n": "ci", "other": "ops"}}
+	tests := []struct {
+		name, header string
+		want         *Principal
+		err          error
+	}{
+		{"valid token", "Bearer t0k3n", &Principal{Name: "ci", Method: "token"}, nil},
+		{"second token", "Bearer other", &Principal{Name: "ops", Method: "token"}, nil},
+		{"unknown token", "Bearer nope", nil, ErrInvalidCredentials},
+		{"token prefix", "Bearer t0k", nil, ErrInvalidCredentials},
+		{"empty token", "Bearer ", nil, ErrInvalidCredentials},
+		{"no header", "", nil, nil},
+		{"other scheme", "Basic dXNlcjpwYXNz", nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/status", nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			got, err := auth.Authenticate(r)
+			if !errors.Is(err, test.err) || !samePrincipal(got, test.want) {
+				t.Errorf("got (%+v, %v), want (%+v, %v)", got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func TestBasicAuthenticator(t *testing.T) {
+	auth := &BasicAuthenticator{Users: map[string]string{"alice": cheapHash(t, "s3cret")}}
+	tests := []struct {
+		name, user, password string
+		basic                bool
+		want                 *Principal
+		err                  error
+	}{
+		{"valid password", "alice", "s3cret", true, &Principal{Name: "alice", Method: "basic"}, nil},
+		{"cached password", "alice", "s3cret", true, &Principal{Name: "alice", Method: "basic"}, nil},
+		{"wrong password", "alice", "secret", true, nil, ErrInvalidCredentials},
+		{"unknown user", "bob", "s3cret", true, nil, ErrInvalidCredentials},
+		{"no credentials", "", "", false, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/status", nil)
+			if test.basic {
+				r.SetBasicAuth(test.user, test.password)
+			}
+			got, err := auth.Authenticate(r)
+			if !errors.Is(err, test.err) || !samePrincipal(got, test.want) {
+				t.Errorf("got (%+v, %v), want (%+v, %v)", got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func TestCredentialCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	var cache credentialCache
+	digest := func(i int) [sha256.Size]byte { return sha256.Sum256([]byte(fmt.Sprint(i))) }
+	for i := range maxVerifiedCredentials {
+		cache.add(digest(i))
+	}
+	// Using the oldest entry keeps it; the next oldest is dropped instead
+	if !cache.contains(digest(0)) {
+		t.Fatal("the first entry should still be cached")
+	}
+	cache.add(digest(maxVerifiedCredentials))
+	if !cache.contains(digest(0)) {
+		t.Error("the recently used entry was evicted")
+	}
+	if cache.contains(digest(1)) {
+		t.Error("the least recently used entry was kept")
+	}
+	if len(cache.entries) != maxVerifiedCredentials || cache.order.Len() != maxVerifiedCredentials {
+		t.Errorf("cache holds %d entries, want %d", len(cache.entries), maxVerifiedCredentials)
+	}
+}
+
+func TestCertAuthenticator(t *testing.T) {
+	withCert := func(commonName string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	tests := []struct {
+		name  string
+		names map[string]string
+		tls   *tls.ConnectionState
+		want  *Principal
+		err   error
+	}{
+		{"any verified certificate", nil, withCert("alice"), &Principal{Name: "alice", Method: "mtls"}, nil},
+		{"mapped common name", map[string]string{"alice": "ops"}, withCert("alice"), &Principal{Name: "ops", Method: "mtls"}, nil},
+		{"unmapped common name", map[string]string{"alice": "ops"}, withCert("mallory"), nil, ErrInvalidCredentials},
+		{"no TLS", nil, nil, nil, nil},
+		{"no client certificate", nil, &tls.ConnectionState{}, nil, nil},
+		{"unverified certificate", nil, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "alice"}}}}, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/status", nil)
+			r.TLS = test.tls
+			got, err := (&CertAuthenticator{Names: test.names}).Authenticate(r)
+			if !errors.Is(err, test.err) || !samePrincipal(got, test.want) {
+				t.Errorf("got (%+v, %v), want (%+v, %v)", got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func TestAuthChain(t *testing.T) {
+	chain := AuthChain{
+		&TokenAuthenticator{Tokens: map[string]string{"t0k3n": "ci"}},
+		&BasicAuthenticator{Users: map[string]string{"alice": cheapHash(t, "s3cret")}},
+	}
+	r := httptest.NewRequest("GET", "/status", nil)
+	r.SetBasicAuth("alice", "s3cret")
+	if got, err := chain.Authenticate(r); err != nil || !samePrincipal(got, &Principal{Name: "alice", Method: "basic"}) {
+		t.Errorf("basic auth through the chain = (%+v, %v)", got, err)
+	}
+
+	r = httptest.NewRequest("GET", "/status", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	if _, err := chain.Authenticate(r); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("an invalid token should stop the chain, got %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "/status", nil)
+	if got, err := chain.Authenticate(r); got != nil || err != nil {
+		t.Errorf("a request without credentials = (%+v, %v), want neither", got, err)
+	}
+}
+
+func samePrincipal(a, b *Principal) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
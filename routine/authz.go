@@ -0,0 +1,190 @@
+package routine
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Permission names an operation on the control API
+type Permission string
+
+const (
+	PermViewStatus   Permission = "status:read"
+	PermStart        Permission = "routine:start"
+	PermStop         Permission = "routine:stop"
+	PermSuspend      Permission = "routine:suspend"
+	PermResume       Permission = "routine:resume"
+	PermUpdateConfig Permission = "routine:update-config"
+	PermSwitchMode   Permission = "mode:switch"
+	PermReadAudit    Permission = "audit:read"
+	PermManageLimits Permission = "limits:write"
+	PermManageRules  Permission = "rules:write"
+)
+
+// Role is a named set of permissions
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// rolePermissions lists what each role may do. Each role includes the one before it.
+var rolePermissions = map[Role][]Permission{
+	RoleViewer:   {PermViewStatus},
+	RoleOperator: {PermViewStatus, PermSuspend, PermResume},
+	RoleAdmin: {PermViewStatus, PermSuspend, PermResume,
+		PermStart, PermStop, PermUpdateConfig, PermSwitchMode, PermReadAudit, PermManageLimits, PermManageRules},
+}
+
+// Grant gives a role to a caller, optionally limited to some routine types or tags.
+// An empty Types or Tags list does not restrict on that dimension.
+type Grant struct {
+	Role  Role     `json:"role"`
+	Types []string `json:"types,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// Scoped reports whether the grant is limited to some routines
+func (g Grant) Scoped() bool {
+	return len(g.Types) > 0 || len(g.Tags) > 0
+}
+
+// Allows reports whether the grant permits perm on a routine of the given type and tags
+func (g Grant) Allows(perm Permission, routineType string, tags []string) bool {
+	if !slices.Contains(rolePermissions[g.Role], perm) {
+		return false
+	}
+	if len(g.Types) > 0 && !slices.Contains(g.Types, routineType) {
+		return false
+	}
+	if len(g.Tags) > 0 && !slices.ContainsFunc(tags, func(tag string) bool {
+		return slices.Contains(g.Tags, tag)
+	}) {
+		return false
+	}
+	return true
+}
+
+// Policy maps principals to their grants
+type Policy struct {
+	// Grants maps a principal name to its grants
+	Grants map[string][]Grant
+	// Default applies to authenticated principals without their own entry
+	Default []Grant
+}
+
+// GrantsFor returns the grants of a principal
+func (p *Policy) GrantsFor(principal *Principal) []Grant {
+	if principal != nil {
+		if grants, ok := p.Grants[principal.Name]; ok {
+			return grants
+		}
+	}
+	return p.Default
+}
+
+// validateGrants checks that every grant names a known role
+func validateGrants(grants []Grant) error {
+	for _, grant := range grants {
+		if _, ok := rolePermissions[grant.Role]; !ok {
+			return fmt.Errorf("unknown role %q", grant.Role)
+		}
+	}
+	return nil
+}
+
+// PermissionError reports which permission a caller was missing
+type PermissionError struct {
+	Permission Permission
+	ID         string
+}
+
+func (e *PermissionError) Error() string {
+	if e.ID != "" {
+		return fmt.Sprintf("permission denied: missing %s on routine %s", e.Permission, e.ID)
+	}
+	return fmt.Sprintf("permission denied: missing %s", e.Permission)
+}
+
+// adminGrants is what every caller gets when no policy is configured
+var adminGrants = []Grant{{Role: RoleAdmin}}
+
+// grantsFor returns the grants of the caller making the request
+func (s *RoutineScheduler[TConfig, TOutput]) grantsFor(r *http.Request) []Grant {
+	if s.Policy == nil {
+		return adminGrants
+	}
+	return s.Policy.GrantsFor(PrincipalFrom(r))
+}
+
+// routineType is the type name used to scope grants to this scheduler's routines
+func (s *RoutineScheduler[TConfig, TOutput]) routineType() string {
+	if s.Routine.Type != "" {
+		return s.Routine.Type
+	}
+	return "default"
+}
+
+// can reports whether the caller may apply perm to a routine with the given tags
+func (s *RoutineScheduler[TConfig, TOutput]) can(r *http.Request, perm Permission, tags []string) bool {
+	return slices.ContainsFunc(s.grantsFor(r), func(g Grant) bool {
+		return g.Allows(perm, s.routineType(), tags)
+	})
+}
+
+// checkTargets returns a PermissionError for the first routine the caller may not apply perm to
+func (s *RoutineScheduler[TConfig, TOutput]) checkTargets(r *http.Request, perm Permission, ids []string) error {
+	for _, id := range ids {
+		val, ok := routineMap.Load(id)
+		if !ok {
+			// Missing routines are reported by the operation itself
+			continue
+		}
+		ctrl, ok := val.(*RoutineControl[TConfig, TOutput])
+		if !ok {
+			continue
+		}
+		if !s.can(r, perm, ctrl.Tags) {
+			return &PermissionError{Permission: perm, ID: id}
+		}
+	}
+	return nil
+}
+
+// authorized rejects callers that hold no grant at all for perm.
+// Scoped grants still pass here and are checked per routine by the handler.
+func (s *RoutineScheduler[TConfig, TOutput]) authorized(perm Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := slices.ContainsFunc(s.grantsFor(r), func(g Grant) bool {
+			return slices.Contains(rolePermissions[g.Role], perm)
+		})
+		if !allowed {
+			denied(w, &PermissionError{Permission: perm})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authorizedGlobal rejects callers that do not hold perm without any scope,
+// for operations that affect the whole scheduler rather than single routines
+func (s *RoutineScheduler[TConfig, TOutput]) authorizedGlobal(perm Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := slices.ContainsFunc(s.grantsFor(r), func(g Grant) bool {
+			return !g.Scoped() && slices.Contains(rolePermissions[g.Role], perm)
+		})
+		if !allowed {
+			denied(w, &PermissionError{Permission: perm})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// denied writes a 403 response explaining the missing permission
+func denied(w http.ResponseWriter, err error) {
+	NewHandleResult(0, "Permission denied").SetError(err).Status(http.StatusForbidden).Response(w)
+}
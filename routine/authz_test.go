@@ -0,0 +1,171 @@
+package routine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrantAllows(t *testing.T) {
+	tests := []struct {
+		name  string
+		grant Grant
+		perm  Permission
+		rtype string
+		tags  []string
+		want  bool
+	}{
+		{"viewer reads status", Grant{Role: RoleViewer}, PermViewStatus, "job", nil, true},
+		{"viewer cannot suspend", Grant{Role: RoleViewer}, PermSuspend, "job", nil, false},
+		{"operator suspends", Grant{Role: RoleOperator}, PermSuspend, "job", nil, true},
+		{"operator resumes", Grant{Role: RoleOperator}, PermResume, "job", nil, true},
+		{"operator cannot stop", Grant{Role: RoleOperator}, PermStop, "job", nil, false},
+		{"operator cannot start", Grant{Role: RoleOperator}, PermStart, "job", nil, false},
+		{"admin stops", Grant{Role: RoleAdmin}, PermStop, "job", nil, true},
+		{"admin manages rules", Grant{Role: RoleAdmin}, PermManageRules, "job", nil, true},
+		{"unknown role allows nothing", Grant{Role: "root"}, PermViewStatus, "job", nil, false},
+		{"type scope matches", Grant{Role: RoleAdmin, Types: []string{"job"}}, PermStop, "job", nil, true},
+		{"type scope excludes", Grant{Role: RoleAdmin, Types: []string{"job"}}, PermStop, "batch", nil, false},
+		{"tag scope matches one tag", Grant{Role: RoleOperator, Tags: []string{"team-a"}}, PermSuspend, "job", []string{"prod", "team-a"}, true},
+		{"tag scope excludes", Grant{Role: RoleOperator, Tags: []string{"team-a"}}, PermSuspend, "job", []string{"team-b"}, false},
+		{"tag scope excludes untagged", Grant{Role: RoleOperator, Tags: []string{"team-a"}}, PermSuspend, "job", nil, false},
+		{"type and tag scopes both apply", Grant{Role: RoleAdmin, Types: []string{"job"}, Tags: []string{"team-a"}}, PermStop, "batch", []string{"team-a"}, false},
+		{"scope does not add permissions", Grant{Role: RoleViewer, Tags: []string{"team-a"}}, PermStop, "job", []string{"team-a"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.grant.Allows(test.perm, test.rtype, test.tags); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// authzRequest is one request through the control API and the status it should get
+type authzRequest struct {
+	name, caller, method, target, body string
+	status                             int
+	audited                            bool
+}
+
+func TestRoutesAuthorize(t *testing.T) {
+	policy := &Policy{Grants: map[string][]Grant{
+		"viewer":   {{Role: RoleViewer}},
+		"operator": {{Role: RoleOperator}},
+		"admin":    {{Role: RoleAdmin}},
+		"team-a":   {{Role: RoleAdmin, Tags: []string{"team-a"}}},
+		"other":    {{Role: RoleAdmin, Types: []string{"batch"}}},
+	}}
+	tests := []authzRequest{
+		{"viewer reads status", "viewer", http.MethodGet, "/status", "", http.StatusOK, false},
+		{"anonymous caller has no grants", "", http.MethodGet, "/status", "", http.StatusForbidden, false},
+		{"viewer cannot stop", "viewer", http.MethodPost, "/stop", `["x"]`, http.StatusForbidden, true},
+		{"operator cannot start", "operator", http.MethodPost, "/start?count=1", "", http.StatusForbidden, true},
+		{"operator cannot purge tombstones", "operator", http.MethodPost, "/tombstones/purge", "", http.StatusForbidden, true},
+		{"admin of another type cannot purge", "other", http.MethodPost, "/tombstones/purge", `["a1"]`, http.StatusForbidden, true},
+		{"scoped admin cannot purge another team's tombstone", "team-a", http.MethodPost, "/tombstones/purge", `["b1"]`, http.StatusForbidden, true},
+		{"scoped admin cannot set limits", "team-a", http.MethodPost, "/limits", `{}`, http.StatusForbidden, true},
+		{"scoped admin cannot manage rules", "team-a", http.MethodPost, "/rules", `{}`, http.StatusForbidden, true},
+		{"scoped admin cannot switch mode", "team-a", http.MethodPost, "/switch?mode=on", "", http.StatusForbidden, true},
+		{"scoped admin cannot read the audit log", "team-a", http.MethodGet, "/audit", "", http.StatusForbidden, false},
+		{"admin reads the audit log", "admin", http.MethodGet, "/audit", "", http.StatusOK, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, audit := newAuthzScheduler(t, policy)
+			w := serveAs(s, test.caller, test.method, test.target, test.body)
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			entries, err := audit.Query(AuditQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.audited != (len(entries) == 1) {
+				t.Fatalf("%d audit entries, want audited %v", len(entries), test.audited)
+			}
+			if test.audited && (entries[0].Status != test.status || entries[0].Caller != callerName(test.caller)) {
+				t.Errorf("audited %s with status %d, want %s with %d", entries[0].Caller, entries[0].Status, callerName(test.caller), test.status)
+			}
+		})
+	}
+}
+
+func TestPurgeTombstonesScope(t *testing.T) {
+	policy := &Policy{Grants: map[string][]Grant{
+		"team-a": {{Role: RoleAdmin, Tags: []string{"team-a"}}},
+		"admin":  {{Role: RoleAdmin}},
+	}}
+	tests := []struct {
+		caller string
+		left   []string
+	}{
+		{"team-a", []string{"b1"}},
+		{"admin", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.caller, func(t *testing.T) {
+			s, _ := newAuthzScheduler(t, policy)
+			// Purging everything only reaches the tombstones the caller could have stopped
+			if w := serveAs(s, test.caller, http.MethodPost, "/tombstones/purge", ""); w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var left []string
+			for _, entry := range s.Tombstones() {
+				left = append(left, entry.ID)
+			}
+			if !slices.Equal(left, test.left) {
+				t.Errorf("tombstones left %v, want %v", left, test.left)
+			}
+		})
+	}
+}
+
+// newAuthzScheduler returns a scheduler enforcing policy with an audit log and
+// the tombstones a1 and a2 tagged team-a and b1 tagged team-b
+func newAuthzScheduler(t *testing.T, policy *Policy) (*RoutineScheduler[*testConfig, int], *AuditLog) {
+	t.Helper()
+	audit, err := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	s.Policy = policy
+	s.Audit = audit
+	finished := time.Now().Add(-time.Minute)
+	for _, entry := range []Tombstone{
+		{ID: "a1", Tags: []string{"team-a"}},
+		{ID: "a2", Tags: []string{"team-a"}},
+		{ID: "b1", Tags: []string{"team-b"}},
+	} {
+		entry.Type = s.routineType()
+		entry.State = StateStopped
+		entry.FinishedAt = finished
+		s.tombstones.add(&tombstone[*testConfig, int]{Tombstone: entry}, time.Hour, 10)
+	}
+	return s, audit
+}
+
+// serveAs sends a request through the scheduler's routes as the named caller, or anonymously
+func serveAs(s *RoutineScheduler[*testConfig, int], caller, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if caller != "" {
+		r = r.WithContext(context.WithValue(r.Context(), principalContextKey{}, &Principal{Name: caller}))
+	}
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, r)
+	return w
+}
+
+func callerName(caller string) string {
+	if caller == "" {
+		return "anonymous"
+	}
+	return caller
+}
@@ -1,35 +1,106 @@
 package routine
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func (s *RoutineScheduler[TConfig, TOutput]) Serve() {
+// shutdownTimeout bounds how long Serve waits for requests and routines to finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// routes builds the control API. Audited actions are audited around the
+// permission check, so refused attempts are recorded too.
+func (s *RoutineScheduler[TConfig, TOutput]) routes() *http.ServeMux {
 	// Create a new ServeMux for this scheduler instance
 	mux := http.NewServeMux()
 
 	// Register handlers for this scheduler instance
 	mux.HandleFunc("/", s.handleHome)
-	mux.HandleFunc("/start", s.handleStart)
-	mux.HandleFunc("/stop", s.handleStop)
-	mux.HandleFunc("/suspend", s.handleSuspend)
-	mux.HandleFunc("/resume", s.handleResume)
-	mux.HandleFunc("/update-config", s.handleUpdateConfig)
-	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/static/", s.handleStatic)
+	mux.HandleFunc("/start", s.audited("start", s.authorized(PermStart, s.idempotent(s.handleStart))))
+	mux.HandleFunc("/stop", s.audited("stop", s.authorized(PermStop, s.handleStop)))
+	mux.HandleFunc("/suspend", s.audited("suspend", s.authorized(PermSuspend, s.handleSuspend)))
+	mux.HandleFunc("/resume", s.audited("resume", s.authorized(PermResume, s.handleResume)))
+	mux.HandleFunc("/update-config", s.audited("update-config", s.authorized(PermUpdateConfig, s.handleUpdateConfig)))
+	mux.HandleFunc("/status", s.authorized(PermViewStatus, s.handleStatus))
+	mux.HandleFunc("/routine", s.authorized(PermViewStatus, s.handleRoutineDetail))
+	mux.HandleFunc("/config-schema", s.authorized(PermViewStatus, s.handleConfigSchema))
+	mux.HandleFunc("/config-versions", s.authorized(PermViewStatus, s.handleConfigVersions))
+	mux.HandleFunc("/config-diff", s.authorized(PermViewStatus, s.handleConfigDiff))
+	mux.HandleFunc("/rollback", s.audited("rollback", s.authorized(PermUpdateConfig, s.handleRollback)))
+	mux.HandleFunc("GET /limits", s.authorized(PermViewStatus, s.handleLimits))
+	mux.HandleFunc("POST /limits", s.audited("limits", s.authorizedGlobal(PermManageLimits, s.handleSetLimits)))
+	mux.HandleFunc("GET /rate-limits", s.authorized(PermViewStatus, s.handleRateLimits))
+	mux.HandleFunc("POST /rate-limits", s.audited("rate-limits", s.authorizedGlobal(PermManageLimits, s.handleSetRateLimits)))
+	mux.HandleFunc("/rate-limit", s.audited("rate-limit", s.authorized(PermUpdateConfig, s.handleRoutineRateLimit)))
+	mux.HandleFunc("/priority", s.audited("priority", s.authorized(PermUpdateConfig, s.handlePriority)))
+	mux.HandleFunc("GET /leader", s.authorized(PermViewStatus, s.handleLeader))
+	mux.HandleFunc("GET /rules", s.authorized(PermViewStatus, s.handleRules))
+	mux.HandleFunc("POST /rules", s.audited("rule", s.authorizedGlobal(PermManageRules, s.handlePutRule)))
+	mux.HandleFunc("DELETE /rules", s.audited("delete-rule", s.authorizedGlobal(PermManageRules, s.handleDeleteRule)))
+	mux.HandleFunc("GET /dag", s.authorized(PermViewStatus, s.handleDAG))
+	mux.HandleFunc("GET /result", s.authorized(PermViewStatus, s.handleResult))
+	mux.HandleFunc("GET /tombstones", s.authorized(PermViewStatus, s.handleTombstones))
+	mux.HandleFunc("POST /tombstones/purge", s.audited("purge", s.authorized(PermStop, s.handlePurgeTombstones)))
+	mux.HandleFunc("/labels", s.audited("label", s.authorized(PermUpdateConfig, s.handleLabels)))
 	mux.HandleFunc("/interactive_mode", s.handleInteractiveMode)
-	mux.HandleFunc("/switch", s.handleSwitchInteractiveMode)
+	mux.HandleFunc("/switch", s.audited("switch", s.authorizedGlobal(PermSwitchMode, s.handleSwitchInteractiveMode)))
+	mux.HandleFunc("/audit", s.authorizedGlobal(PermReadAudit, s.handleAudit))
+	mux.HandleFunc("/whoami", s.handleWhoami)
+	return mux
+}
 
-	log.Printf("Routine server starting on port %d...", s.Port)
-	err := http.ListenAndServe(":"+strconv.Itoa(s.Port), mux)
+// Serve runs the control API until the process receives SIGINT or SIGTERM
+func (s *RoutineScheduler[TConfig, TOutput]) Serve() {
+	resign := s.startElection()
+	server, err := s.newServer(s.forwarding(s.authenticate(s.routes())))
 	if err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
+	listener, err := s.listen()
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+
+	// SIGINT and SIGTERM shut the server down gracefully; Serve returns once
+	// in-flight requests are answered and leadership is given up
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		log.Println("Routine server shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Server shutdown: %v", err)
+		}
+		resign(ctx)
+	}()
+
+	if s.Server.UseTLS() {
+		log.Printf("Routine server starting with TLS on %s...", listener.Addr())
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		log.Printf("Routine server starting on %s...", listener.Addr())
+		err = server.Serve(listener)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Server failed: %v", err)
+	}
+	<-shutdown
 }
 
 // Handler to check if the application is in interactive mode
@@ -42,6 +113,8 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleInteractiveMode(w http.Respon
 func (s *RoutineScheduler[TConfig, TOutput]) handleSwitchInteractiveMode(w http.ResponseWriter, r *http.Request) {
 	// Get the desired mode from the query parameter
 	mode := r.URL.Query().Get("mode")
+	audit := auditFrom(r)
+	audit.OldConfig = map[string]string{"interactiveMode": strconv.FormatBool(s.InteractiveMode)}
 
 	if mode == "on" {
 		s.InteractiveMode = true
@@ -50,6 +123,7 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleSwitchInteractiveMode(w http.
 		s.InteractiveMode = false
 		log.Println("Switched to normal mode (interactive)")
 	}
+	audit.NewConfig = map[string]string{"interactiveMode": strconv.FormatBool(s.InteractiveMode)}
 
 	// Return the current mode
 	w.Header().Set("Content-Type", "application/json")
@@ -58,9 +132,13 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleSwitchInteractiveMode(w http.
 
 // handleHome serves the main HTML page
 func (s *RoutineScheduler[TConfig, TOutput]) handleHome(w http.ResponseWriter, r *http.Request) {
-	// Always serve the index.html file directly
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	// Always serve the dashboard page directly
 	// The JavaScript in the HTML will check for the isTestMode flag
-	http.ServeFile(w, r, "static/routines.html")
+	s.serveAsset(w, r, "routines.html")
 }
 
 // handleStart starts new routines based on request parameters
@@ -69,8 +147,63 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleStart(w http.ResponseWriter,
 	countStr := r.URL.Query().Get("count")
 	configStr := r.URL.Query().Get("config")
 	count, _ := strconv.Atoi(countStr)
+	opts := StartOptions{Tags: splitList(r.URL.Query().Get("tags")), Actor: callerIdentity(r)}
 
 	var result *HandleResult = NewHandleResult(count, "Failed to start all requested routines")
+	audit := auditFrom(r)
+	audit.NewConfig = map[string]string{"request": configStr}
+
+	labels, err := ParseLabels(r.URL.Query().Get("labels"))
+	if err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+	opts.Labels = labels
+	if opts.RateLimit, err = parseRateQuery(r); err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+	if opts.Bounds, err = parseBoundsQuery(r.URL.Query()); err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+	if err = parseScheduleQuery(r.URL.Query(), &opts); err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+	if opts.DependsOn, err = ParseDependencies(r.URL.Query().Get("depends_on")); err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+	if value := r.URL.Query().Get("config_template"); value != "" {
+		if len(opts.DependsOn) == 0 {
+			result.SetError(errors.New("config_template needs depends_on")).Response(w)
+			return
+		}
+		if opts.ConfigTemplate, err = ParseConfigTemplate(value); err != nil {
+			result.SetError(fmt.Errorf("invalid config_template: %v", err)).Response(w)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("priority"); value != "" {
+		if opts.Priority, err = strconv.Atoi(value); err != nil {
+			result.SetError(fmt.Errorf("invalid priority parameter %q", value)).Response(w)
+			return
+		}
+	}
+
+	// A client-supplied name replaces the generated ID; several routines get -1, -2, ... appended
+	name := r.URL.Query().Get("name")
+
+	// wait=first blocks until every started routine has finished its first iteration
+	waitFirst := r.URL.Query().Get("wait") == "first"
+	timeout := DefaultStartWaitTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			result.SetError(fmt.Errorf("invalid timeout parameter %q", value)).Response(w)
+			return
+		}
+	}
 
 	started := 0
 
@@ -86,12 +219,22 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleStart(w http.ResponseWriter,
 		return
 	}
 
+	// Check the caller may start routines of this type with these tags
+	if !s.can(r, PermStart, opts.Tags) {
+		denied(w, &PermissionError{Permission: PermStart})
+		return
+	}
+
 	// Validate config before starting any routines
-	_, err := s.Routine.DeserializeConfig(configStr)
+	config, err := s.Routine.DeserializeConfig(configStr)
 	if err != nil {
 		result.SetError(fmt.Errorf("invalid config: %v", err)).Response(w)
 		return
 	}
+	if fieldErrors := s.validateConfig(config); len(fieldErrors) > 0 {
+		result.SetFieldErrors(fieldErrors).Response(w)
+		return
+	}
 
 	for i := 0; i < count; i++ {
 		// Use a function to properly scope the recovery for each iteration
@@ -99,6 +242,7 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleStart(w http.ResponseWriter,
 			defer func() {
 				if r := recover(); r != nil {
 					result.SetError(fmt.Errorf("some routines failed to start: %v", r))
+					result.Failures = append(result.Failures, RoutineFailure{Instance: i + 1, Error: fmt.Sprint(r)})
 				}
 			}()
 
@@ -106,33 +250,84 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleStart(w http.ResponseWriter,
 			config, err := s.Routine.DeserializeConfig(configStr)
 			if err != nil {
 				result.SetError(fmt.Errorf("failed to deserialize config: %v", err))
+				result.Failures = append(result.Failures, RoutineFailure{Instance: i + 1, Error: err.Error()})
 				return
 			}
-			id, err := s.StartRoutineWithConfig(config)
+			opts.Name = name
+			if name != "" && count > 1 {
+				opts.Name = fmt.Sprintf("%s-%d", name, i+1)
+			}
+			id, err := s.StartRoutineWithOptions(config, opts)
 			if err != nil {
 				result.SetError(fmt.Errorf("failed to start routine: %v", err))
+				result.Failures = append(result.Failures, RoutineFailure{ID: opts.Name, Instance: i + 1, Error: err.Error()})
+				if errors.Is(err, ErrIDConflict) {
+					result.Status(http.StatusConflict)
+				} else if errors.Is(err, ErrLimitReached) || errors.Is(err, ErrQueueFull) {
+					result.Status(http.StatusTooManyRequests)
+				}
 				return
 			} else if id != "" {
+				audit.IDs = append(audit.IDs, id)
+				result.IDs = append(result.IDs, id)
 				started++
 			}
 		}()
 	}
 
+	if waitFirst && len(result.IDs) > 0 {
+		s.waitFirstOutputs(r.Context(), timeout, result)
+	}
+
 	result.Set(started, count).Response(w)
 }
 
+// DefaultStartWaitTimeout bounds how long /start?wait=first blocks when no timeout is given
+const DefaultStartWaitTimeout = 30 * time.Second
+
+// waitFirstOutputs waits for the first iteration of every started routine and
+// adds their outputs to the result. Routines that fail or time out are listed
+// as failures; a timeout answers 504.
+func (s *RoutineScheduler[TConfig, TOutput]) waitFirstOutputs(ctx context.Context, timeout time.Duration, result *HandleResult) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result.Outputs = make(map[string]json.RawMessage, len(result.IDs))
+	for _, id := range result.IDs {
+		output, err := s.WaitFirstOutput(ctx, id)
+		if err != nil {
+			result.SetError(err)
+			result.Failures = append(result.Failures, RoutineFailure{ID: id, Error: err.Error()})
+			if errors.Is(err, context.DeadlineExceeded) {
+				result.Status(http.StatusGatewayTimeout)
+			}
+			continue
+		}
+		data, err := json.Marshal(output)
+		if err != nil {
+			data, _ = json.Marshal(s.Routine.SerializeOutput(output))
+		}
+		result.Outputs[id] = data
+	}
+}
+
 // handleStop stops routines based on request body
 func (s *RoutineScheduler[TConfig, TOutput]) handleStop(w http.ResponseWriter, r *http.Request) {
-	var ids []string
-	var result *HandleResult = NewHandleResult(len(ids), "Failed to stop all requested routines")
-	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
-		result.SetError(fmt.Errorf("invalid request format: %v", err)).Response(w)
+	var result *HandleResult = NewHandleResult(0, "Failed to stop all requested routines")
+	// The body lists IDs, or a selector query parameter picks routines by label
+	ids, err := s.decodeTargets(r, PermStop)
+	if err != nil {
+		targetError(w, result, err)
 		return
 	}
 
+	audit := auditFrom(r)
+	audit.IDs = ids
+	audit.OldConfig = s.snapshotConfigs(ids)
+
 	stopped := 0
 
-	stopped, err := s.StopRoutines(ids)
+	stopped, err = s.StopRoutines(ids)
 
 	result.SetError(err)
 	result.Set(stopped, len(ids)).Response(w)
@@ -140,43 +335,67 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleStop(w http.ResponseWriter, r
 
 // handleSuspend suspends routines based on request body
 func (s *RoutineScheduler[TConfig, TOutput]) handleSuspend(w http.ResponseWriter, r *http.Request) {
-	var ids []string
-	var result *HandleResult = NewHandleResult(len(ids), "Failed to suspend all requested routines")
-	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
-		result.SetError(fmt.Errorf("invalid request format: %v", err)).Response(w)
+	var result *HandleResult = NewHandleResult(0, "Failed to suspend all requested routines")
+	// The body lists IDs, or a selector query parameter picks routines by label
+	ids, err := s.decodeTargets(r, PermSuspend)
+	if err != nil {
+		targetError(w, result, err)
 		return
 	}
 
+	audit := auditFrom(r)
+	audit.IDs = ids
+	audit.OldConfig = s.snapshotConfigs(ids)
+
 	suspended := 0
 
-	suspended, err := s.SuspendRoutines(ids)
+	suspended, err = s.suspendRoutines(callerIdentity(r), ids)
+	audit.NewConfig = s.snapshotConfigs(ids)
 
 	result.SetError(err)
+	if errors.Is(err, ErrNotAdmitted) {
+		result.Status(http.StatusConflict)
+	}
 	result.Set(suspended, len(ids)).Response(w)
 }
 
 // handleResume resumes routines based on request body
 func (s *RoutineScheduler[TConfig, TOutput]) handleResume(w http.ResponseWriter, r *http.Request) {
-	var ids []string
-	var result *HandleResult = NewHandleResult(len(ids), "Failed to resume all requested routines")
-	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
-		result.SetError(fmt.Errorf("invalid request format: %v", err)).Response(w)
+	var result *HandleResult = NewHandleResult(0, "Failed to resume all requested routines")
+	// The body lists IDs, or a selector query parameter picks routines by label
+	ids, err := s.decodeTargets(r, PermResume)
+	if err != nil {
+		targetError(w, result, err)
 		return
 	}
 
+	audit := auditFrom(r)
+	audit.IDs = ids
+	audit.OldConfig = s.snapshotConfigs(ids)
+
 	resumed := 0
 
-	resumed, err := s.ResumeRoutines(ids)
+	resumed, err = s.resumeRoutines(callerIdentity(r), ids)
+	audit.NewConfig = s.snapshotConfigs(ids)
 
 	result.SetError(err)
+	if errors.Is(err, ErrNotAdmitted) {
+		result.Status(http.StatusConflict)
+	}
 	result.Set(resumed, len(ids)).Response(w)
 }
 
-// handleUpdateConfig updates routine configs based on request body
+// handleUpdateConfig updates routine configs based on request body.
+// The body carries either a full config, an RFC 7396 merge patch or an
+// RFC 6902 JSON patch; patches apply to each routine's current config.
 func (s *RoutineScheduler[TConfig, TOutput]) handleUpdateConfig(w http.ResponseWriter, r *http.Request) {
 	type UpdateConfigPayload struct {
-		IDs    []string `json:"ids"`
-		Config string   `json:"config"`
+		IDs        []string             `json:"ids"`
+		Config     string               `json:"config"`
+		MergePatch json.RawMessage      `json:"merge_patch"`
+		JSONPatch  []JSONPatchOperation `json:"json_patch"`
+		// Revisions holds the config revision the caller expects per routine
+		Revisions Revisions `json:"revisions"`
 	}
 
 	var payload UpdateConfigPayload
@@ -188,6 +407,50 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleUpdateConfig(w http.ResponseW
 		return
 	}
 
+	// A selector query parameter picks routines by label instead of listing IDs
+	ids, err := s.selectTargets(r, PermUpdateConfig, payload.IDs)
+	if err != nil {
+		targetError(w, result, err)
+		return
+	}
+	payload.IDs = ids
+
+	// Routines that changed since the caller read them are rejected per ID with 409
+	expected, err := expectedRevisions(r, payload.IDs, payload.Revisions)
+	if err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+
+	audit := auditFrom(r)
+	audit.IDs = payload.IDs
+	audit.OldConfig = s.snapshotConfigs(payload.IDs)
+
+	var patch ConfigPatch
+	switch {
+	case payload.MergePatch != nil && payload.JSONPatch != nil, payload.Config != "" && (payload.MergePatch != nil || payload.JSONPatch != nil):
+		result.SetError(errors.New("only one of config, merge_patch and json_patch may be given")).Response(w)
+		return
+	case payload.MergePatch != nil:
+		patch = MergePatch(payload.MergePatch)
+	case payload.JSONPatch != nil:
+		patch = JSONPatch(payload.JSONPatch)
+	}
+	if patch != nil {
+		updated, fieldErrors, err := s.patchRoutineConfig(callerIdentity(r), expected, payload.IDs, patch)
+		audit.NewConfig = s.snapshotConfigs(payload.IDs)
+		if len(fieldErrors) > 0 {
+			result.Set(0, len(payload.IDs)).SetFieldErrors(fieldErrors).Response(w)
+			return
+		}
+		if err != nil {
+			log.Printf("Error: could not patch config %v", err)
+			result.SetError(fmt.Errorf("could not patch config %v", err)).SetConflicts(err)
+		}
+		result.Set(updated, len(payload.IDs)).Response(w)
+		return
+	}
+
 	routine := s.Routine
 
 	newConfig, err := routine.DeserializeConfig(payload.Config)
@@ -196,11 +459,16 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleUpdateConfig(w http.ResponseW
 		result.SetError(fmt.Errorf("could not deserialize config %v", err)).Response(w)
 		return
 	}
+	if fieldErrors := s.validateConfig(newConfig); len(fieldErrors) > 0 {
+		result.SetFieldErrors(fieldErrors).Response(w)
+		return
+	}
 
-	updated, err := s.UpdateRoutineConfig(payload.IDs, newConfig)
+	updated, err := s.updateRoutineConfig(callerIdentity(r), expected, payload.IDs, newConfig)
+	audit.NewConfig = s.snapshotConfigs(payload.IDs)
 	if err != nil {
 		log.Printf("Error: could not update config %v", err)
-		result.SetError(fmt.Errorf("could not update config %v", err)).Response(w)
+		result.SetError(fmt.Errorf("could not update config %v", err)).SetConflicts(err).Set(updated, len(payload.IDs)).Response(w)
 		return
 	}
 
@@ -210,15 +478,39 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleUpdateConfig(w http.ResponseW
 // handleStatus returns the status of all routines
 func (s *RoutineScheduler[TConfig, TOutput]) handleStatus(w http.ResponseWriter, r *http.Request) {
 	type RoutineInfo struct {
-		ID        string `json:"id"`
-		OutputStr string `json:"output"`
-		ConfigStr string `json:"config"`
+		ID        string       `json:"id"`
+		OutputStr string       `json:"output"`
+		ConfigStr string       `json:"config"`
+		Tags      []string     `json:"tags,omitempty"`
+		Labels    Labels       `json:"labels,omitempty"`
+		State     RoutineState `json:"state"`
+		// Revision is the config version to send back as If-Match or in revisions
+		Revision int64 `json:"revision"`
+		Priority int   `json:"priority"`
+		// QueuePosition is the place of a pending routine in the admission queue, from 1
+		QueuePosition int `json:"queue_position,omitempty"`
+		// RateLimit is the routine's own limit; RateWaitMs adds up the delays of all limits
+		RateLimit  *RateLimit `json:"rate_limit,omitempty"`
+		RateWaitMs float64    `json:"rate_wait_ms"`
+		// StartAt is when a scheduled routine starts
+		StartAt *time.Time `json:"start_at,omitempty"`
+		// DependsOn lists what the routine waited for before starting
+		DependsOn []Dependency `json:"depends_on,omitempty"`
+		// ExitReason and FinishedAt are set on finished routines, listed with finished=true
+		ExitReason string     `json:"exit_reason,omitempty"`
+		FinishedAt *time.Time `json:"finished_at,omitempty"`
 	}
 
 	// Get filter parameter from query string
 	filterID := r.URL.Query().Get("filter")
+	selector, err := ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		NewHandleResult(0, "Invalid selector").SetError(err).Response(w)
+		return
+	}
 
 	var routines []RoutineInfo
+	positions := admission.positions()
 
 	// Collect status from all routines
 	routineMap.Range(func(key, val any) bool {
@@ -231,29 +523,209 @@ func (s *RoutineScheduler[TConfig, TOutput]) handleStatus(w http.ResponseWriter,
 		// Use type switch to handle different routine control types
 		switch ctrl := val.(type) {
 		case *RoutineControl[TConfig, TOutput]:
+			// Only list routines the caller is allowed to see
+			if !s.can(r, PermViewStatus, ctrl.Tags) {
+				return true
+			}
+			labels := ctrl.Labels()
+			if !selector.Matches(labels) {
+				return true
+			}
+
 			// Use the routine instance from the scheduler
 			routine := s.Routine
 			output := ctrl.Output.Load().(TOutput)
 			config := ctrl.Config.Load().(TConfig)
 
-			routines = append(routines, RoutineInfo{
-				ID:        id,
-				OutputStr: routine.SerializeOutput(output),
-				ConfigStr: routine.SerializeConfig(config),
-			})
+			info := RoutineInfo{
+				ID:         id,
+				OutputStr:  routine.SerializeOutput(output),
+				ConfigStr:  routine.SerializeConfig(config),
+				Tags:       ctrl.Tags,
+				Labels:     labels,
+				State:      ctrl.State(),
+				Revision:   ctrl.versions.revision(),
+				Priority:   ctrl.Priority(),
+				RateLimit:  ctrl.RateLimit(),
+				RateWaitMs: ctrl.history.timing().RateWaitMs,
+			}
+			if ctrl.ticket != nil {
+				info.QueuePosition = positions[ctrl.ticket]
+			}
+			if at := ctrl.StartAt(); !at.IsZero() {
+				info.StartAt = &at
+			}
+			info.DependsOn = ctrl.Dependencies()
+			routines = append(routines, info)
 		}
 		return true
 	})
 
+	// Finished routines follow the running ones, most recent first
+	if r.URL.Query().Get("finished") == "true" {
+		tombstones := s.Tombstones()
+		slices.Reverse(tombstones)
+		for _, entry := range tombstones {
+			if filterID != "" && !strings.Contains(strings.ToLower(entry.ID), strings.ToLower(filterID)) {
+				continue
+			}
+			if !s.can(r, PermViewStatus, entry.Tags) || !selector.Matches(entry.Labels) {
+				continue
+			}
+			routines = append(routines, RoutineInfo{
+				ID:         entry.ID,
+				OutputStr:  entry.Output,
+				ConfigStr:  entry.Config,
+				Tags:       entry.Tags,
+				Labels:     entry.Labels,
+				State:      entry.State,
+				ExitReason: entry.ExitReason,
+				FinishedAt: &entry.FinishedAt,
+			})
+		}
+	}
+
 	_ = json.NewEncoder(w).Encode(routines)
 }
 
+// splitList splits a comma separated query parameter, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// handleRoutineDetail returns the history of a single routine for its detail page
+func (s *RoutineScheduler[TConfig, TOutput]) handleRoutineDetail(w http.ResponseWriter, r *http.Request) {
+	type RoutineDetail struct {
+		ID        string           `json:"id"`
+		Type      string           `json:"type"`
+		Tags      []string         `json:"tags,omitempty"`
+		Labels    Labels           `json:"labels,omitempty"`
+		State     RoutineState     `json:"state"`
+		Revision  int64            `json:"revision"`
+		Priority  int              `json:"priority"`
+		RateLimit *RateLimit       `json:"rate_limit,omitempty"`
+		Bounds    RunBounds        `json:"bounds"`
+		DependsOn []Dependency     `json:"depends_on,omitempty"`
+		StartedAt time.Time        `json:"started_at"`
+		OutputStr string           `json:"output"`
+		ConfigStr string           `json:"config"`
+		Timing    IterationTiming  `json:"timing"`
+		Events    []LifecycleEvent `json:"events"`
+		Outputs   []OutputSample   `json:"outputs"`
+		Logs      []LogEntry       `json:"logs"`
+		Errors    []ErrorTrace     `json:"errors"`
+	}
+
+	id := r.URL.Query().Get("id")
+	result := NewHandleResult(1, "Failed to load routine")
+
+	var ctrl *RoutineControl[TConfig, TOutput]
+	if val, ok := routineMap.Load(id); ok {
+		if ctrl, ok = val.(*RoutineControl[TConfig, TOutput]); !ok {
+			result.SetError(fmt.Errorf("could not convert routine %s to expected type", id)).Response(w)
+			return
+		}
+	} else if entry, ok := s.loadTombstone(id); ok {
+		// A finished routine's history is gone; its tombstone tells how it ended
+		if !s.can(r, PermViewStatus, entry.Tags) {
+			denied(w, &PermissionError{Permission: PermViewStatus, ID: id})
+			return
+		}
+		events := []LifecycleEvent{{Time: entry.FinishedAt, Event: string(entry.State), Detail: entry.ExitReason}}
+		traces := []ErrorTrace{}
+		if entry.LastError != "" {
+			traces = append(traces, ErrorTrace{Time: entry.FinishedAt, Iteration: entry.Iterations, Error: entry.LastError})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(RoutineDetail{
+			ID:        id,
+			Type:      entry.Type,
+			Tags:      entry.Tags,
+			Labels:    entry.Labels,
+			State:     entry.State,
+			DependsOn: entry.dependsOn,
+			StartedAt: entry.StartedAt,
+			OutputStr: entry.Output,
+			ConfigStr: entry.Config,
+			Timing:    IterationTiming{Iterations: entry.Iterations},
+			Events:    events,
+			Outputs:   []OutputSample{},
+			Logs:      []LogEntry{},
+			Errors:    traces,
+		})
+		return
+	} else {
+		result.SetError(fmt.Errorf("routine %s not found", id)).Status(http.StatusNotFound).Response(w)
+		return
+	}
+	if !s.can(r, PermViewStatus, ctrl.Tags) {
+		denied(w, &PermissionError{Permission: PermViewStatus, ID: id})
+		return
+	}
+
+	history := ctrl.history
+	timing := history.timing()
+	revision := ctrl.versions.revision()
+	history.mu.Lock()
+	detail := RoutineDetail{
+		ID:        id,
+		Type:      s.routineType(),
+		Tags:      ctrl.Tags,
+		Labels:    ctrl.Labels(),
+		State:     history.state,
+		Revision:  revision,
+		Priority:  ctrl.Priority(),
+		RateLimit: ctrl.RateLimit(),
+		Bounds:    ctrl.Bounds(),
+		DependsOn: ctrl.Dependencies(),
+		StartedAt: history.startedAt,
+		OutputStr: s.Routine.SerializeOutput(ctrl.Output.Load().(TOutput)),
+		ConfigStr: s.Routine.SerializeConfig(ctrl.Config.Load().(TConfig)),
+		Timing:    timing,
+		Events:    history.events.slice(),
+		Outputs:   history.outputs.slice(),
+		Logs:      history.logs.slice(),
+		Errors:    history.errors.slice(),
+	}
+	history.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", revisionETag(revision))
+	_ = json.NewEncoder(w).Encode(detail)
+}
+
 type HandleResult struct {
 	Success             bool   `json:"success"`
 	Error               string `json:"error"`
 	SuccessCount        int    `json:"success_count"`
 	TotalCount          int    `json:"total_count"`
 	DefaultErrorMessage string `json:"-"`
+	// StatusCode overrides the HTTP status of a failed result; 0 means 400
+	StatusCode int `json:"-"`
+	// FieldErrors lists each invalid config field when a config is rejected
+	FieldErrors []FieldError `json:"field_errors,omitempty"`
+	// Failures lists the routines a bulk operation could not apply to, and why
+	Failures []RoutineFailure `json:"failures,omitempty"`
+	// IDs lists the routines a start request created, so replays return them too
+	IDs []string `json:"ids,omitempty"`
+	// Outputs holds the first output of each started routine when the start request waited for it
+	Outputs map[string]json.RawMessage `json:"outputs,omitempty"`
+}
+
+// RoutineFailure is the error of one routine in a bulk operation
+type RoutineFailure struct {
+	ID string `json:"id,omitempty"`
+	// Instance numbers the routine within a start request, from 1
+	Instance int    `json:"instance,omitempty"`
+	Error    string `json:"error"`
+	// Revision is the current config revision when the failure is a conflict
+	Revision int64 `json:"revision,omitempty"`
 }
 
 func NewHandleResult(totalCount int, defaultErrorMessage string) *HandleResult {
@@ -289,15 +761,47 @@ func (result *HandleResult) Set(successCount, totalCount int) *HandleResult {
 	return result
 }
 
+// SetFieldErrors rejects the request as 422 with one entry per invalid field
+func (result *HandleResult) SetFieldErrors(fieldErrors []FieldError) *HandleResult {
+	messages := make([]string, len(fieldErrors))
+	for i, fieldError := range fieldErrors {
+		messages[i] = fieldError.Error()
+	}
+	result.SetError(fmt.Errorf("invalid config: %s", strings.Join(messages, "; ")))
+	result.FieldErrors = fieldErrors
+	return result.Status(http.StatusUnprocessableEntity)
+}
+
+// SetConflicts reports every *ConflictError in err as a failure and answers 409
+func (result *HandleResult) SetConflicts(err error) *HandleResult {
+	conflicts := conflictsIn(err)
+	for _, conflict := range conflicts {
+		result.Failures = append(result.Failures, RoutineFailure{ID: conflict.ID, Error: conflict.Error(), Revision: conflict.Actual})
+	}
+	if len(conflicts) > 0 {
+		result.Status(http.StatusConflict)
+	}
+	return result
+}
+
+// Status sets the HTTP status code used when the result is not successful
+func (result *HandleResult) Status(statusCode int) *HandleResult {
+	result.StatusCode = statusCode
+	return result
+}
+
 func (result *HandleResult) Response(w http.ResponseWriter) {
 	result.Success = (result.SuccessCount == result.TotalCount) && (result.Error == "")
-	if (result.SuccessCount != result.TotalCount) && (result.Error != "") {
+	// Field errors are more useful than the generic message, so keep them visible
+	if (result.SuccessCount != result.TotalCount) && (result.Error != "") && len(result.FieldErrors) == 0 {
 		result.Error = result.DefaultErrorMessage
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if result.Success {
 		w.WriteHeader(http.StatusOK)
+	} else if result.StatusCode != 0 {
+		w.WriteHeader(result.StatusCode)
 	} else {
 		w.WriteHeader(http.StatusBadRequest)
 	}
@@ -0,0 +1,301 @@
+package routine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Dependency makes a routine wait until another routine of the same scheduler reaches a state
+type Dependency struct {
+	ID string `json:"id"`
+	// State is the state to reach; empty means StateCompleted
+	State RoutineState `json:"state,omitempty"`
+}
+
+func (dep Dependency) state() RoutineState {
+	if dep.State == "" {
+		return StateCompleted
+	}
+	return dep.State
+}
+
+func (dep Dependency) String() string {
+	return dep.ID + ":" + string(dep.state())
+}
+
+// ParseDependencies parses a comma separated list such as "extract,load:running".
+// A dependency without a state waits for completion.
+func ParseDependencies(value string) ([]Dependency, error) {
+	var deps []Dependency
+	for _, item := range splitList(value) {
+		id, state, _ := strings.Cut(item, ":")
+		dep := Dependency{ID: strings.TrimSpace(id), State: RoutineState(strings.TrimSpace(state))}
+		if dep.ID == "" {
+			return nil, fmt.Errorf("invalid dependency %q", item)
+		}
+		switch dep.state() {
+		case StateRunning, StateSuspended, StateCompleted, StateStopped, StateFailed:
+		default:
+			return nil, fmt.Errorf("dependency %s cannot wait for state %q", dep.ID, dep.State)
+		}
+		deps = append(deps, dep)
+	}
+	return deps, nil
+}
+
+// UpstreamData is what a config template sees of one dependency
+type UpstreamData struct {
+	ID    string
+	State RoutineState
+	// Output is the dependency's latest output, its final output once it finished
+	Output any
+}
+
+// DependencyData is passed to config templates, e.g.
+// {"value": {{(index .Upstream "extract").Output.Count}}}
+type DependencyData struct {
+	Upstream map[string]UpstreamData
+	// Config is the routine's config given at start, serialized
+	Config string
+}
+
+// ParseConfigTemplate parses a text/template rendering a routine's config from
+// its dependencies. The json function writes a value as JSON.
+func ParseConfigTemplate(text string) (*template.Template, error) {
+	return template.New("config").Option("missingkey=error").Funcs(template.FuncMap{
+		"json": func(value any) (string, error) {
+			data, err := json.Marshal(value)
+			return string(data), err
+		},
+	}).Parse(text)
+}
+
+// Dependencies returns what the routine waits for before it starts
+func (ctrl *RoutineControl[TConfig, TOutput]) Dependencies() []Dependency {
+	return ctrl.dependsOn
+}
+
+// dependencyReached reports whether a live or finished routine exists and whether it has been in state
+func (s *RoutineScheduler[TConfig, TOutput]) dependencyReached(id string, state RoutineState) (exists, reached bool) {
+	if ctrl, err := s.loadControl(id); err == nil {
+		return true, ctrl.history.hasReached(state)
+	}
+	if entry, ok := s.loadTombstone(id); ok {
+		return true, entry.reached[state]
+	}
+	return false, false
+}
+
+// dependencyMet reports whether dep is met, returning what a config template
+// sees of it. It fails once dep can no longer be met: the routine is gone, or
+// finished without reaching the state. While dep is not met yet, changed is
+// closed at the routine's next state change.
+func (s *RoutineScheduler[TConfig, TOutput]) dependencyMet(dep Dependency) (upstream UpstreamData, met bool, changed <-chan struct{}, err error) {
+	if ctrl, errLoad := s.loadControl(dep.ID); errLoad == nil {
+		reached, state, changed := ctrl.history.watch(dep.state())
+		if reached {
+			return UpstreamData{ID: dep.ID, State: ctrl.State(), Output: ctrl.Output.Load()}, true, nil, nil
+		}
+		// A routine is still in the map for a moment after its final state
+		if state.finished() {
+			return upstream, false, nil, fmt.Errorf("dependency %s ended %s without reaching %s", dep.ID, state, dep.state())
+		}
+		return upstream, false, changed, nil
+	}
+	entry, ok := s.loadTombstone(dep.ID)
+	if !ok {
+		return upstream, false, nil, fmt.Errorf("dependency %s not found", dep.ID)
+	}
+	if !entry.reached[dep.state()] {
+		return upstream, false, nil, fmt.Errorf("dependency %s ended %s without reaching %s", dep.ID, entry.State, dep.state())
+	}
+	return entry.upstream(), true, nil, nil
+}
+
+// waitDependencies blocks until every dependency is met and returns what config templates see of them
+func (s *RoutineScheduler[TConfig, TOutput]) waitDependencies(ctx context.Context, deps []Dependency) (map[string]UpstreamData, error) {
+	for {
+		// Only the first unmet dependency is watched: every one must be met, so
+		// there is nothing to do before it changes state
+		var changed <-chan struct{}
+		nodes := make(map[string]UpstreamData, len(deps))
+		for _, dep := range deps {
+			node, met, depChanged, err := s.dependencyMet(dep)
+			if err != nil {
+				return nil, err
+			}
+			if !met {
+				changed = depChanged
+				break
+			}
+			nodes[dep.ID] = node
+		}
+		if len(nodes) == len(deps) {
+			return nodes, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// renderConfig builds the routine's config from its dependencies' outputs
+func (s *RoutineScheduler[TConfig, TOutput]) renderConfig(ctrl *RoutineControl[TConfig, TOutput], tmpl *template.Template, upstream map[string]UpstreamData) (TConfig, error) {
+	var zero TConfig
+	data := DependencyData{
+		Upstream: upstream,
+		Config:   s.Routine.SerializeConfig(ctrl.Config.Load().(TConfig)),
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return zero, fmt.Errorf("could not render config template: %v", err)
+	}
+	config, err := s.Routine.DeserializeConfig(buf.String())
+	if err != nil {
+		return zero, fmt.Errorf("rendered config is invalid: %v", err)
+	}
+	if fieldErrors := s.validateConfig(config); len(fieldErrors) > 0 {
+		return zero, fmt.Errorf("rendered config is invalid: %s: %s", fieldErrors[0].Field, fieldErrors[0].Message)
+	}
+	return config, nil
+}
+
+// checkDependencies rejects a start whose dependencies do not exist
+func (s *RoutineScheduler[TConfig, TOutput]) checkDependencies(deps []Dependency) error {
+	var err error
+	for _, dep := range deps {
+		if exists, _ := s.dependencyReached(dep.ID, dep.state()); !exists {
+			err = errors.Join(err, fmt.Errorf("dependency %s not found", dep.ID))
+		}
+	}
+	return err
+}
+
+// await holds a routine until its dependencies are met, renders its config
+// from them, and then schedules or admits it like a fresh start.
+// It returns the function that stops the routine.
+func (s *RoutineScheduler[TConfig, TOutput]) await(ctx context.Context, cancel context.CancelFunc, id string, ctrl *RoutineControl[TConfig, TOutput], done chan struct{}, ready <-chan struct{}, opts StartOptions) context.CancelFunc {
+	var mu sync.Mutex
+	var stop context.CancelFunc // Set once the dependencies are met
+	deps := make([]string, len(opts.DependsOn))
+	for i, dep := range opts.DependsOn {
+		deps[i] = dep.String()
+	}
+	ctrl.history.event(StateWaiting, "waiting", strings.Join(deps, ","))
+
+	go func() {
+		<-ready
+		nodes, err := s.waitDependencies(ctx, opts.DependsOn)
+		mu.Lock()
+		defer mu.Unlock()
+		if ctx.Err() != nil {
+			s.discard(id, ctrl, done, nil)
+			return
+		}
+		if err == nil && opts.ConfigTemplate != nil {
+			var config TConfig
+			if config, err = s.renderConfig(ctrl, opts.ConfigTemplate, nodes); err == nil {
+				ctrl.storeConfig(config, opts.Actor, "dependencies")
+				ctrl.history.event("", "config-rendered", s.Routine.SerializeConfig(config))
+			}
+		}
+		if err == nil && opts.StartAt.After(time.Now()) {
+			stop = s.schedule(ctx, cancel, id, ctrl, done, ready, opts.StartAt)
+			return
+		}
+		if err == nil {
+			stop, err = s.admit(ctx, cancel, id, ctrl, done)
+		}
+		if err != nil {
+			cancel()
+			s.discard(id, ctrl, done, err)
+		}
+	}()
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if stop != nil {
+			stop()
+			return
+		}
+		cancel()
+	}
+}
+
+// DAGNode is a routine in the dependency graph
+type DAGNode struct {
+	ID         string       `json:"id"`
+	State      RoutineState `json:"state"`
+	ExitReason string       `json:"exit_reason,omitempty"`
+	DependsOn  []Dependency `json:"depends_on,omitempty"`
+}
+
+// DAGEdge points from a dependency to the routine waiting for it
+type DAGEdge struct {
+	From  string       `json:"from"`
+	To    string       `json:"to"`
+	State RoutineState `json:"state"`
+	Met   bool         `json:"met"`
+}
+
+// DAG is the dependency graph between routines, live and finished
+type DAG struct {
+	Nodes []DAGNode `json:"nodes"`
+	Edges []DAGEdge `json:"edges"`
+}
+
+// handleDAG shows the routines that depend on others or are depended on, with their state
+func (s *RoutineScheduler[TConfig, TOutput]) handleDAG(w http.ResponseWriter, r *http.Request) {
+	nodes := make(map[string]DAGNode)
+	var order []string
+	add := func(node DAGNode) {
+		if _, ok := nodes[node.ID]; !ok {
+			order = append(order, node.ID)
+		}
+		nodes[node.ID] = node
+	}
+	// Tombstones first so a live routine reusing an ID replaces its tombstone
+	ttl, limit := s.tombstoneLimits()
+	for _, entry := range s.tombstones.snapshot(ttl, limit) {
+		if s.can(r, PermViewStatus, entry.Tags) {
+			add(DAGNode{ID: entry.ID, State: entry.State, ExitReason: entry.ExitReason, DependsOn: entry.dependsOn})
+		}
+	}
+	routineMap.Range(func(key, val any) bool {
+		if ctrl, ok := val.(*RoutineControl[TConfig, TOutput]); ok && s.can(r, PermViewStatus, ctrl.Tags) {
+			add(DAGNode{ID: key.(string), State: ctrl.State(), DependsOn: ctrl.Dependencies()})
+		}
+		return true
+	})
+
+	dag := DAG{Nodes: []DAGNode{}, Edges: []DAGEdge{}}
+	linked := make(map[string]bool)
+	for _, id := range order {
+		for _, dep := range nodes[id].DependsOn {
+			_, met := s.dependencyReached(dep.ID, dep.state())
+			dag.Edges = append(dag.Edges, DAGEdge{From: dep.ID, To: id, State: dep.state(), Met: met})
+			linked[dep.ID], linked[id] = true, true
+		}
+	}
+	for _, id := range order {
+		if linked[id] {
+			dag.Nodes = append(dag.Nodes, nodes[id])
+		}
+	}
+	slices.SortFunc(dag.Edges, func(a, b DAGEdge) int { return strings.Compare(a.To+a.From, b.To+b.From) })
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(dag)
+}
@@ -0,0 +1,165 @@
+package routine
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTest starts a routine of s, failing the test if it is refused
+func startTest(t *testing.T, s *RoutineScheduler[*testConfig, int], config *testConfig, opts StartOptions) *RoutineControl[*testConfig, int] {
+	t.Helper()
+	id, err := s.StartRoutineWithOptions(config, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, err := s.loadControl(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctrl
+}
+
+// buried waits for ctrl to end and returns its tombstone
+func buried(t *testing.T, s *RoutineScheduler[*testConfig, int], id string, ctrl *RoutineControl[*testConfig, int]) Tombstone {
+	t.Helper()
+	waitDone(t, ctrl)
+	entry, ok := s.loadTombstone(id)
+	if !ok {
+		t.Fatalf("no tombstone for %s", id)
+	}
+	return entry.Tombstone
+}
+
+func TestDependencyEndsWithoutReachingState(t *testing.T) {
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	// A finished dependency that never failed
+	s.tombstones.add(&tombstone[*testConfig, int]{
+		Tombstone: Tombstone{ID: "done", State: StateCompleted, FinishedAt: time.Now()},
+		reached:   map[RoutineState]bool{StateRunning: true, StateCompleted: true},
+	}, time.Hour, 10)
+	// And a live one, scheduled far ahead, that is stopped while the dependent waits
+	live := startTest(t, s, &testConfig{}, StartOptions{Name: "live", StartAt: time.Now().Add(time.Hour)})
+
+	finished := startTest(t, s, &testConfig{}, StartOptions{Name: "after-done", DependsOn: []Dependency{{ID: "done", State: StateFailed}}})
+	waiting := startTest(t, s, &testConfig{}, StartOptions{Name: "after-live", DependsOn: []Dependency{{ID: "live"}}})
+	if err := s.StopRoutine("live"); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, live)
+
+	for id, ctrl := range map[string]*RoutineControl[*testConfig, int]{"after-done": finished, "after-live": waiting} {
+		entry := buried(t, s, id, ctrl)
+		if entry.State != StateFailed || !strings.Contains(entry.LastError, "without reaching") {
+			t.Errorf("%s ended %s with %q, want it failed for a dependency that cannot be met", id, entry.State, entry.LastError)
+		}
+	}
+}
+
+func TestSelfDependency(t *testing.T) {
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	// The tombstone lets the dependency pass the existence check, so only the self reference refuses it
+	s.tombstones.add(&tombstone[*testConfig, int]{
+		Tombstone: Tombstone{ID: "loop", State: StateCompleted, FinishedAt: time.Now()},
+		reached:   map[RoutineState]bool{StateCompleted: true},
+	}, time.Hour, 10)
+
+	_, err := s.StartRoutineWithOptions(&testConfig{}, StartOptions{Name: "loop", DependsOn: []Dependency{{ID: "loop"}}})
+	if err == nil || !strings.Contains(err.Error(), "cannot depend on itself") {
+		t.Fatalf("got %v, want the self dependency refused", err)
+	}
+	if _, err := s.loadControl("loop"); err == nil {
+		t.Error("the refused routine kept its ID")
+	}
+}
+
+func TestStopWhileWaitingForDependency(t *testing.T) {
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	upstream := startTest(t, s, &testConfig{}, StartOptions{Name: "upstream", StartAt: time.Now().Add(time.Hour)})
+	dependent := startTest(t, s, &testConfig{}, StartOptions{Name: "dependent", DependsOn: []Dependency{{ID: "upstream"}}})
+	if state := dependent.State(); state != StateWaiting {
+		t.Fatalf("dependent is %s, want %s", state, StateWaiting)
+	}
+
+	if err := s.StopRoutine("dependent"); err != nil {
+		t.Fatal(err)
+	}
+	entry := buried(t, s, "dependent", dependent)
+	if entry.State != StateStopped || entry.ExitReason != ExitStopped || entry.Iterations != 0 {
+		t.Errorf("dependent ended %s (%s) after %d iterations, want stopped before running", entry.State, entry.ExitReason, entry.Iterations)
+	}
+	if state := upstream.State(); state != StateScheduled {
+		t.Errorf("stopping the dependent left upstream %s, want %s", state, StateScheduled)
+	}
+}
+
+func TestConfigTemplate(t *testing.T) {
+	s := newTestScheduler(t, func(ctrl *RoutineControl[*testConfig, int]) (int, error) {
+		return ctrl.Config.Load().(*testConfig).Value * 10, nil
+	})
+	tests := []struct {
+		name     string
+		template string
+		state    RoutineState
+		config   string
+		err      string
+	}{
+		{"output of the dependency", `{"value": {{(index .Upstream "source").Output}}}`, StateCompleted, `{"value":40}`, ""},
+		{"json of the dependency", `{"value": {{json (index .Upstream "source").Output}}}`, StateCompleted, `{"value":40}`, ""},
+		{"own config", `{{.Config}}`, StateCompleted, `{"value":2}`, ""},
+		{"missing field", `{"value": {{.Missing}}}`, StateFailed, `{"value":2}`, "could not render config template"},
+		{"invalid config", `{"value": "{{(index .Upstream "source").State}}"}`, StateFailed, `{"value":2}`, "rendered config is invalid"},
+	}
+	source := startTest(t, s, &testConfig{Value: 4}, StartOptions{Name: "source", Bounds: RunBounds{MaxIterations: 1}})
+	waitDone(t, source)
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl, err := ParseConfigTemplate(test.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctrl := startTest(t, s, &testConfig{Value: 2}, StartOptions{
+				Name:           "rendered-" + string(rune('a'+i)),
+				DependsOn:      []Dependency{{ID: "source"}},
+				ConfigTemplate: tmpl,
+				Bounds:         RunBounds{MaxIterations: 1},
+			})
+			entry := buried(t, s, "rendered-"+string(rune('a'+i)), ctrl)
+			if entry.State != test.state || entry.Config != test.config || !strings.Contains(entry.LastError, test.err) {
+				t.Errorf("ended %s with config %s and error %q, want %s with %s and %q", entry.State, entry.Config, entry.LastError, test.state, test.config, test.err)
+			}
+		})
+	}
+}
+
+func TestDependentStartsAfterUpstreamCompletes(t *testing.T) {
+	var upstream *RoutineControl[*testConfig, int]
+	var early atomic.Bool
+	s := newTestScheduler(t, func(ctrl *RoutineControl[*testConfig, int]) (int, error) {
+		if ctrl.Config.Load().(*testConfig).Value == 1 {
+			time.Sleep(5 * time.Millisecond)
+			return 1, nil
+		}
+		// The dependent must not run before the upstream has finished all its iterations
+		if upstream.history.iterationCount() != 3 || !upstream.history.hasReached(StateCompleted) {
+			early.Store(true)
+		}
+		return 2, nil
+	})
+	upstream = startTest(t, s, &testConfig{Value: 1}, StartOptions{Name: "upstream", Bounds: RunBounds{MaxIterations: 3}})
+	dependent := startTest(t, s, &testConfig{Value: 2}, StartOptions{
+		Name:      "dependent",
+		DependsOn: []Dependency{{ID: "upstream"}},
+		Bounds:    RunBounds{MaxIterations: 1},
+	})
+
+	entry := buried(t, s, "dependent", dependent)
+	if entry.State != StateCompleted || entry.Iterations != 1 {
+		t.Fatalf("dependent ended %s after %d iterations: %s", entry.State, entry.Iterations, entry.LastError)
+	}
+	if early.Load() {
+		t.Error("dependent ran before upstream completed")
+	}
+}
@@ -0,0 +1,518 @@
+package routine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expr is a parsed rule condition over the JSON form of a routine's output, such as
+// "Count > 1000 && Timestamp != null" or "$error contains \"timeout\"".
+//
+// Names are fields of the output, with dotted paths and [n] for nested values;
+// a missing field is null. Names starting with $ are set by the rule engine:
+// $output (the whole output), $error (the error message, or null), $iteration,
+// $id and $state. Literals are numbers, "strings" or 'strings', true, false and
+// null. Operators, loosest first: ||, &&, !, == != < <= > >= contains, + -, * / %,
+// and unary -. Ordering against null is false rather than an error, so a
+// condition on an output field simply does not hold while there is no output.
+type Expr struct {
+	source string
+	root   exprNode
+}
+
+// ParseExpr parses a rule condition
+func ParseExpr(source string) (*Expr, error) {
+	tokens, err := lexExpr(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.or()
+	if err == nil && p.peek().kind != tokenEnd {
+		err = fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+	return &Expr{source: source, root: root}, nil
+}
+
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Eval reports whether the condition holds for a decoded JSON output. vars holds
+// the $ names. A result other than a boolean holds when it is not null, 0 or "".
+func (e *Expr) Eval(output any, vars map[string]any) (bool, error) {
+	value, err := e.root.eval(&exprEnv{output: output, vars: vars})
+	if err != nil {
+		return false, err
+	}
+	return truthy(value), nil
+}
+
+type exprEnv struct {
+	output any
+	vars   map[string]any
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenName
+	tokenOperator
+)
+
+type exprToken struct {
+	kind  tokenKind
+	text  string
+	value any // Decoded numbers and strings
+}
+
+// lexExpr splits an expression into names, literals and operators
+func lexExpr(input string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(input) && input[j] != c {
+				if input[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(input) {
+				return nil, errors.New("unterminated string")
+			}
+			text := input[i : j+1]
+			if c == '\'' {
+				text = strconv.Quote(strings.ReplaceAll(input[i+1:j], `\'`, `'`))
+			}
+			value, err := strconv.Unquote(text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s", input[i:j+1])
+			}
+			tokens = append(tokens, exprToken{kind: tokenString, text: input[i : j+1], value: value})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(input) && input[i+1] >= '0' && input[i+1] <= '9':
+			j := i
+			for j < len(input) && (input[j] >= '0' && input[j] <= '9' || input[j] == '.' || input[j] == 'e' || input[j] == 'E' ||
+				(input[j] == '-' || input[j] == '+') && (input[j-1] == 'e' || input[j-1] == 'E')) {
+				j++
+			}
+			value, err := strconv.ParseFloat(input[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s", input[i:j])
+			}
+			tokens = append(tokens, exprToken{kind: tokenNumber, text: input[i:j], value: value})
+			i = j
+		case isNameByte(c) || c == '$':
+			j := i + 1
+			for j < len(input) && isNameByte(input[j]) {
+				j++
+			}
+			tokens = append(tokens, exprToken{kind: tokenName, text: input[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", ".", "[", "]"} {
+				if strings.HasPrefix(input[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, exprToken{kind: tokenOperator, text: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return exprToken{kind: tokenEnd}
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.peek()
+	if token.kind != tokenEnd {
+		p.pos++
+	}
+	return token
+}
+
+// accept consumes the next token when it is one of the operators or keywords
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	token := p.peek()
+	if token.kind != tokenOperator && token.kind != tokenName {
+		return "", false
+	}
+	for _, op := range ops {
+		if token.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) or() (exprNode, error) {
+	return p.binary(p.and, "||")
+}
+
+func (p *exprParser) and() (exprNode, error) {
+	return p.binary(p.not, "&&")
+}
+
+func (p *exprParser) not() (exprNode, error) {
+	if _, ok := p.accept("!"); ok {
+		operand, err := p.not()
+		return notNode{operand}, err
+	}
+	return p.comparison()
+}
+
+func (p *exprParser) comparison() (exprNode, error) {
+	left, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.accept("==", "!=", "<=", ">=", "<", ">", "contains"); ok {
+		right, err := p.sum()
+		return binaryNode{op, left, right}, err
+	}
+	return left, nil
+}
+
+func (p *exprParser) sum() (exprNode, error) {
+	return p.binary(p.product, "+", "-")
+}
+
+func (p *exprParser) product() (exprNode, error) {
+	return p.binary(p.unary, "*", "/", "%")
+}
+
+// binary parses left-associative chains of the operators at one precedence level
+func (p *exprParser) binary(operand func() (exprNode, error), ops ...string) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op, left, right}
+	}
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	if _, ok := p.accept("-"); ok {
+		operand, err := p.unary()
+		return binaryNode{"-", literalNode{0.0}, operand}, err
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	token := p.next()
+	switch token.kind {
+	case tokenNumber, tokenString:
+		return literalNode{token.value}, nil
+	case tokenName:
+		switch token.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		case "contains":
+			return nil, errors.New("expected a value before contains")
+		}
+		return p.path(token.text)
+	case tokenOperator:
+		if token.text == "(" {
+			inner, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.accept(")"); !ok {
+				return nil, errors.New("missing ')'")
+			}
+			return inner, nil
+		}
+		return nil, fmt.Errorf("unexpected %q", token.text)
+	}
+	return nil, errors.New("unexpected end of expression")
+}
+
+// path parses the .field and [n] steps after a name
+func (p *exprParser) path(name string) (exprNode, error) {
+	node := pathNode{name: name}
+	for {
+		switch op, _ := p.accept(".", "["); op {
+		case ".":
+			field := p.next()
+			if field.kind != tokenName {
+				return nil, fmt.Errorf("expected a field name after %s", name)
+			}
+			node.steps = append(node.steps, field.text)
+		case "[":
+			index := p.next()
+			if index.kind != tokenNumber && index.kind != tokenString {
+				return nil, errors.New("expected a number or string inside []")
+			}
+			if _, ok := p.accept("]"); !ok {
+				return nil, errors.New("missing ']'")
+			}
+			node.steps = append(node.steps, index.value)
+		default:
+			return node, nil
+		}
+	}
+}
+
+type exprNode interface {
+	eval(env *exprEnv) (any, error)
+}
+
+type literalNode struct {
+	value any
+}
+
+func (n literalNode) eval(*exprEnv) (any, error) {
+	return n.value, nil
+}
+
+// pathNode looks up a name and walks into objects by field and arrays by index
+type pathNode struct {
+	name  string
+	steps []any // string fields and float64 indexes
+}
+
+func (n pathNode) eval(env *exprEnv) (any, error) {
+	var value any
+	if strings.HasPrefix(n.name, "$") {
+		var ok bool
+		if value, ok = env.vars[n.name]; !ok {
+			return nil, fmt.Errorf("unknown variable %s", n.name)
+		}
+	} else if object, ok := env.output.(map[string]any); ok {
+		value = object[n.name]
+	}
+	for _, step := range n.steps {
+		switch key := step.(type) {
+		case string:
+			object, _ := value.(map[string]any)
+			value = object[key]
+		case float64:
+			array, _ := value.([]any)
+			if index := int(key); index >= 0 && index < len(array) {
+				value = array[index]
+			} else {
+				value = nil
+			}
+		}
+	}
+	return value, nil
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n notNode) eval(env *exprEnv) (any, error) {
+	value, err := n.operand.eval(env)
+	return !truthy(value), err
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n binaryNode) eval(env *exprEnv) (any, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// Logical operators short-circuit
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "&&", "||":
+		return truthy(right), nil
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "contains":
+		switch container := left.(type) {
+		case string:
+			s, ok := right.(string)
+			return ok && strings.Contains(container, s), nil
+		case []any:
+			for _, item := range container {
+				if equal(item, right) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case nil:
+			return false, nil
+		}
+		return nil, fmt.Errorf("contains needs a string or array, not %s", typeName(left))
+	case "<", "<=", ">", ">=":
+		if left == nil || right == nil {
+			return false, nil
+		}
+		cmp, err := compare(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	}
+
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	a, okA := left.(float64)
+	b, okB := right.(float64)
+	if !okA || !okB {
+		if s, ok := left.(string); ok && n.op == "+" {
+			if t, ok := right.(string); ok {
+				return s + t, nil
+			}
+		}
+		return nil, fmt.Errorf("cannot apply %s to %s and %s", n.op, typeName(left), typeName(right))
+	}
+	switch n.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return a / b, nil
+	default:
+		if int64(b) == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return float64(int64(a) % int64(b)), nil
+	}
+}
+
+func truthy(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+// equal compares JSON scalars; objects and arrays are never equal
+func equal(a, b any) bool {
+	switch a.(type) {
+	case nil, bool, float64, string:
+		return a == b
+	}
+	return false
+}
+
+// compare orders two numbers or two strings
+func compare(a, b any) (int, error) {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %s with %s", typeName(a), typeName(b))
+}
+
+func typeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	}
+	return "object"
+}
@@ -0,0 +1,141 @@
+package routine
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestExprEval(t *testing.T) {
+	var output any
+	if err := json.Unmarshal([]byte(`{"Count": 1200, "Name": "fetch-eu", "Tags": ["a", "b"], "Nested": {"Items": [{"Ok": true}, {"Ok": false}]}, "Empty": ""}`), &output); err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]any{"$error": nil, "$iteration": 4.0, "$id": "r1", "$state": "running", "$output": output}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"Count > 1000", true},
+		{"Count >= 1200 && Count <= 1200", true},
+		{"Count < 1000 || Name == 'fetch-eu'", true},
+		{`Name contains "eu"`, true},
+		{`Tags contains "c"`, false},
+		{`Tags contains "b"`, true},
+		{"Nested.Items[0].Ok", true},
+		{"Nested.Items[1].Ok", false},
+		{"Nested.Items[5].Ok == null", true},
+		{`Nested["Items"][0].Ok`, true},
+		{"Missing == null", true},
+		{"Missing > 3", false},
+		{"Missing < 3", false},
+		{"!Missing", true},
+		{"Empty", false},
+		{"Count", true},
+		{"1 + 2 * 3 == 7", true},
+		{"(1 + 2) * 3 == 9", true},
+		{"-Count < 0", true},
+		{"Count % 7 == 3", true},
+		{"10 / 4 == 2.5", true},
+		{"'a' + 'b' == 'ab'", true},
+		{"'abc' < 'abd'", true},
+		{"$error == null", true},
+		{"$iteration % 2 == 0", true},
+		{"$output.Count == Count", true},
+		{"$state == 'running' && $id != 'r2'", true},
+		{"Tags == Tags", false}, // Arrays are never equal
+		{"!(Count > 1000)", false},
+		{"1e3 < Count", true},
+		{`"say \"hi\"" contains "hi"`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			expr, err := ParseExpr(test.expr)
+			if err != nil {
+				t.Fatalf("ParseExpr: %v", err)
+			}
+			got, err := expr.Eval(output, vars)
+			if err != nil {
+				t.Fatalf("Eval: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExprEvalNoOutput(t *testing.T) {
+	// A failed iteration has no output, so field conditions simply do not hold
+	vars := map[string]any{"$error": "timeout while fetching"}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"Count > 1000", false},
+		{"$error != null", true},
+		{`$error contains "timeout"`, true},
+		{"Count + 1 == null", true},
+	}
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			expr, err := ParseExpr(test.expr)
+			if err != nil {
+				t.Fatalf("ParseExpr: %v", err)
+			}
+			got, err := expr.Eval(nil, vars)
+			if err != nil {
+				t.Fatalf("Eval: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"Count >",
+		"(Count > 1",
+		"Count > 1)",
+		`Name == "open`,
+		"Count # 1",
+		"contains 'a'",
+		"Items[",
+		"Items[0",
+		"Items.",
+		"1 2",
+	}
+	for _, source := range tests {
+		t.Run(source, func(t *testing.T) {
+			if _, err := ParseExpr(source); err == nil {
+				t.Errorf("ParseExpr(%q) succeeded, want an error", source)
+			}
+		})
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	output := map[string]any{"Count": 3.0, "Name": "x", "Tags": []any{"a"}}
+	tests := []string{
+		"Count / 0 > 1",
+		"Count % 0 > 1",
+		"Count < 'x'",
+		"Name - 1",
+		"Count contains 1",
+		"$unknown == 1",
+	}
+	for _, source := range tests {
+		t.Run(source, func(t *testing.T) {
+			expr, err := ParseExpr(source)
+			if err != nil {
+				t.Fatalf("ParseExpr: %v", err)
+			}
+			if _, err := expr.Eval(output, map[string]any{}); err == nil {
+				t.Errorf("Eval(%q) succeeded, want an error", source)
+			}
+		})
+	}
+}
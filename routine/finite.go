@@ -0,0 +1,116 @@
+package routine
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrDone is returned by a Job, possibly wrapped, to end its routine as
+// completed. The output returned with it is kept as the final output.
+var ErrDone = errors.New("routine done")
+
+// DefaultRetention is how long finished routines stay queryable when Retention is unset
+const DefaultRetention = time.Hour
+
+// Completion reasons recorded with the completed event
+const (
+	CompletedDone          = "done"
+	CompletedMaxIterations = "max-iterations"
+	CompletedDeadline      = "deadline"
+	CompletedMaxRuntime    = "max-runtime"
+)
+
+var errCompletedBeforeFirstIteration = errors.New("routine completed before its first iteration")
+
+// RunBounds make a routine finite. It completes when any bound is reached;
+// zero fields are unbounded.
+type RunBounds struct {
+	// MaxIterations counts successful iterations
+	MaxIterations int64 `json:"max_iterations,omitempty"`
+	// Until is the absolute time after which no iteration starts
+	Until time.Time `json:"until,omitzero"`
+	// MaxRuntime counts from when the routine starts running, not from when it was queued
+	MaxRuntime time.Duration `json:"max_runtime,omitempty"`
+}
+
+func (b RunBounds) validate() error {
+	if b.MaxIterations < 0 || b.MaxRuntime < 0 {
+		return errors.New("run bounds must not be negative")
+	}
+	return nil
+}
+
+// runBounds tracks a routine's bounds once it runs
+type runBounds struct {
+	RunBounds
+	// end is the earlier of Until and the start plus MaxRuntime
+	end       time.Time
+	endReason string
+}
+
+// begin fixes the end of the run when the routine starts running
+func (b *runBounds) begin(now time.Time) {
+	b.end, b.endReason = b.Until, CompletedDeadline
+	if b.MaxRuntime > 0 {
+		if end := now.Add(b.MaxRuntime); b.end.IsZero() || end.Before(b.end) {
+			b.end, b.endReason = end, CompletedMaxRuntime
+		}
+	}
+}
+
+// reached returns why the routine must complete, or "" while it may run on
+func (b *runBounds) reached(now time.Time, iterations int64) string {
+	if b.MaxIterations > 0 && iterations >= b.MaxIterations {
+		return CompletedMaxIterations
+	}
+	if !b.end.IsZero() && !now.Before(b.end) {
+		return b.endReason
+	}
+	return ""
+}
+
+// clamp shortens a wait so the routine notices its end on time
+func (b *runBounds) clamp(wait time.Duration, now time.Time) time.Duration {
+	if b.end.IsZero() {
+		return wait
+	}
+	return max(min(wait, b.end.Sub(now)), 0)
+}
+
+// Bounds returns the limits the routine was started with
+func (ctrl *RoutineControl[TConfig, TOutput]) Bounds() RunBounds {
+	return ctrl.bounds.RunBounds
+}
+
+// retention returns how long finished routines stay queryable
+func (s *RoutineScheduler[TConfig, TOutput]) retention() time.Duration {
+	if s.Retention <= 0 {
+		return DefaultRetention
+	}
+	return s.Retention
+}
+
+// parseBoundsQuery reads the max_iterations, until and max_runtime query parameters of a start request
+func parseBoundsQuery(query url.Values) (RunBounds, error) {
+	var bounds RunBounds
+	var err error
+	if value := query.Get("max_iterations"); value != "" {
+		if bounds.MaxIterations, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return bounds, fmt.Errorf("invalid max_iterations parameter %q", value)
+		}
+	}
+	if value := query.Get("until"); value != "" {
+		if bounds.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			return bounds, fmt.Errorf("invalid until parameter %q: use RFC 3339", value)
+		}
+	}
+	if value := query.Get("max_runtime"); value != "" {
+		if bounds.MaxRuntime, err = time.ParseDuration(value); err != nil {
+			return bounds, fmt.Errorf("invalid max_runtime parameter %q", value)
+		}
+	}
+	return bounds, bounds.validate()
+}
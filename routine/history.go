@@ -0,0 +1,312 @@
+package routine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RoutineState is the lifecycle state of a routine
+type RoutineState string
+
+const (
+	// StatePending routines wait in the admission queue for a free slot
+	StatePending RoutineState = "pending"
+	// StateWaiting routines wait for their dependencies before they are scheduled or admitted
+	StateWaiting RoutineState = "waiting"
+	// StateScheduled routines wait for their start time before admission
+	StateScheduled RoutineState = "scheduled"
+	StateRunning   RoutineState = "running"
+	StateSuspended RoutineState = "suspended"
+	StateStopped   RoutineState = "stopped"
+	StateFailed    RoutineState = "failed"
+	// StateCompleted routines reached a run bound or returned ErrDone
+	StateCompleted RoutineState = "completed"
+)
+
+// finished reports whether the state is final: stopped, failed or completed
+func (state RoutineState) finished() bool {
+	return state == StateStopped || state == StateFailed || state == StateCompleted
+}
+
+// History limits; older entries are dropped first
+const (
+	maxLifecycleEvents = 100
+	maxOutputSamples   = 500
+	maxLogEntries      = 200
+	maxErrorTraces     = 20
+)
+
+// LifecycleEvent records a change in a routine's life, such as being suspended or reconfigured
+type LifecycleEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// OutputSample is the output of one iteration along with how long it took
+type OutputSample struct {
+	Time       time.Time          `json:"time"`
+	Iteration  int64              `json:"iteration"`
+	DurationMs float64            `json:"duration_ms"`
+	Values     map[string]float64 `json:"values,omitempty"`
+}
+
+// LogEntry is a message logged by a job through RoutineControl.Logf
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// ErrorTrace is an error returned by a job, or a panic with its stack
+type ErrorTrace struct {
+	Time      time.Time `json:"time"`
+	Iteration int64     `json:"iteration"`
+	Error     string    `json:"error"`
+	Panic     bool      `json:"panic"`
+	Stack     string    `json:"stack,omitempty"`
+}
+
+// IterationTiming summarizes how long iterations take
+type IterationTiming struct {
+	Iterations int64   `json:"iterations"`
+	LastMs     float64 `json:"last_ms"`
+	AvgMs      float64 `json:"avg_ms"`
+	MinMs      float64 `json:"min_ms"`
+	MaxMs      float64 `json:"max_ms"`
+	// RateWaitMs is the time iterations were held back by rate limits
+	RateWaitMs     float64 `json:"rate_wait_ms"`
+	LastRateWaitMs float64 `json:"last_rate_wait_ms"`
+}
+
+// PanicError wraps a value recovered from a panicking job
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("job panicked: %v", e.Value)
+}
+
+// ring is a fixed-size buffer that keeps the most recent items
+type ring[T any] struct {
+	items []T
+	next  int
+	limit int
+}
+
+func newRing[T any](limit int) ring[T] {
+	return ring[T]{limit: limit}
+}
+
+func (r *ring[T]) push(item T) {
+	if len(r.items) < r.limit {
+		r.items = append(r.items, item)
+		return
+	}
+	r.items[r.next] = item
+	r.next = (r.next + 1) % r.limit
+}
+
+// slice returns the items from oldest to newest
+func (r *ring[T]) slice() []T {
+	out := make([]T, 0, len(r.items))
+	out = append(out, r.items[r.next:]...)
+	return append(out, r.items[:r.next]...)
+}
+
+// routineHistory keeps what happened to a routine for the detail view
+type routineHistory struct {
+	mu sync.Mutex
+
+	state     RoutineState
+	reached   map[RoutineState]bool // Every state the routine has been in
+	startedAt time.Time
+	events    ring[LifecycleEvent]
+	outputs   ring[OutputSample]
+	logs      ring[LogEntry]
+	errors    ring[ErrorTrace]
+
+	iterations    int64
+	totalDuration time.Duration
+	minDuration   time.Duration
+	maxDuration   time.Duration
+	lastDuration  time.Duration
+	rateWaited    time.Duration
+	lastRateWait  time.Duration
+
+	// changed is closed at the next state change; nil while nothing watches the routine
+	changed chan struct{}
+}
+
+func newRoutineHistory() *routineHistory {
+	return &routineHistory{
+		state:     StateRunning,
+		reached:   make(map[RoutineState]bool),
+		startedAt: time.Now(),
+		events:    newRing[LifecycleEvent](maxLifecycleEvents),
+		outputs:   newRing[OutputSample](maxOutputSamples),
+		logs:      newRing[LogEntry](maxLogEntries),
+		errors:    newRing[ErrorTrace](maxErrorTraces),
+	}
+}
+
+// event records a lifecycle event, changing the state when one is given
+func (h *routineHistory) event(state RoutineState, event, detail string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state != "" {
+		h.state = state
+		h.reached[state] = true
+		if h.changed != nil {
+			close(h.changed)
+			h.changed = nil
+		}
+	}
+	h.events.push(LifecycleEvent{Time: time.Now(), Event: event, Detail: detail})
+}
+
+// watch reports whether the routine has been in state and, when it has not,
+// returns its current state and a channel closed at its next state change
+func (h *routineHistory) watch(state RoutineState) (reached bool, current RoutineState, changed <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.reached[state] {
+		return true, h.state, nil
+	}
+	if h.changed == nil {
+		h.changed = make(chan struct{})
+	}
+	return false, h.state, h.changed
+}
+
+// iteration records a successful iteration and its numeric output values
+func (h *routineHistory) iteration(duration time.Duration, values map[string]float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.iterations++
+	h.totalDuration += duration
+	h.lastDuration = duration
+	if h.iterations == 1 || duration < h.minDuration {
+		h.minDuration = duration
+	}
+	if duration > h.maxDuration {
+		h.maxDuration = duration
+	}
+	h.outputs.push(OutputSample{
+		Time:       time.Now(),
+		Iteration:  h.iterations,
+		DurationMs: milliseconds(duration),
+		Values:     values,
+	})
+}
+
+// hasReached reports whether the routine has ever been in the state
+func (h *routineHistory) hasReached(state RoutineState) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.reached[state]
+}
+
+// iterationCount returns the number of successful iterations
+func (h *routineHistory) iterationCount() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.iterations
+}
+
+// rateWait records how long rate limits delay the next iteration
+func (h *routineHistory) rateWait(wait time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rateWaited += wait
+	h.lastRateWait = wait
+}
+
+// failure records an error or panic that ended an iteration
+func (h *routineHistory) failure(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	trace := ErrorTrace{Time: time.Now(), Iteration: h.iterations + 1, Error: err.Error()}
+	if panicErr, ok := err.(*PanicError); ok {
+		trace.Panic = true
+		trace.Stack = string(panicErr.Stack)
+	}
+	h.errors.push(trace)
+}
+
+func (h *routineHistory) log(message string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.logs.push(LogEntry{Time: time.Now(), Message: message})
+}
+
+func (h *routineHistory) currentState() RoutineState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+func (h *routineHistory) timing() IterationTiming {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	timing := IterationTiming{
+		Iterations: h.iterations,
+		LastMs:     milliseconds(h.lastDuration),
+		MinMs:      milliseconds(h.minDuration),
+		MaxMs:      milliseconds(h.maxDuration),
+
+		RateWaitMs:     milliseconds(h.rateWaited),
+		LastRateWaitMs: milliseconds(h.lastRateWait),
+	}
+	if h.iterations > 0 {
+		timing.AvgMs = milliseconds(h.totalDuration) / float64(h.iterations)
+	}
+	return timing
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// numericValues extracts the numbers in the JSON form of an output, keyed by dotted path.
+// A bare number is reported under "value".
+func numericValues(output any) map[string]float64 {
+	data, err := json.Marshal(output)
+	if err != nil {
+		return nil
+	}
+	var decoded any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil
+	}
+	values := make(map[string]float64)
+	collectNumbers(values, "", decoded, 0)
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+func collectNumbers(values map[string]float64, prefix string, node any, depth int) {
+	// Deeply nested outputs are unlikely to be charted; keep the sample small
+	if depth > 3 {
+		return
+	}
+	switch v := node.(type) {
+	case float64:
+		if prefix == "" {
+			prefix = "value"
+		}
+		values[prefix] = v
+	case map[string]any:
+		for key, child := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			collectNumbers(values, key, child, depth+1)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package routine
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultIdempotencyWindow is how long start results are remembered when IdempotencyWindow is unset
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKeyLength rejects keys that are clearly not opaque client tokens
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotencyEntries bounds the responses kept for replay; the oldest
+// finished one makes room for a new key
+const maxIdempotencyEntries = 10000
+
+var (
+	errIdempotencyKeyTooLong = errors.New("Idempotency-Key is too long")
+	errIdempotencyKeyReused  = errors.New("Idempotency-Key was already used for a different request")
+	errIdempotencyIncomplete = errors.New("the original request with this Idempotency-Key did not complete; retry it")
+	errIdempotencyCacheFull  = errors.New("too many requests with an Idempotency-Key are in progress; retry later")
+)
+
+// idempotentResponse is a finished response kept for replay, or one still being produced
+type idempotentResponse struct {
+	key         string
+	element     *list.Element // Position in the expiry order once finished
+	fingerprint [32]byte
+	done        chan struct{}
+	expires     time.Time
+	status      int
+	header      http.Header
+	body        []byte
+	ids         []string // Routines the original request acted on, for the audit log
+}
+
+// idempotencyCache remembers responses by caller and Idempotency-Key.
+// The zero value is ready to use.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+	// finished orders finished entries by expiry; the window is fixed, so
+	// that is the order they finished in
+	finished list.List
+}
+
+// begin returns the entry for key, creating it if absent. The boolean
+// reports whether the caller owns the new entry and must produce the response.
+// It fails when the cache is full of requests still in progress.
+func (c *idempotencyCache) begin(key string, fingerprint [32]byte, now time.Time) (*idempotentResponse, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*idempotentResponse)
+	}
+	// Expired entries are swept here instead of by a background goroutine
+	for front := c.finished.Front(); front != nil; front = c.finished.Front() {
+		entry := front.Value.(*idempotentResponse)
+		if !now.After(entry.expires) {
+			break
+		}
+		c.removeLocked(entry)
+	}
+	if entry, ok := c.entries[key]; ok {
+		return entry, false, nil
+	}
+	if len(c.entries) >= maxIdempotencyEntries {
+		front := c.finished.Front()
+		if front == nil {
+			return nil, false, errIdempotencyCacheFull
+		}
+		c.removeLocked(front.Value.(*idempotentResponse))
+	}
+	entry := &idempotentResponse{key: key, fingerprint: fingerprint, done: make(chan struct{})}
+	c.entries[key] = entry
+	return entry, true, nil
+}
+
+func (c *idempotencyCache) removeLocked(entry *idempotentResponse) {
+	delete(c.entries, entry.key)
+	if entry.element != nil {
+		c.finished.Remove(entry.element)
+		entry.element = nil
+	}
+}
+
+// finish stores the produced response and wakes requests waiting to replay it
+func (c *idempotencyCache) finish(entry *idempotentResponse, rec *auditRecorder, ids []string, expires time.Time) {
+	c.mu.Lock()
+	entry.ids = slices.Clone(ids)
+	entry.status = rec.status
+	entry.header = rec.Header().Clone()
+	entry.body = bytes.Clone(rec.body.Bytes())
+	entry.expires = expires
+	entry.element = c.finished.PushBack(entry)
+	c.mu.Unlock()
+	close(entry.done)
+}
+
+// forget drops an entry whose handler failed to produce a response, so the key can be retried
+func (c *idempotencyCache) forget(key string, entry *idempotentResponse) {
+	c.mu.Lock()
+	if c.entries[key] == entry {
+		c.removeLocked(entry)
+	}
+	c.mu.Unlock()
+	close(entry.done)
+}
+
+// idempotent makes a handler safe to retry. A request carrying an
+// Idempotency-Key runs once per caller and key within IdempotencyWindow;
+// retries get the original status and body with Idempotent-Replayed: true.
+// A retry that arrives while the first request is still running waits for it.
+// Reusing a key for a different request fails with 422, and a new key fails
+// with 503 while the cache is full of requests in progress. Replays are audited
+// with the original request's routines and marked as replayed.
+func (s *RoutineScheduler[TConfig, TOutput]) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		result := NewHandleResult(0, "Invalid Idempotency-Key")
+		if len(key) > maxIdempotencyKeyLength {
+			result.SetError(errIdempotencyKeyTooLong).Response(w)
+			return
+		}
+
+		// The request is identified by its method, query and body
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			result.SetError(err).Response(w)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		io.WriteString(hash, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery+"\n")
+		hash.Write(body)
+		var fingerprint [32]byte
+		copy(fingerprint[:], hash.Sum(nil))
+
+		// Keys are scoped to the caller so one client cannot replay another's result
+		cacheKey := callerIdentity(r) + "\x00" + key
+		entry, owner, err := s.idempotency.begin(cacheKey, fingerprint, time.Now())
+		if err != nil {
+			result.SetError(err).Status(http.StatusServiceUnavailable).Response(w)
+			return
+		}
+		if !owner {
+			if entry.fingerprint != fingerprint {
+				result.SetError(errIdempotencyKeyReused).Status(http.StatusUnprocessableEntity).Response(w)
+				return
+			}
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.status == 0 {
+				// The first request never produced a response; let the client try again
+				result.SetError(errIdempotencyIncomplete).Status(http.StatusConflict).Response(w)
+				return
+			}
+			audit := auditFrom(r)
+			audit.IDs = entry.ids
+			audit.Replayed = true
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		rec := &auditRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if !completed {
+				s.idempotency.forget(cacheKey, entry)
+			}
+		}()
+		next(rec, r)
+		if rec.status == 0 {
+			return
+		}
+		completed = true
+		window := s.IdempotencyWindow
+		if window <= 0 {
+			window = DefaultIdempotencyWindow
+		}
+		s.idempotency.finish(entry, rec, auditFrom(r).IDs, time.Now().Add(window))
+	}
+}
@@ -0,0 +1,284 @@
+package routine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	var cache idempotencyCache
+	now := time.Now()
+	fingerprint := [32]byte{1}
+
+	entry, owner, _ := cache.begin("k", fingerprint, now)
+	if !owner {
+		t.Fatal("the first request should own the entry")
+	}
+	if again, owner, _ := cache.begin("k", fingerprint, now); owner || again != entry {
+		t.Fatal("a retry should get the existing entry")
+	}
+
+	rec := &auditRecorder{ResponseWriter: httptest.NewRecorder()}
+	rec.Header().Set("Content-Type", "application/json")
+	rec.WriteHeader(http.StatusOK)
+	rec.Write([]byte(`{"ok":true}`))
+	cache.finish(entry, rec, []string{"r1"}, now.Add(time.Minute))
+	select {
+	case <-entry.done:
+	default:
+		t.Fatal("finish should wake waiting retries")
+	}
+	if entry.status != http.StatusOK || string(entry.body) != `{"ok":true}` || !slices.Equal(entry.ids, []string{"r1"}) {
+		t.Errorf("stored %d %s %v", entry.status, entry.body, entry.ids)
+	}
+
+	// Entries are swept once they expire
+	if _, owner, _ := cache.begin("k", fingerprint, now.Add(30*time.Second)); owner {
+		t.Error("the entry expired early")
+	}
+	if _, owner, _ := cache.begin("k", fingerprint, now.Add(2*time.Minute)); !owner {
+		t.Error("the expired entry was replayed")
+	}
+}
+
+func TestIdempotencyCacheForget(t *testing.T) {
+	var cache idempotencyCache
+	now := time.Now()
+	entry, _, _ := cache.begin("k", [32]byte{1}, now)
+	cache.forget("k", entry)
+	select {
+	case <-entry.done:
+	default:
+		t.Fatal("forget should wake waiting retries")
+	}
+	if _, owner, _ := cache.begin("k", [32]byte{1}, now); !owner {
+		t.Error("a forgotten key should run again")
+	}
+}
+
+func TestIdempotencyCacheBounded(t *testing.T) {
+	var cache idempotencyCache
+	now := time.Now()
+	finish := func(entry *idempotentResponse, expires time.Time) {
+		rec := &auditRecorder{ResponseWriter: httptest.NewRecorder()}
+		rec.WriteHeader(http.StatusOK)
+		cache.finish(entry, rec, nil, expires)
+	}
+	var inFlight []*idempotentResponse
+	for i := range maxIdempotencyEntries {
+		entry, _, err := cache.begin(fmt.Sprint(i), [32]byte{}, now)
+		if err != nil {
+			t.Fatalf("begin %d: %v", i, err)
+		}
+		inFlight = append(inFlight, entry)
+	}
+	// Requests still in progress are never evicted
+	if _, _, err := cache.begin("new", [32]byte{}, now); !errors.Is(err, errIdempotencyCacheFull) {
+		t.Fatalf("begin on a full cache = %v, want %v", err, errIdempotencyCacheFull)
+	}
+
+	// Once some finish, the oldest finished makes room first
+	finish(inFlight[5], now.Add(time.Minute))
+	finish(inFlight[3], now.Add(2*time.Minute))
+	if _, owner, err := cache.begin("new", [32]byte{}, now); err != nil || !owner {
+		t.Fatalf("begin after a finish = (%v, %v)", owner, err)
+	}
+	if _, ok := cache.entries["5"]; ok {
+		t.Error("the oldest finished entry was kept")
+	}
+	if _, ok := cache.entries["3"]; !ok {
+		t.Error("a newer finished entry was evicted")
+	}
+	if len(cache.entries) != maxIdempotencyEntries || cache.finished.Len() != 1 {
+		t.Errorf("cache holds %d entries, %d finished", len(cache.entries), cache.finished.Len())
+	}
+
+	// Expired entries are swept from the front of the expiry order
+	if _, owner, _ := cache.begin("3", [32]byte{}, now.Add(3*time.Minute)); !owner {
+		t.Error("the expired entry was replayed")
+	}
+	if cache.finished.Len() != 0 {
+		t.Errorf("%d finished entries left after they all expired", cache.finished.Len())
+	}
+}
+
+// idempotentRequest is one request to the idempotent test handler and what it should get
+type idempotentRequest struct {
+	key, caller, query, body string
+	status                   int
+	replayed                 bool
+	calls                    int    // Handler calls after this request
+	audited                  string // Routine ID the audit entry names, if any
+}
+
+func TestIdempotent(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []idempotentRequest
+	}{
+		{
+			name: "requests without a key always run",
+			requests: []idempotentRequest{
+				{status: http.StatusOK, calls: 1, audited: "r1"},
+				{status: http.StatusOK, calls: 2, audited: "r2"},
+			},
+		},
+		{
+			name: "a retry is replayed",
+			requests: []idempotentRequest{
+				{key: "a", body: "x", status: http.StatusOK, calls: 1, audited: "r1"},
+				{key: "a", body: "x", status: http.StatusOK, replayed: true, calls: 1, audited: "r1"},
+				{key: "b", body: "x", status: http.StatusOK, calls: 2, audited: "r2"},
+			},
+		},
+		{
+			name: "a key reused for another request is rejected",
+			requests: []idempotentRequest{
+				{key: "a", body: "x", status: http.StatusOK, calls: 1, audited: "r1"},
+				{key: "a", body: "y", status: http.StatusUnprocessableEntity, calls: 1},
+				{key: "a", body: "x", query: "count=2", status: http.StatusUnprocessableEntity, calls: 1},
+			},
+		},
+		{
+			name: "keys are scoped to the caller",
+			requests: []idempotentRequest{
+				{key: "a", caller: "alice", body: "x", status: http.StatusOK, calls: 1, audited: "r1"},
+				{key: "a", caller: "bob", body: "x", status: http.StatusOK, calls: 2, audited: "r2"},
+				{key: "a", caller: "alice", body: "x", status: http.StatusOK, replayed: true, calls: 2, audited: "r1"},
+			},
+		},
+		{
+			name: "failed responses are replayed too",
+			requests: []idempotentRequest{
+				{key: "a", body: "fail", status: http.StatusBadRequest, calls: 1, audited: "r1"},
+				{key: "a", body: "fail", status: http.StatusBadRequest, replayed: true, calls: 1, audited: "r1"},
+			},
+		},
+		{
+			name: "overlong keys are rejected",
+			requests: []idempotentRequest{
+				{key: strings.Repeat("k", maxIdempotencyKeyLength+1), body: "x", status: http.StatusBadRequest, calls: 0},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			audit, err := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer audit.Close()
+			s := &RoutineScheduler[int, int]{Audit: audit}
+			calls := 0
+			handler := s.audited("start", s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				auditFrom(r).IDs = []string{fmt.Sprintf("r%d", calls)}
+				result := NewHandleResult(1, "Failed to start")
+				if r.URL.Query().Get("fail") != "" {
+					result.SetError(fmt.Errorf("failed"))
+				} else {
+					result.Set(1, 1)
+				}
+				result.Response(w)
+			}))
+
+			var wantAudit []AuditEntry
+			for i, req := range test.requests {
+				query := req.query
+				if req.body == "fail" {
+					query = "fail=1"
+				}
+				r := httptest.NewRequest(http.MethodPost, "/start?"+query, strings.NewReader(req.body))
+				if req.key != "" {
+					r.Header.Set("Idempotency-Key", req.key)
+				}
+				if req.caller != "" {
+					r = r.WithContext(context.WithValue(r.Context(), principalContextKey{}, &Principal{Name: req.caller}))
+				}
+				w := httptest.NewRecorder()
+				handler(w, r)
+
+				if w.Code != req.status {
+					t.Errorf("request %d: status %d, want %d: %s", i, w.Code, req.status, w.Body)
+				}
+				if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != req.replayed {
+					t.Errorf("request %d: replayed %v, want %v", i, replayed, req.replayed)
+				}
+				if calls != req.calls {
+					t.Errorf("request %d: handler ran %d times, want %d", i, calls, req.calls)
+				}
+				// Replays are audited with the routines of the original request
+				entry := AuditEntry{Replayed: req.replayed, Status: req.status}
+				if req.audited != "" {
+					entry.IDs = []string{req.audited}
+				}
+				wantAudit = append(wantAudit, entry)
+			}
+
+			entries, err := audit.Query(AuditQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(wantAudit) {
+				t.Fatalf("audited %d requests, want %d", len(entries), len(wantAudit))
+			}
+			for i, entry := range entries {
+				want := wantAudit[i]
+				if entry.Replayed != want.Replayed || entry.Status != want.Status || !slices.Equal(entry.IDs, want.IDs) {
+					t.Errorf("audit entry %d = replayed %v, status %d, ids %v; want replayed %v, status %d, ids %v",
+						i, entry.Replayed, entry.Status, entry.IDs, want.Replayed, want.Status, want.IDs)
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotentRetryWaitsForFirstRequest(t *testing.T) {
+	s := &RoutineScheduler[int, int]{}
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	calls := 0
+	handler := s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		close(entered)
+		<-release
+		NewHandleResult(1, "").Set(1, 1).Response(w)
+	})
+
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/start", strings.NewReader("x"))
+		r.Header.Set("Idempotency-Key", "a")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- request() }()
+	<-entered
+	retry := make(chan *httptest.ResponseRecorder)
+	go func() { retry <- request() }()
+
+	select {
+	case <-retry:
+		t.Fatal("the retry answered before the first request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if w := <-first; w.Code != http.StatusOK {
+		t.Errorf("first request status %d", w.Code)
+	}
+	if w := <-retry; w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry status %d, replayed %q", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+}
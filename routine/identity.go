@@ -0,0 +1,196 @@
+package routine
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// ErrIDConflict is returned when a requested routine name is already taken
+var ErrIDConflict = errors.New("routine ID already in use")
+
+// maxIdentityAttempts bounds how often a generated ID is regenerated after a collision
+// before a ULID suffix is appended to make it unique
+const maxIdentityAttempts = 5
+
+// crockford is the Base32 alphabet ULIDs are written in
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var ulidState struct {
+	mu     sync.Mutex
+	last   uint64
+	random [10]byte
+}
+
+// NewULID returns a ULID: a 48-bit millisecond timestamp and 80 random bits
+// in 26 Crockford Base32 characters. IDs sort by creation time, and IDs
+// created in the same millisecond increment the random part so they stay
+// unique and ordered.
+func NewULID() string {
+	ulidState.mu.Lock()
+	now := uint64(time.Now().UnixMilli())
+	if now <= ulidState.last {
+		// Same millisecond (or a clock step back): increment the previous random part
+		now = ulidState.last
+		for i := len(ulidState.random) - 1; i >= 0; i-- {
+			ulidState.random[i]++
+			if ulidState.random[i] != 0 {
+				break
+			}
+		}
+	} else {
+		ulidState.last = now
+		_, _ = rand.Read(ulidState.random[:])
+	}
+	var raw [16]byte
+	binary.BigEndian.PutUint64(raw[:8], now<<16)
+	copy(raw[6:], ulidState.random[:])
+	ulidState.mu.Unlock()
+	return encodeULID(raw)
+}
+
+// encodeULID writes 128 bits as 26 characters of 5 bits, the first holding only 3
+func encodeULID(raw [16]byte) string {
+	var out [26]byte
+	var acc uint64
+	var hi = binary.BigEndian.Uint64(raw[:8])
+	var lo = binary.BigEndian.Uint64(raw[8:])
+	for i := 25; i >= 0; i-- {
+		acc = lo & 31
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+		out[i] = crockford[acc]
+	}
+	return string(out[:])
+}
+
+// NewUUID returns a random (version 4) UUID
+func NewUUID() string {
+	var raw [16]byte
+	_, _ = rand.Read(raw[:])
+	raw[6] = raw[6]&0x0f | 0x40
+	raw[8] = raw[8]&0x3f | 0x80
+	var buf bytes.Buffer
+	for i, part := range [][]byte{raw[0:4], raw[4:6], raw[6:8], raw[8:10], raw[10:16]} {
+		if i > 0 {
+			buf.WriteByte('-')
+		}
+		buf.WriteString(hex.EncodeToString(part))
+	}
+	return buf.String()
+}
+
+// ULIDIdentity returns a RoutineIdentity generating prefix followed by a ULID
+func ULIDIdentity[TConfig any](prefix string) RoutineIdentity[TConfig] {
+	return func(TConfig) string { return prefix + NewULID() }
+}
+
+// UUIDIdentity returns a RoutineIdentity generating prefix followed by a random UUID
+func UUIDIdentity[TConfig any](prefix string) RoutineIdentity[TConfig] {
+	return func(TConfig) string { return prefix + NewUUID() }
+}
+
+// identitySeq numbers routines across all schedulers for the {{.Seq}} template field
+var identitySeq atomic.Int64
+
+// IdentityData is what an ID template can refer to
+type IdentityData struct {
+	// Type is the routine type, "default" when unset
+	Type string
+	// Labels are the labels given at start, so {{.Labels.env}} works
+	Labels Labels
+	// Generated is the ID from the routine's GenIdentity
+	Generated string
+	ULID      string
+	UUID      string
+	// Seq increases by one for every routine started
+	Seq int64
+}
+
+// ParseIDTemplate parses a text/template for routine IDs, such as
+// "{{.Type}}-{{.Labels.env}}-{{.ULID}}". Missing labels render as empty.
+func ParseIDTemplate(text string) (*template.Template, error) {
+	return template.New("id").Option("missingkey=zero").Parse(text)
+}
+
+// validRoutineName reports whether a client-supplied name is safe to use as an ID:
+// at most 253 letters, digits, '-', '_' and '.', beginning and ending with a letter or digit
+func validRoutineName(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for i, r := range name {
+		alnum := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+		if !alnum && (i == 0 || i == len(name)-1 || !strings.ContainsRune("-_.", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// generateID builds a candidate ID from the ID template, or GenIdentity without one
+func (s *RoutineScheduler[TConfig, TOutput]) generateID(config TConfig, opts StartOptions) (string, error) {
+	generated := s.Routine.GenIdentity(config)
+	if s.IDTemplate == nil {
+		return generated, nil
+	}
+	var buf bytes.Buffer
+	err := s.IDTemplate.Execute(&buf, IdentityData{
+		Type:      s.routineType(),
+		Labels:    copyLabels(opts.Labels),
+		Generated: generated,
+		ULID:      NewULID(),
+		UUID:      NewUUID(),
+		Seq:       identitySeq.Add(1),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not render ID template: %v", err)
+	}
+	if buf.Len() == 0 {
+		return "", errors.New("ID template rendered an empty ID")
+	}
+	return buf.String(), nil
+}
+
+// claimID reserves a unique ID for ctrl in routineMap. A client-supplied name
+// fails with ErrIDConflict when taken; generated IDs are regenerated on
+// collision and finally made unique with a ULID suffix.
+func (s *RoutineScheduler[TConfig, TOutput]) claimID(ctrl *RoutineControl[TConfig, TOutput], config TConfig, opts StartOptions) (string, error) {
+	if opts.Name != "" {
+		if !validRoutineName(opts.Name) {
+			return "", fmt.Errorf("invalid routine name %q", opts.Name)
+		}
+		if _, loaded := routineMap.LoadOrStore(opts.Name, ctrl); loaded {
+			return "", fmt.Errorf("%w: %s", ErrIDConflict, opts.Name)
+		}
+		return opts.Name, nil
+	}
+
+	var id string
+	for attempt := 0; attempt < maxIdentityAttempts; attempt++ {
+		candidate, err := s.generateID(config, opts)
+		if err != nil {
+			return "", err
+		}
+		if _, loaded := routineMap.LoadOrStore(candidate, ctrl); !loaded {
+			return candidate, nil
+		}
+		id = candidate
+	}
+	log.Printf("routine ID %s keeps colliding, adding a unique suffix", id)
+	for {
+		candidate := id + "-" + NewULID()
+		if _, loaded := routineMap.LoadOrStore(candidate, ctrl); !loaded {
+			return candidate, nil
+		}
+	}
+}
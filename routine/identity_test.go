@@ -0,0 +1,136 @@
+package routine
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeULID(t *testing.T) {
+	timestamp := func(ms uint64) [16]byte {
+		var raw [16]byte
+		binary.BigEndian.PutUint64(raw[:8], ms<<16)
+		return raw
+	}
+	var ones [16]byte
+	for i := range ones {
+		ones[i] = 0xff
+	}
+	tests := []struct {
+		name string
+		raw  [16]byte
+		want string
+	}{
+		{"zero", [16]byte{}, "00000000000000000000000000"},
+		{"largest", ones, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ"},
+		// The timestamp of the example in the ULID specification
+		{"timestamp", timestamp(1469918176385), "01ARYZ6S410000000000000000"},
+		{"lowest bit", [16]byte{15: 1}, "00000000000000000000000001"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := encodeULID(test.raw); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewULIDMonotonic(t *testing.T) {
+	start := time.Now().UnixMilli()
+	previous := NewULID()
+	// Far more IDs than milliseconds pass, so many share one
+	for range 10000 {
+		id := NewULID()
+		if len(id) != 26 || strings.Trim(id, crockford) != "" {
+			t.Fatalf("%s is not 26 Crockford Base32 characters", id)
+		}
+		if id <= previous {
+			t.Fatalf("%s does not sort after %s", id, previous)
+		}
+		previous = id
+	}
+	if ms, now := ulidTime(previous), time.Now().UnixMilli(); ms < start || ms > now {
+		t.Errorf("timestamp %d is outside [%d, %d]", ms, start, now)
+	}
+}
+
+func TestNewULIDCarriesWithinAMillisecond(t *testing.T) {
+	ulidState.mu.Lock()
+	savedLast, savedRandom := ulidState.last, ulidState.random
+	// Pretend the last ID was made in the future, so the next one shares its millisecond
+	future := uint64(time.Now().Add(time.Hour).UnixMilli())
+	ulidState.last = future
+	ulidState.random = [10]byte{7: 0x01, 8: 0xff, 9: 0xff}
+	ulidState.mu.Unlock()
+	defer func() {
+		ulidState.mu.Lock()
+		ulidState.last, ulidState.random = savedLast, savedRandom
+		ulidState.mu.Unlock()
+	}()
+
+	id := NewULID()
+	if ms := ulidTime(id); ms != int64(future) {
+		t.Errorf("timestamp %d, want the shared millisecond %d", ms, future)
+	}
+	if !strings.HasSuffix(id, encodeULID([16]byte{13: 0x02})[10:]) {
+		t.Errorf("%s does not end in the incremented random part", id)
+	}
+}
+
+// ulidTime decodes the millisecond timestamp held in the first ten characters
+func ulidTime(id string) int64 {
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	return ms
+}
+
+func TestClaimID(t *testing.T) {
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	taken := &RoutineControl[*testConfig, int]{}
+	for _, id := range []string{"dup", "seq-1", "seq-2", "named"} {
+		routineMap.Store(id, taken)
+		t.Cleanup(func() { routineMap.Delete(id) })
+	}
+	claim := func(opts StartOptions) (string, error) {
+		ctrl := NewRoutineControl(&testConfig{}, 0)
+		id, err := s.claimID(ctrl, &testConfig{}, opts)
+		if err == nil {
+			t.Cleanup(func() { routineMap.Delete(id) })
+		}
+		return id, err
+	}
+
+	// A generator that collides a few times is retried
+	n := 0
+	s.Routine.GenIdentity = func(*testConfig) string { n++; return "seq-" + string(rune('0'+n)) }
+	if id, err := claim(StartOptions{}); err != nil || id != "seq-3" || n != 3 {
+		t.Errorf("got (%s, %v) after %d attempts, want seq-3 after 3", id, err, n)
+	}
+
+	// One that keeps colliding gets a ULID suffix
+	n = 0
+	s.Routine.GenIdentity = func(*testConfig) string { n++; return "dup" }
+	id, err := claim(StartOptions{})
+	if err != nil || !strings.HasPrefix(id, "dup-") || len(id) != len("dup-")+26 {
+		t.Errorf("got (%s, %v), want dup- followed by a ULID", id, err)
+	}
+	if n != maxIdentityAttempts {
+		t.Errorf("generated %d IDs before the suffix, want %d", n, maxIdentityAttempts)
+	}
+
+	// Names are never altered
+	if _, err := claim(StartOptions{Name: "named"}); !errors.Is(err, ErrIDConflict) {
+		t.Errorf("a taken name = %v, want %v", err, ErrIDConflict)
+	}
+	if _, err := claim(StartOptions{Name: "-bad"}); err == nil || errors.Is(err, ErrIDConflict) {
+		t.Errorf("an invalid name = %v, want it refused", err)
+	}
+	if id, err := claim(StartOptions{Name: "fresh"}); err != nil || id != "fresh" {
+		t.Errorf("a free name = (%s, %v)", id, err)
+	}
+}
@@ -0,0 +1,124 @@
+package routine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// RunOnce starts a one-shot routine: it runs a single iteration and completes,
+// leaving its output in its tombstone. Set opts.StartAt to run it later.
+func (s *RoutineScheduler[TConfig, TOutput]) RunOnce(config TConfig, opts StartOptions) (string, error) {
+	opts.Bounds.MaxIterations = 1
+	return s.StartRoutineWithOptions(config, opts)
+}
+
+// ParseStartAt parses when a delayed routine starts: an RFC 3339 time, or a
+// clock time such as "03:00" or "03:00:30" meaning its next occurrence in
+// now's location
+func ParseStartAt(value string, now time.Time) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		clock, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		at := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid start time %q: use RFC 3339 or HH:MM", value)
+}
+
+// parseScheduleQuery applies the once, at and delay query parameters of a start request
+func parseScheduleQuery(query url.Values, opts *StartOptions) error {
+	if query.Get("once") == "true" {
+		if opts.Bounds.MaxIterations > 0 {
+			return errors.New("give either once or max_iterations, not both")
+		}
+		opts.Bounds.MaxIterations = 1
+	}
+	at, delay := query.Get("at"), query.Get("delay")
+	switch {
+	case at != "" && delay != "":
+		return errors.New("give either at or delay, not both")
+	case at != "":
+		var err error
+		if opts.StartAt, err = ParseStartAt(at, time.Now()); err != nil {
+			return err
+		}
+	case delay != "":
+		wait, err := time.ParseDuration(delay)
+		if err != nil || wait < 0 {
+			return fmt.Errorf("invalid delay parameter %q", delay)
+		}
+		opts.StartAt = time.Now().Add(wait)
+	}
+	return nil
+}
+
+// StartAt returns when a delayed routine was scheduled to start, or the zero time
+func (ctrl *RoutineControl[TConfig, TOutput]) StartAt() time.Time {
+	return ctrl.startAt
+}
+
+// handleResult returns the outcome of a finished routine from its tombstone.
+// A routine that has not finished yet is answered with 202 and its state;
+// wait=<duration> blocks up to that long for it to finish first.
+func (s *RoutineScheduler[TConfig, TOutput]) handleResult(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	result := NewHandleResult(1, "Failed to load result")
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		if wait, err = time.ParseDuration(value); err != nil || wait < 0 {
+			result.SetError(fmt.Errorf("invalid wait parameter %q", value)).Response(w)
+			return
+		}
+	}
+
+	if ctrl, err := s.loadControl(id); err == nil {
+		if !s.can(r, PermViewStatus, ctrl.Tags) {
+			denied(w, &PermissionError{Permission: PermViewStatus, ID: id})
+			return
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-ctrl.Done:
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// A live routine wins over an older tombstone under the same ID
+	if ctrl, err := s.loadControl(id); err == nil {
+		pending := map[string]any{"id": id, "state": ctrl.State()}
+		if at := ctrl.StartAt(); !at.IsZero() {
+			pending["start_at"] = at
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(pending)
+		return
+	}
+	entry, ok := s.loadTombstone(id)
+	if !ok {
+		result.SetError(fmt.Errorf("routine %s not found", id)).Status(http.StatusNotFound).Response(w)
+		return
+	}
+	if !s.can(r, PermViewStatus, entry.Tags) {
+		denied(w, &PermissionError{Permission: PermViewStatus, ID: id})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entry.Tombstone)
+}
@@ -0,0 +1,162 @@
+package routine
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseStartAt(t *testing.T) {
+	utc := time.Date(2026, 5, 10, 14, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value string
+		now   time.Time
+		want  time.Time
+		err   bool
+	}{
+		{"RFC 3339", "2026-05-11T08:00:00Z", utc, time.Date(2026, 5, 11, 8, 0, 0, 0, time.UTC), false},
+		{"later today", "18:00", utc, time.Date(2026, 5, 10, 18, 0, 0, 0, time.UTC), false},
+		{"with seconds", "14:30:01", utc, time.Date(2026, 5, 10, 14, 30, 1, 0, time.UTC), false},
+		{"earlier rolls over to tomorrow", "09:15", utc, time.Date(2026, 5, 11, 9, 15, 0, 0, time.UTC), false},
+		{"now rolls over to tomorrow", "14:30", utc, time.Date(2026, 5, 11, 14, 30, 0, 0, time.UTC), false},
+		{"rolls over into the next month", "00:00", time.Date(2026, 5, 31, 23, 0, 0, 0, time.UTC), time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC), false},
+		{"out of range", "25:00", utc, time.Time{}, true},
+		{"not a time", "soon", utc, time.Time{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseStartAt(test.value, test.now)
+			if !got.Equal(test.want) || (err != nil) != test.err {
+				t.Errorf("got (%v, %v), want %v with error %v", got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func TestParseStartAtAcrossDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	tests := []struct {
+		name  string
+		value string
+		now   time.Time
+		want  time.Time
+		wait  time.Duration
+	}{
+		// Clocks move forward at 02:00 on 8 March 2026, so the next day is 23 hours long
+		{"spring forward", "09:00", time.Date(2026, 3, 7, 12, 0, 0, 0, loc), time.Date(2026, 3, 8, 9, 0, 0, 0, loc), 20 * time.Hour},
+		// And back at 02:00 on 1 November 2026, so that day is 25 hours long
+		{"fall back", "09:00", time.Date(2026, 10, 31, 12, 0, 0, 0, loc), time.Date(2026, 11, 1, 9, 0, 0, 0, loc), 22 * time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseStartAt(test.value, test.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The wall clock time is kept, not the elapsed hours
+			if !got.Equal(test.want) || got.Sub(test.now) != test.wait {
+				t.Errorf("got %v, %v after now; want %v, %v after", got, got.Sub(test.now), test.want, test.wait)
+			}
+		})
+	}
+}
+
+func TestParseScheduleQuery(t *testing.T) {
+	tests := []struct {
+		query      string
+		iterations int64
+		delayed    bool
+		err        bool
+	}{
+		{"", 0, false, false},
+		{"once=true", 1, false, false},
+		{"once=false&max_iterations=3", 3, false, false},
+		{"once=true&max_iterations=3", 0, false, true},
+		{"delay=1m", 0, true, false},
+		{"at=23:59:59", 0, true, false},
+		{"at=23:59&delay=1m", 0, false, true},
+		{"delay=-1m", 0, false, true},
+		{"delay=soon", 0, false, true},
+		{"at=soon", 0, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var opts StartOptions
+			if opts.Bounds, err = parseBoundsQuery(query); err == nil {
+				err = parseScheduleQuery(query, &opts)
+			}
+			if (err != nil) != test.err {
+				t.Fatalf("error %v, want error %v", err, test.err)
+			}
+			if test.err {
+				return
+			}
+			if opts.Bounds.MaxIterations != test.iterations || opts.StartAt.After(time.Now()) != test.delayed {
+				t.Errorf("max iterations %d and start at %v, want %d and delayed %v", opts.Bounds.MaxIterations, opts.StartAt, test.iterations, test.delayed)
+			}
+		})
+	}
+}
+
+func TestHandleResultWait(t *testing.T) {
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) {
+		time.Sleep(20 * time.Millisecond)
+		return 1, nil
+	})
+	finishing, err := s.StartRoutineWithOptions(&testConfig{}, StartOptions{Name: "finishing", Bounds: RunBounds{MaxIterations: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.StartRoutineWithOptions(&testConfig{}, StartOptions{Name: "later", StartAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, target string
+		status       int
+		state        RoutineState
+	}{
+		{"waits for the routine to finish", "/result?id=" + finishing + "&wait=5s", http.StatusOK, StateCompleted},
+		{"answers a pending routine when the wait runs out", "/result?id=later&wait=10ms", http.StatusAccepted, StateScheduled},
+		{"answers a pending routine at once without a wait", "/result?id=later", http.StatusAccepted, StateScheduled},
+		{"refuses an invalid wait", "/result?id=later&wait=soon", http.StatusBadRequest, ""},
+		{"refuses a negative wait", "/result?id=later&wait=-1s", http.StatusBadRequest, ""},
+		{"unknown routine", "/result?id=missing&wait=10ms", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			if test.state == "" {
+				return
+			}
+			var body struct {
+				State   RoutineState `json:"state"`
+				StartAt *time.Time   `json:"start_at"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.State != test.state {
+				t.Errorf("state %s, want %s", body.State, test.state)
+			}
+			if test.status == http.StatusAccepted && body.StartAt == nil {
+				t.Error("a scheduled routine is answered without its start time")
+			}
+		})
+	}
+}
@@ -0,0 +1,460 @@
+package routine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Labels are key/value pairs used to group routines and select them in bulk
+type Labels map[string]string
+
+// String formats labels as a sorted, comma separated key=value list
+func (l Labels) String() string {
+	pairs := make([]string, 0, len(l))
+	for key, value := range l {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// ParseLabels reads a comma separated key=value list such as "env=prod,tier=web"
+func ParseLabels(value string) (Labels, error) {
+	labels := Labels{}
+	for _, pair := range splitList(value) {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q must be key=value", pair)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return labels, ValidateLabels(labels)
+}
+
+// ValidateLabels checks label keys and values with the rules Kubernetes uses:
+// a key is an optional DNS subdomain prefix and "/" followed by a name of at
+// most 63 characters; values are at most 63 characters and may be empty.
+// Names and values use letters, digits, '-', '_' and '.', and begin and end
+// with a letter or digit.
+func ValidateLabels(labels Labels) error {
+	for key, value := range labels {
+		if err := validateLabelKey(key); err != nil {
+			return err
+		}
+		if value != "" && !isLabelName(value) {
+			return fmt.Errorf("label %s has invalid value %q", key, value)
+		}
+	}
+	return nil
+}
+
+func validateLabelKey(key string) error {
+	name := key
+	if prefix, rest, ok := strings.Cut(key, "/"); ok {
+		if len(prefix) == 0 || len(prefix) > 253 || !isDNSSubdomain(prefix) {
+			return fmt.Errorf("label key %q has an invalid prefix", key)
+		}
+		name = rest
+	}
+	if !isLabelName(name) {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+	return nil
+}
+
+func isLabelName(name string) bool {
+	if len(name) == 0 || len(name) > 63 {
+		return false
+	}
+	for i, r := range name {
+		alnum := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+		if !alnum && (i == 0 || i == len(name)-1 || !strings.ContainsRune("-_.", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDNSSubdomain(name string) bool {
+	for _, part := range strings.Split(name, ".") {
+		if len(part) == 0 || len(part) > 63 {
+			return false
+		}
+		for i, r := range part {
+			alnum := r >= 'a' && r <= 'z' || r >= '0' && r <= '9'
+			if !alnum && (i == 0 || i == len(part)-1 || r != '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// selectorOperator is how a requirement compares a label
+type selectorOperator string
+
+const (
+	opEquals       selectorOperator = "="
+	opNotEquals    selectorOperator = "!="
+	opIn           selectorOperator = "in"
+	opNotIn        selectorOperator = "notin"
+	opExists       selectorOperator = "exists"
+	opDoesNotExist selectorOperator = "!"
+)
+
+// Requirement is one comma separated term of a selector
+type Requirement struct {
+	Key      string
+	Operator selectorOperator
+	Values   []string
+}
+
+// Matches reports whether labels satisfy the requirement.
+// Like Kubernetes, != and notin also match routines without the label.
+func (req Requirement) Matches(labels Labels) bool {
+	value, ok := labels[req.Key]
+	switch req.Operator {
+	case opEquals, opIn:
+		return ok && slices.Contains(req.Values, value)
+	case opNotEquals, opNotIn:
+		return !ok || !slices.Contains(req.Values, value)
+	case opExists:
+		return ok
+	case opDoesNotExist:
+		return !ok
+	}
+	return false
+}
+
+// Selector is a parsed label selector; every requirement must match.
+// The empty selector matches every routine.
+type Selector []Requirement
+
+// Matches reports whether labels satisfy every requirement
+func (s Selector) Matches(labels Labels) bool {
+	for _, req := range s {
+		if !req.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSelector parses a Kubernetes-style label selector such as
+// "env=prod,tier!=batch,region in (eu, us),!canary,team".
+// Supported terms are key=value, key==value, key!=value, key in (...),
+// key notin (...), key (exists) and !key (does not exist).
+func ParseSelector(selector string) (Selector, error) {
+	p := &selectorParser{tokens: lexSelector(selector)}
+	var reqs Selector
+	for p.peek() != "" {
+		req, err := p.requirement()
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %v", selector, err)
+		}
+		reqs = append(reqs, req)
+		if next := p.next(); next != "" && next != "," {
+			return nil, fmt.Errorf("invalid selector %q: expected ',' but found %q", selector, next)
+		}
+	}
+	return reqs, nil
+}
+
+// lexSelector splits a selector into words and the punctuation ( ) , = == != !
+func lexSelector(input string) []string {
+	var tokens []string
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.HasPrefix(input[i:], "==") || strings.HasPrefix(input[i:], "!="):
+			tokens = append(tokens, input[i:i+2])
+			i += 2
+		case strings.ContainsRune("(),=!", rune(c)):
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			j := i
+			for j < len(input) && !strings.ContainsRune(" \t(),=!", rune(input[j])) {
+				j++
+			}
+			tokens = append(tokens, input[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+type selectorParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *selectorParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *selectorParser) next() string {
+	token := p.peek()
+	if token != "" {
+		p.pos++
+	}
+	return token
+}
+
+func (p *selectorParser) requirement() (Requirement, error) {
+	if p.peek() == "!" {
+		p.next()
+		key, err := p.key()
+		return Requirement{Key: key, Operator: opDoesNotExist}, err
+	}
+	key, err := p.key()
+	if err != nil {
+		return Requirement{}, err
+	}
+
+	switch op := p.peek(); op {
+	case "", ",":
+		return Requirement{Key: key, Operator: opExists}, nil
+	case "=", "==", "!=":
+		p.next()
+		value := p.peek()
+		if value == "," || value == "" {
+			// key= selects an empty value
+			value = ""
+		} else if strings.ContainsAny(value, "()=!") {
+			return Requirement{}, fmt.Errorf("expected a value after %s", op)
+		} else {
+			p.next()
+		}
+		operator := opEquals
+		if op == "!=" {
+			operator = opNotEquals
+		}
+		return Requirement{Key: key, Operator: operator, Values: []string{value}}, nil
+	case "in", "notin":
+		p.next()
+		values, err := p.valueSet()
+		operator := opIn
+		if op == "notin" {
+			operator = opNotIn
+		}
+		return Requirement{Key: key, Operator: operator, Values: values}, err
+	default:
+		return Requirement{}, fmt.Errorf("unexpected %q after key %s", op, key)
+	}
+}
+
+func (p *selectorParser) key() (string, error) {
+	key := p.next()
+	if key == "" || strings.ContainsAny(key, "(),=!") {
+		return "", fmt.Errorf("expected a label key but found %q", key)
+	}
+	return key, validateLabelKey(key)
+}
+
+// valueSet parses "(a, b, c)"
+func (p *selectorParser) valueSet() ([]string, error) {
+	if p.next() != "(" {
+		return nil, errors.New("expected '(' after in/notin")
+	}
+	var values []string
+	for {
+		token := p.next()
+		switch token {
+		case ")":
+			if len(values) == 0 {
+				return nil, errors.New("in/notin needs at least one value")
+			}
+			return values, nil
+		case ",":
+			continue
+		case "", "(", "=", "==", "!=", "!":
+			return nil, errors.New("unterminated value set")
+		default:
+			values = append(values, token)
+		}
+	}
+}
+
+// Labels returns a copy of the routine's labels
+func (ctrl *RoutineControl[TConfig, TOutput]) Labels() Labels {
+	labels, _ := ctrl.labels.Load().(Labels)
+	return copyLabels(labels)
+}
+
+// copyLabels copies labels so callers never share the stored map
+func copyLabels(labels Labels) Labels {
+	out := make(Labels, len(labels))
+	for key, value := range labels {
+		out[key] = value
+	}
+	return out
+}
+
+// relabel sets and removes labels in one step
+func (ctrl *RoutineControl[TConfig, TOutput]) relabel(set Labels, remove []string) Labels {
+	ctrl.labelsMu.Lock()
+	defer ctrl.labelsMu.Unlock()
+	labels := ctrl.Labels()
+	for _, key := range remove {
+		delete(labels, key)
+	}
+	for key, value := range set {
+		labels[key] = value
+	}
+	ctrl.labels.Store(labels)
+	return labels
+}
+
+// SelectRoutines returns the IDs of the routines whose labels match selector
+func (s *RoutineScheduler[TConfig, TOutput]) SelectRoutines(selector Selector) []string {
+	var ids []string
+	routineMap.Range(func(key, val any) bool {
+		if ctrl, ok := val.(*RoutineControl[TConfig, TOutput]); ok && selector.Matches(ctrl.Labels()) {
+			ids = append(ids, key.(string))
+		}
+		return true
+	})
+	sort.Strings(ids)
+	return ids
+}
+
+// LabelRoutines sets and removes labels on each routine
+func (s *RoutineScheduler[TConfig, TOutput]) LabelRoutines(ids []string, set Labels, remove []string) (int, error) {
+	if err := ValidateLabels(set); err != nil {
+		return 0, err
+	}
+	var err error
+	labeled := 0
+	for _, id := range ids {
+		ctrl, errLoad := s.loadControl(id)
+		if errLoad != nil {
+			err = errors.Join(err, errLoad)
+			continue
+		}
+		labels := ctrl.relabel(set, remove)
+		ctrl.history.event("", "labels-changed", labels.String())
+		labeled++
+	}
+	return labeled, err
+}
+
+// errEmptySelector rejects bulk writes whose selector would match every routine
+var errEmptySelector = errors.New("selector must not be empty; list the routine IDs to act on every routine")
+
+// emptySelector reports whether a request gives a selector parameter without any requirement
+func emptySelector(query url.Values) bool {
+	return query.Has("selector") && strings.TrimSpace(query.Get("selector")) == ""
+}
+
+// selectTargets resolves the routines a bulk request acts on. A "selector"
+// query parameter picks every matching routine the caller holds perm for;
+// otherwise the explicitly listed IDs are used and checked against perm.
+// Unlike reads, writes refuse an empty selector rather than treating it as "all".
+func (s *RoutineScheduler[TConfig, TOutput]) selectTargets(r *http.Request, perm Permission, ids []string) ([]string, error) {
+	query := r.URL.Query()
+	if !query.Has("selector") {
+		return ids, s.checkTargets(r, perm, ids)
+	}
+	if len(ids) > 0 {
+		return nil, errors.New("give either routine IDs or a selector, not both")
+	}
+	if emptySelector(query) {
+		return nil, errEmptySelector
+	}
+	selector, err := ParseSelector(query.Get("selector"))
+	if err != nil {
+		return nil, err
+	}
+	selected := []string{}
+	for _, id := range s.SelectRoutines(selector) {
+		if ctrl, err := s.loadControl(id); err == nil && s.can(r, perm, ctrl.Tags) {
+			selected = append(selected, id)
+		}
+	}
+	return selected, nil
+}
+
+// decodeTargets reads a JSON array of IDs from the body, which may be empty when a selector is given,
+// and resolves the routines to act on
+func (s *RoutineScheduler[TConfig, TOutput]) decodeTargets(r *http.Request, perm Permission) ([]string, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request format: %v", err)
+	}
+	var ids []string
+	if len(strings.TrimSpace(string(body))) > 0 || !r.URL.Query().Has("selector") {
+		if err := json.Unmarshal(body, &ids); err != nil {
+			return nil, fmt.Errorf("invalid request format: %v", err)
+		}
+	}
+	return s.selectTargets(r, perm, ids)
+}
+
+// handleLabels sets and removes labels on routines chosen by ID or selector
+func (s *RoutineScheduler[TConfig, TOutput]) handleLabels(w http.ResponseWriter, r *http.Request) {
+	type LabelsPayload struct {
+		IDs    []string `json:"ids"`
+		Set    Labels   `json:"set"`
+		Remove []string `json:"remove"`
+	}
+
+	var payload LabelsPayload
+	result := NewHandleResult(0, "Failed to label all requested routines")
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		result.SetError(fmt.Errorf("invalid request format: %v", err)).Response(w)
+		return
+	}
+	if err := ValidateLabels(payload.Set); err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+	ids, err := s.selectTargets(r, PermUpdateConfig, payload.IDs)
+	if err != nil {
+		targetError(w, result, err)
+		return
+	}
+
+	audit := auditFrom(r)
+	audit.IDs = ids
+	audit.OldConfig = s.snapshotLabels(ids)
+
+	labeled, err := s.LabelRoutines(ids, payload.Set, payload.Remove)
+	audit.NewConfig = s.snapshotLabels(ids)
+
+	result.SetError(err)
+	result.Set(labeled, len(ids)).Response(w)
+}
+
+// snapshotLabels captures the labels of routines for the audit log
+func (s *RoutineScheduler[TConfig, TOutput]) snapshotLabels(ids []string) map[string]string {
+	snapshot := make(map[string]string, len(ids))
+	for _, id := range ids {
+		if ctrl, err := s.loadControl(id); err == nil {
+			snapshot[id] = ctrl.Labels().String()
+		}
+	}
+	return snapshot
+}
+
+// targetError answers a failed target resolution: 403 when permission is missing, 400 otherwise
+func targetError(w http.ResponseWriter, result *HandleResult, err error) {
+	var permErr *PermissionError
+	if errors.As(err, &permErr) {
+		denied(w, err)
+		return
+	}
+	result.SetError(err).Response(w)
+}
@@ -0,0 +1,130 @@
+package routine
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     Selector
+	}{
+		{"", nil},
+		{"env=prod", Selector{{Key: "env", Operator: opEquals, Values: []string{"prod"}}}},
+		{"env==prod", Selector{{Key: "env", Operator: opEquals, Values: []string{"prod"}}}},
+		{"env != prod", Selector{{Key: "env", Operator: opNotEquals, Values: []string{"prod"}}}},
+		{"env=", Selector{{Key: "env", Operator: opEquals, Values: []string{""}}}},
+		{"region in (eu, us)", Selector{{Key: "region", Operator: opIn, Values: []string{"eu", "us"}}}},
+		{"region notin (eu)", Selector{{Key: "region", Operator: opNotIn, Values: []string{"eu"}}}},
+		{"team", Selector{{Key: "team", Operator: opExists}}},
+		{"!canary", Selector{{Key: "canary", Operator: opDoesNotExist}}},
+		{"example.com/owner=ops", Selector{{Key: "example.com/owner", Operator: opEquals, Values: []string{"ops"}}}},
+		{"env=prod,tier!=batch,region in (eu, us),!canary,team", Selector{
+			{Key: "env", Operator: opEquals, Values: []string{"prod"}},
+			{Key: "tier", Operator: opNotEquals, Values: []string{"batch"}},
+			{Key: "region", Operator: opIn, Values: []string{"eu", "us"}},
+			{Key: "canary", Operator: opDoesNotExist},
+			{Key: "team", Operator: opExists},
+		}},
+		{"env=,team", Selector{
+			{Key: "env", Operator: opEquals, Values: []string{""}},
+			{Key: "team", Operator: opExists},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			got, err := ParseSelector(test.selector)
+			if err != nil {
+				t.Fatalf("ParseSelector: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	tests := []string{
+		"=prod",
+		"env=prod tier=web",
+		"env=(prod)",
+		"env in eu",
+		"env in ()",
+		"env in (eu",
+		"env notin (eu, =)",
+		"env < 3",
+		"!",
+		"-env=prod",
+		"env=prod,,tier=web",
+	}
+	for _, selector := range tests {
+		t.Run(selector, func(t *testing.T) {
+			if _, err := ParseSelector(selector); err == nil {
+				t.Errorf("ParseSelector(%q) succeeded, want an error", selector)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := Labels{"env": "prod", "region": "eu", "team": ""}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"env=prod", true},
+		{"env=dev", false},
+		{"env!=dev", true},
+		{"tier!=batch", true}, // != matches routines without the label
+		{"region in (eu, us)", true},
+		{"region notin (eu, us)", false},
+		{"tier notin (batch)", true},
+		{"tier in (batch)", false},
+		{"team", true},
+		{"team=", true},
+		{"tier", false},
+		{"!tier", true},
+		{"!env", false},
+		{"env=prod,region=us", false},
+		{"env=prod,region=eu,!canary", true},
+	}
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			selector, err := ParseSelector(test.selector)
+			if err != nil {
+				t.Fatalf("ParseSelector: %v", err)
+			}
+			if got := selector.Matches(labels); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEmptySelector(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", false},
+		{"selector=env%3Dprod", false},
+		{"selector=", true},
+		{"selector=%20%20", true},
+		{"other=1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := emptySelector(query); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package routine
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultElectionInterval is how often replicas try to take or renew leadership
+const DefaultElectionInterval = 2 * time.Second
+
+// ErrNotLeader is returned when a follower is asked to start a routine
+var ErrNotLeader = errors.New("this replica is not the leader")
+
+// forwardedHeader marks a request a follower forwarded, so it is never forwarded twice
+const forwardedHeader = "X-Routine-Forwarded-By"
+
+// LeaderInfo identifies a replica
+type LeaderInfo struct {
+	ID string `json:"id"`
+	// URL is the base URL other replicas forward requests to
+	URL string `json:"url,omitempty"`
+}
+
+// LeaderElector is a leader election backend. Every replica calls TryAcquire
+// each election interval; the backend lets at most one of them lead at a time.
+type LeaderElector interface {
+	// TryAcquire takes or renews leadership for self and reports whether self leads
+	TryAcquire(ctx context.Context, self LeaderInfo) (bool, error)
+	// Leader returns the current leader; ok is false while there is none
+	Leader(ctx context.Context) (leader LeaderInfo, ok bool, err error)
+	// Release gives leadership up if this replica holds it
+	Release(ctx context.Context) error
+}
+
+// Election makes replicas of a scheduler share one set of routines: only the
+// leader runs routines. Followers forward writes to the leader and proxy reads
+// to it, answering reads themselves while no leader can be reached.
+type Election struct {
+	Elector LeaderElector
+	// ID names this replica; empty means hostname-pid
+	ID string
+	// URL is the base URL followers forward to, e.g. "http://10.0.0.5:8080"
+	URL string
+	// Interval between attempts to take or renew leadership; 0 means DefaultElectionInterval
+	Interval time.Duration
+	// Transport carries forwarded requests; nil means http.DefaultTransport
+	Transport http.RoundTripper
+
+	leading atomic.Bool
+	mu      sync.Mutex
+	since   time.Time // When leadership was last won or lost
+	lastErr string
+}
+
+// LeaderStatus is this replica's view of the election
+type LeaderStatus struct {
+	Self    *LeaderInfo `json:"self,omitempty"`
+	Leading bool        `json:"leading"`
+	Since   *time.Time  `json:"since,omitempty"`
+	Leader  *LeaderInfo `json:"leader,omitempty"`
+	// Election is false when the scheduler runs without leader election and always leads
+	Election  bool   `json:"election"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (e *Election) self() LeaderInfo {
+	return LeaderInfo{ID: e.ID, URL: e.URL}
+}
+
+func (e *Election) interval() time.Duration {
+	if e.Interval <= 0 {
+		return DefaultElectionInterval
+	}
+	return e.Interval
+}
+
+// Leading reports whether this replica may run routines. It always does without an election.
+func (s *RoutineScheduler[TConfig, TOutput]) Leading() bool {
+	return s.Election == nil || s.Election.leading.Load()
+}
+
+// startElection runs a first round, so the replica knows its role before it
+// serves requests, and keeps campaigning in the background until the returned
+// function is called. That function resigns: it stops the campaign and the
+// routines, then releases leadership so another replica can take over at once.
+func (s *RoutineScheduler[TConfig, TOutput]) startElection() (resign func(ctx context.Context)) {
+	e := s.Election
+	if e == nil {
+		return func(context.Context) {}
+	}
+	if e.ID == "" {
+		host, _ := os.Hostname()
+		e.ID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	s.elect()
+	quit := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(e.interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.elect()
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func(ctx context.Context) {
+		close(quit)
+		<-stopped
+		s.resign(ctx)
+	}
+}
+
+// resign steps down for good. The routines are stopped first and given until
+// ctx ends to finish, so the next leader never runs them alongside this one.
+func (s *RoutineScheduler[TConfig, TOutput]) resign(ctx context.Context) {
+	e := s.Election
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leading.Load() {
+		log.Printf("replica %s is resigning, stopping its routines", e.ID)
+		var done []chan struct{}
+		for _, id := range s.SelectRoutines(nil) {
+			if ctrl, err := s.loadControl(id); err == nil {
+				ctrl.Cancel()
+				done = append(done, ctrl.Done)
+			}
+		}
+		for _, ch := range done {
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				log.Printf("replica %s resigns with routines still stopping", e.ID)
+				return
+			}
+		}
+		e.leading.Store(false)
+		e.since = time.Now()
+	}
+	if err := e.Elector.Release(ctx); err != nil {
+		log.Printf("could not release leadership: %v", err)
+	}
+}
+
+// elect runs one election round. A replica that cannot confirm its leadership
+// steps down and stops its routines, so two replicas never run them together.
+func (s *RoutineScheduler[TConfig, TOutput]) elect() {
+	e := s.Election
+	ctx, cancel := context.WithTimeout(context.Background(), e.interval())
+	defer cancel()
+	leading, err := e.Elector.TryAcquire(ctx, e.self())
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		if e.lastErr != err.Error() {
+			log.Printf("leader election: %v", err)
+		}
+		e.lastErr = err.Error()
+		leading = false
+	} else {
+		e.lastErr = ""
+	}
+	if leading == e.leading.Load() {
+		return
+	}
+	e.leading.Store(leading)
+	e.since = time.Now()
+	if leading {
+		log.Printf("replica %s is now the leader", e.ID)
+		return
+	}
+	log.Printf("replica %s lost leadership, stopping its routines", e.ID)
+	if _, err := s.StopRoutines(s.SelectRoutines(nil)); err != nil {
+		log.Printf("could not stop routines after losing leadership: %v", err)
+	}
+}
+
+// LeaderStatus returns this replica's role and the current leader
+func (s *RoutineScheduler[TConfig, TOutput]) LeaderStatus(ctx context.Context) LeaderStatus {
+	e := s.Election
+	if e == nil {
+		return LeaderStatus{Leading: true}
+	}
+	e.mu.Lock()
+	self := e.self()
+	status := LeaderStatus{Self: &self, Leading: e.leading.Load(), Election: true, LastError: e.lastErr}
+	if !e.since.IsZero() {
+		since := e.since
+		status.Since = &since
+	}
+	e.mu.Unlock()
+	if leader, ok, err := e.Elector.Leader(ctx); err != nil {
+		status.LastError = err.Error()
+	} else if ok {
+		status.Leader = &leader
+	}
+	return status
+}
+
+// forwarding sends a follower's requests to the leader. Writes that cannot
+// reach a leader are refused; reads are then answered from local state.
+// Client certificates end at this replica's TLS listener, so writes by
+// certificate-authenticated callers are refused with the leader's URL instead
+// of being forwarded without the certificate.
+func (s *RoutineScheduler[TConfig, TOutput]) forwarding(next http.Handler) http.Handler {
+	if s.Election == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+		if s.Leading() || r.URL.Path == "/leader" || read && r.Header.Get(forwardedHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		refuse := func(err error) {
+			if read {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Retry-After", "2")
+			NewHandleResult(0, "").SetError(err).Status(http.StatusServiceUnavailable).Response(w)
+		}
+		// The leader could not see a forwarded certificate, so reads stay local as well
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && read {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// A forwarded write reaching a follower means leadership just moved; let the caller retry
+		if r.Header.Get(forwardedHeader) != "" {
+			refuse(ErrNotLeader)
+			return
+		}
+
+		e := s.Election
+		leader, ok, err := e.Elector.Leader(r.Context())
+		switch {
+		case err != nil:
+			refuse(fmt.Errorf("%w: %v", ErrNotLeader, err))
+			return
+		case !ok || leader.ID == e.ID:
+			refuse(fmt.Errorf("%w and no leader is elected", ErrNotLeader))
+			return
+		case leader.URL == "":
+			refuse(fmt.Errorf("%w and leader %s advertises no URL", ErrNotLeader, leader.ID))
+			return
+		}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			err := fmt.Errorf("%w and client certificates cannot be forwarded; send the request to leader %s at %s", ErrNotLeader, leader.ID, leader.URL)
+			NewHandleResult(0, "").SetError(err).Status(http.StatusMisdirectedRequest).Response(w)
+			return
+		}
+		target, err := url.Parse(leader.URL)
+		if err != nil {
+			refuse(fmt.Errorf("%w and leader %s advertises an invalid URL: %v", ErrNotLeader, leader.ID, err))
+			return
+		}
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(target)
+				pr.SetXForwarded()
+				pr.Out.Header.Set(forwardedHeader, e.ID)
+			},
+			Transport: e.Transport,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("could not forward %s %s to leader %s: %v", r.Method, r.URL.Path, leader.ID, err)
+				refuse(fmt.Errorf("%w and leader %s is unreachable", ErrNotLeader, leader.ID))
+			},
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// DevCertTransport carries forwarded requests between replicas that serve
+// development certificates. Each replica generates its own, so none can verify
+// another's; verification is skipped for loopback leaders only, and leaders on
+// any other host must present a certificate the system trusts.
+func DevCertTransport() http.RoundTripper {
+	verified := http.DefaultTransport.(*http.Transport).Clone()
+	loopback := verified.Clone()
+	loopback.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &devCertTransport{verified: verified, loopback: loopback}
+}
+
+type devCertTransport struct {
+	verified, loopback *http.Transport
+}
+
+func (t *devCertTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if IsLoopbackHost(r.URL.Hostname()) {
+		return t.loopback.RoundTrip(r)
+	}
+	return t.verified.RoundTrip(r)
+}
+
+// IsLoopbackHost reports whether host names this machine's loopback interface
+func IsLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// handleLeader shows this replica's role; it is never forwarded
+func (s *RoutineScheduler[TConfig, TOutput]) handleLeader(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.LeaderStatus(r.Context()))
+}
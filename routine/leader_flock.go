@@ -0,0 +1,109 @@
+//go:build unix && !aix && !solaris
+
+package routine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// FileLockElector elects the replica holding an exclusive flock on a file,
+// which suits replicas on a single machine. The leader writes its LeaderInfo
+// into the file for followers to read. The lock is released when the leader
+// exits, even when it crashes.
+type FileLockElector struct {
+	// Path is the lock file; every replica must use the same one
+	Path string
+
+	mu   sync.Mutex
+	file *os.File // Open and locked while this replica leads
+}
+
+// TryAcquire implements LeaderElector
+func (e *FileLockElector) TryAcquire(ctx context.Context, self LeaderInfo) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.file != nil {
+		// A lock file removed or replaced behind our back no longer excludes anyone
+		if held, err := os.Stat(e.Path); err == nil && sameFile(e.file, held) {
+			return true, nil
+		}
+		e.file.Close()
+		e.file = nil
+	}
+
+	file, err := os.OpenFile(e.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, fmt.Errorf("could not lock %s: %v", e.Path, err)
+	}
+	data, _ := json.Marshal(self)
+	if err := file.Truncate(0); err == nil {
+		_, err = file.WriteAt(data, 0)
+	}
+	if err != nil {
+		file.Close()
+		return false, fmt.Errorf("could not write %s: %v", e.Path, err)
+	}
+	e.file = file
+	return true, nil
+}
+
+// Leader implements LeaderElector
+func (e *FileLockElector) Leader(ctx context.Context) (LeaderInfo, bool, error) {
+	var leader LeaderInfo
+	file, err := os.Open(e.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return leader, false, nil
+	} else if err != nil {
+		return leader, false, err
+	}
+	defer file.Close()
+
+	// Taking a shared lock succeeds only when nobody holds the exclusive one,
+	// in which case the file names a leader that is gone
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return leader, false, nil
+	} else if !errors.Is(err, syscall.EWOULDBLOCK) {
+		return leader, false, err
+	}
+	data, err := os.ReadFile(e.Path)
+	if err != nil {
+		return leader, false, err
+	}
+	// A new leader may not have written itself yet
+	if json.Unmarshal(data, &leader) != nil || leader.ID == "" {
+		return leader, false, nil
+	}
+	return leader, true, nil
+}
+
+// Release implements LeaderElector
+func (e *FileLockElector) Release(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.file == nil {
+		return nil
+	}
+	e.file.Truncate(0)
+	err := e.file.Close()
+	e.file = nil
+	return err
+}
+
+func sameFile(file *os.File, info os.FileInfo) bool {
+	open, err := file.Stat()
+	return err == nil && os.SameFile(open, info)
+}
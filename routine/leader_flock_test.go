@@ -0,0 +1,66 @@
+//go:build unix && !aix && !solaris
+
+package routine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileLockElector(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	a, b := &FileLockElector{Path: path}, &FileLockElector{Path: path}
+	self := LeaderInfo{ID: "a", URL: "http://a"}
+
+	if leading, err := a.TryAcquire(ctx, self); err != nil || !leading {
+		t.Fatalf("a could not take the free lock: (%v, %v)", leading, err)
+	}
+	if leading, err := a.TryAcquire(ctx, self); err != nil || !leading {
+		t.Fatalf("a could not renew its lock: (%v, %v)", leading, err)
+	}
+	if leading, err := b.TryAcquire(ctx, LeaderInfo{ID: "b"}); err != nil || leading {
+		t.Fatalf("b took the held lock: (%v, %v)", leading, err)
+	}
+	if leader, ok, err := b.Leader(ctx); err != nil || !ok || leader != self {
+		t.Fatalf("b sees leader (%+v, %v, %v), want %+v", leader, ok, err, self)
+	}
+
+	if err := a.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := b.Leader(ctx); err != nil || ok {
+		t.Fatalf("a released the lock but is still seen as leader: (%v, %v)", ok, err)
+	}
+	if leading, err := b.TryAcquire(ctx, LeaderInfo{ID: "b"}); err != nil || !leading {
+		t.Fatalf("b could not take the released lock: (%v, %v)", leading, err)
+	}
+}
+
+func TestFileLockElectorLockFileReplaced(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	a, b := &FileLockElector{Path: path}, &FileLockElector{Path: path}
+	if leading, _ := a.TryAcquire(ctx, LeaderInfo{ID: "a"}); !leading {
+		t.Fatal("a could not take the free lock")
+	}
+	defer a.Release(ctx)
+
+	// Someone deletes the lock file; a new one excludes nobody, so b takes it
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if leading, err := b.TryAcquire(ctx, LeaderInfo{ID: "b"}); err != nil || !leading {
+		t.Fatalf("b could not take the new lock file: (%v, %v)", leading, err)
+	}
+	defer b.Release(ctx)
+	// a notices its lock no longer guards the path and steps down
+	if leading, err := a.TryAcquire(ctx, LeaderInfo{ID: "a"}); err != nil || leading {
+		t.Fatalf("a still leads after its lock file was replaced: (%v, %v)", leading, err)
+	}
+	if leader, ok, _ := a.Leader(ctx); !ok || leader.ID != "b" {
+		t.Errorf("a sees leader (%+v, %v), want b", leader, ok)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !unix || aix || solaris
+
+package routine
+
+import (
+	"context"
+	"errors"
+)
+
+// FileLockElector elects the replica holding an exclusive flock on a file.
+// flock is not available on this platform, so every call fails.
+type FileLockElector struct {
+	Path string
+}
+
+var errNoFileLock = errors.New("file lock election is not supported on this platform")
+
+// TryAcquire implements LeaderElector
+func (e *FileLockElector) TryAcquire(ctx context.Context, self LeaderInfo) (bool, error) {
+	return false, errNoFileLock
+}
+
+// Leader implements LeaderElector
+func (e *FileLockElector) Leader(ctx context.Context) (LeaderInfo, bool, error) {
+	return LeaderInfo{}, false, errNoFileLock
+}
+
+// Release implements LeaderElector
+func (e *FileLockElector) Release(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,188 @@
+package routine
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeElector hands out leadership as the test says
+type fakeElector struct {
+	mu       sync.Mutex
+	leading  bool
+	err      error
+	leader   *LeaderInfo
+	released bool
+}
+
+func (e *fakeElector) set(leading bool, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leading, e.err = leading, err
+}
+
+func (e *fakeElector) TryAcquire(ctx context.Context, self LeaderInfo) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading, e.err
+}
+
+func (e *fakeElector) Leader(ctx context.Context) (LeaderInfo, bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leader == nil {
+		return LeaderInfo{}, false, e.err
+	}
+	return *e.leader, true, e.err
+}
+
+func (e *fakeElector) Release(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.released = true
+	return nil
+}
+
+func TestElectStepsDown(t *testing.T) {
+	tests := []struct {
+		name    string
+		leading bool
+		err     error
+	}{
+		{"leadership lost", false, nil},
+		{"leadership cannot be confirmed", true, errors.New("lock unreachable")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			elector := &fakeElector{leading: true}
+			s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+			s.Election = &Election{Elector: elector, ID: "a"}
+			s.elect()
+			if !s.Leading() {
+				t.Fatal("the replica did not take leadership")
+			}
+			id, err := s.StartRoutineWithConfig(&testConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctrl, err := s.loadControl(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			elector.set(test.leading, test.err)
+			s.elect()
+			if s.Leading() {
+				t.Error("the replica still leads")
+			}
+			waitDone(t, ctrl)
+			if _, err := s.StartRoutineWithConfig(&testConfig{}); !errors.Is(err, ErrNotLeader) {
+				t.Errorf("a follower started a routine: %v", err)
+			}
+			if status := s.LeaderStatus(context.Background()); (status.LastError != "") != (test.err != nil) {
+				t.Errorf("last error %q, want one only when the election failed", status.LastError)
+			}
+		})
+	}
+}
+
+func TestResign(t *testing.T) {
+	elector := &fakeElector{leading: true}
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	s.Election = &Election{Elector: elector, ID: "a"}
+	resign := s.startElection()
+	id, err := s.StartRoutineWithConfig(&testConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, err := s.loadControl(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resign(context.Background())
+	// Routines end before leadership is released
+	select {
+	case <-ctrl.Done:
+	default:
+		t.Error("leadership was released with a routine still running")
+	}
+	if !elector.released || s.Leading() {
+		t.Errorf("released %v, leading %v after resigning", elector.released, s.Leading())
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	verified := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+	tests := []struct {
+		name      string
+		leading   bool
+		leader    bool // A leader is elected and reachable
+		method    string
+		forwarded bool
+		tls       *tls.ConnectionState
+		status    int
+		served    string // "local", "leader" or "" when refused
+	}{
+		{"the leader serves itself", true, true, http.MethodPost, false, nil, http.StatusOK, "local"},
+		{"a write goes to the leader", false, true, http.MethodPost, false, nil, http.StatusOK, "leader"},
+		{"a read goes to the leader", false, true, http.MethodGet, false, nil, http.StatusOK, "leader"},
+		{"a read without a leader is answered locally", false, false, http.MethodGet, false, nil, http.StatusOK, "local"},
+		{"a write without a leader is refused", false, false, http.MethodPost, false, nil, http.StatusServiceUnavailable, ""},
+		{"a forwarded read is answered locally", false, true, http.MethodGet, true, nil, http.StatusOK, "local"},
+		{"a write forwarded twice is refused", false, true, http.MethodPost, true, nil, http.StatusServiceUnavailable, ""},
+		{"a certificate caller's read is answered locally", false, true, http.MethodGet, false, verified, http.StatusOK, "local"},
+		{"a certificate caller's write is misdirected", false, true, http.MethodPost, false, verified, http.StatusMisdirectedRequest, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var forwardedBy string
+			leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwardedBy = r.Header.Get(forwardedHeader)
+				w.Write([]byte("leader"))
+			}))
+			defer leader.Close()
+
+			elector := &fakeElector{}
+			if test.leader {
+				elector.leader = &LeaderInfo{ID: "b", URL: leader.URL}
+			}
+			s := &RoutineScheduler[int, int]{Election: &Election{Elector: elector, ID: "a"}}
+			s.Election.leading.Store(test.leading)
+			handler := s.forwarding(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("local"))
+			}))
+
+			r := httptest.NewRequest(test.method, "/status", nil)
+			if test.forwarded {
+				r.Header.Set(forwardedHeader, "c")
+			}
+			r.TLS = test.tls
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			body := w.Body.String()
+			if test.served == "" {
+				if body == "local" || body == "leader" {
+					t.Errorf("served by %s, want it refused", body)
+				}
+			} else if body != test.served {
+				t.Errorf("served by %q, want %s", body, test.served)
+			}
+			if test.served == "leader" && forwardedBy != "a" {
+				t.Errorf("the leader saw the request forwarded by %q, want a", forwardedBy)
+			}
+			if test.status == http.StatusMisdirectedRequest && !strings.Contains(body, leader.URL) {
+				t.Errorf("the refusal does not name the leader's URL: %s", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,468 @@
+package routine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ConfigPatch transforms the JSON form of a routine's current config into the new one
+type ConfigPatch func(current []byte) ([]byte, error)
+
+// MergePatch returns a ConfigPatch applying an RFC 7396 JSON Merge Patch
+func MergePatch(patch json.RawMessage) ConfigPatch {
+	return func(current []byte) ([]byte, error) {
+		doc, err := decodeJSON(current)
+		if err != nil {
+			return nil, err
+		}
+		p, err := decodeJSON(patch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid merge patch: %v", err)
+		}
+		return json.Marshal(mergePatch(doc, p))
+	}
+}
+
+// mergePatch implements the MergePatch algorithm of RFC 7396 section 2
+func mergePatch(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// JSONPatchOperation is one operation of an RFC 6902 JSON Patch
+type JSONPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch returns a ConfigPatch applying an RFC 6902 JSON Patch.
+// Operations apply in order and the whole patch fails if any operation fails.
+func JSONPatch(ops []JSONPatchOperation) ConfigPatch {
+	return func(current []byte) ([]byte, error) {
+		doc, err := decodeJSON(current)
+		if err != nil {
+			return nil, err
+		}
+		for i, op := range ops {
+			if doc, err = applyPatchOperation(doc, op); err != nil {
+				return nil, fmt.Errorf("json patch operation %d (%s %s): %v", i, op.Op, op.Path, err)
+			}
+		}
+		return json.Marshal(doc)
+	}
+}
+
+func applyPatchOperation(doc any, op JSONPatchOperation) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("missing value")
+		}
+		value, err := decodeJSON(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add":
+			return pointerAdd(doc, path, value)
+		case "replace":
+			if _, err := pointerGet(doc, path); err != nil {
+				return nil, err
+			}
+			// The empty pointer replaces the whole document
+			if len(path) == 0 {
+				return value, nil
+			}
+			if doc, err = pointerRemove(doc, path); err != nil {
+				return nil, err
+			}
+			return pointerAdd(doc, path, value)
+		default:
+			current, err := pointerGet(doc, path)
+			if err != nil {
+				return nil, err
+			}
+			if !jsonEqual(current, value) {
+				return nil, fmt.Errorf("test failed")
+			}
+			return doc, nil
+		}
+	case "remove":
+		return pointerRemove(doc, path)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, fmt.Errorf("cannot move a value into itself")
+			}
+			if doc, err = pointerRemove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			// Copy must not alias the source
+			value = deepCopy(value)
+		}
+		return pointerAdd(doc, path, value)
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array reference token; "-" means one past the end when allowed
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	limit := length - 1
+	if allowEnd {
+		limit = length
+	}
+	if index > limit {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+func pointerGet(doc any, path []string) (any, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found at %q", token)
+			}
+			doc = value
+		case []any:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("path not found at %q", token)
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd returns doc with value added at path. Parents must exist.
+func pointerAdd(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]any:
+		node[last] = value
+		return doc, nil
+	case []any:
+		index, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		grown := append(node[:index:index], append([]any{value}, node[index:]...)...)
+		return replaceAt(doc, path[:len(path)-1], grown)
+	}
+	return nil, fmt.Errorf("cannot add to a non-container at %q", last)
+}
+
+func pointerRemove(doc any, path []string) (any, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]any:
+		if _, ok := node[last]; !ok {
+			return nil, fmt.Errorf("path not found at %q", last)
+		}
+		delete(node, last)
+		return doc, nil
+	case []any:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		shrunk := append(node[:index:index], node[index+1:]...)
+		return replaceAt(doc, path[:len(path)-1], shrunk)
+	}
+	return nil, fmt.Errorf("path not found at %q", last)
+}
+
+// replaceAt swaps the value at path, needed because slices change identity when resized
+func replaceAt(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]any:
+		node[last] = value
+	case []any:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = value
+	}
+	return doc, nil
+}
+
+// jsonEqual compares decoded JSON values as RFC 6902 test does: numbers by
+// value, so 1 equals 1.0, objects regardless of key order, arrays in order
+func jsonEqual(a, b any) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, okX := new(big.Float).SetString(x.String())
+		fy, okY := new(big.Float).SetString(y.String())
+		return okX && okY && fx.Cmp(fy) == 0
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			other, ok := y[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func deepCopy(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, child := range v {
+			out[key] = deepCopy(child)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, child := range v {
+			out[i] = deepCopy(child)
+		}
+		return out
+	}
+	return value
+}
+
+// decodeJSON decodes keeping numbers exact so large integers survive a round trip
+func decodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// PatchRoutineConfig applies patch to the current config of each routine.
+// Every patched config is deserialized and validated before any is stored, so
+// one invalid result leaves all routines unchanged and is reported as field errors.
+func (s *RoutineScheduler[TConfig, TOutput]) PatchRoutineConfig(ids []string, patch ConfigPatch) (int, []FieldError, error) {
+	return s.patchRoutineConfig(SystemActor, nil, ids, patch)
+}
+
+// maxPatchAttempts bounds how often a patch without an expected revision is
+// reapplied when the config changes between reading and storing it
+const maxPatchAttempts = 3
+
+func (s *RoutineScheduler[TConfig, TOutput]) patchRoutineConfig(actor string, expected Revisions, ids []string, patch ConfigPatch) (int, []FieldError, error) {
+	type pending struct {
+		id       string
+		ctrl     *RoutineControl[TConfig, TOutput]
+		config   TConfig
+		revision int64 // The revision the patch was applied to
+	}
+	var err error
+	var fieldErrors []FieldError
+	updates := make([]pending, 0, len(ids))
+
+	for _, id := range ids {
+		val, ok := routineMap.Load(id)
+		if !ok {
+			err = errors.Join(err, fmt.Errorf("routine %s not found", id))
+			continue
+		}
+		ctrl, ok := val.(*RoutineControl[TConfig, TOutput])
+		if !ok {
+			err = errors.Join(err, fmt.Errorf("could not convert routine %s to expected type", id))
+			continue
+		}
+
+		config, revision, invalid, errPatch := s.preparePatch(id, ctrl, patch)
+		if errPatch != nil {
+			err = errors.Join(err, errPatch)
+			continue
+		}
+		if want := expected[id]; want != 0 && want != revision {
+			err = errors.Join(err, &ConflictError{ID: id, Expected: want, Actual: revision})
+			continue
+		}
+		fieldErrors = append(fieldErrors, invalid...)
+		updates = append(updates, pending{id: id, ctrl: ctrl, config: config, revision: revision})
+	}
+
+	if len(fieldErrors) > 0 {
+		return 0, fieldErrors, err
+	}
+	patched := 0
+	for _, update := range updates {
+		// Storing is pinned to the revision that was patched, so a concurrent change is never overwritten.
+		// A caller who gave no revision gets the patch reapplied to the newer config instead of a conflict.
+		errStore := update.ctrl.storeConfigIf(update.config, update.revision, actor, "patch-config")
+		for attempt := 1; errStore != nil && expected[update.id] == 0 && attempt < maxPatchAttempts; attempt++ {
+			config, revision, invalid, errPatch := s.preparePatch(update.id, update.ctrl, patch)
+			if errPatch == nil && len(invalid) > 0 {
+				errPatch = fmt.Errorf("routine %s: patched config is invalid after a concurrent change: %v", update.id, invalid[0])
+			}
+			if errPatch != nil {
+				errStore = errPatch
+				break
+			}
+			update.config, update.revision = config, revision
+			errStore = update.ctrl.storeConfigIf(update.config, update.revision, actor, "patch-config")
+		}
+		if errStore != nil {
+			var conflict *ConflictError
+			if errors.As(errStore, &conflict) {
+				conflict.ID = update.id
+			}
+			err = errors.Join(err, errStore)
+			continue
+		}
+		update.ctrl.history.event("", "config-patched", s.Routine.SerializeConfig(update.config))
+		patched++
+	}
+	return patched, nil, err
+}
+
+// preparePatch applies patch to a snapshot of the routine's config and returns
+// the patched config with the revision it was based on and any field errors
+func (s *RoutineScheduler[TConfig, TOutput]) preparePatch(id string, ctrl *RoutineControl[TConfig, TOutput], patch ConfigPatch) (TConfig, int64, []FieldError, error) {
+	var zero TConfig
+	snapshot, revision := ctrl.configAt()
+	current, err := json.Marshal(snapshot)
+	if err != nil {
+		return zero, 0, nil, fmt.Errorf("routine %s: could not encode current config: %v", id, err)
+	}
+	patched, err := patch(current)
+	if err == nil {
+		err = checkPatchedConfig(current, patched)
+	}
+	if err != nil {
+		return zero, 0, nil, fmt.Errorf("routine %s: %v", id, err)
+	}
+	config, err := s.Routine.DeserializeConfig(string(patched))
+	if err != nil {
+		return zero, 0, nil, fmt.Errorf("routine %s: could not deserialize patched config: %v", id, err)
+	}
+	var fieldErrors []FieldError
+	for _, fieldError := range s.validateConfig(config) {
+		fieldError.ID = id
+		fieldErrors = append(fieldErrors, fieldError)
+	}
+	return config, revision, fieldErrors, nil
+}
+
+// checkPatchedConfig rejects a patch that replaced the whole config with null,
+// or with something other than an object when the config was one. Either would
+// otherwise deserialize into a zero or partial config before validation.
+func checkPatchedConfig(current, patched []byte) error {
+	patched = bytes.TrimSpace(patched)
+	if bytes.Equal(patched, []byte("null")) {
+		return errors.New("patched config is null")
+	}
+	if isJSONObject(current) && !isJSONObject(patched) {
+		return errors.New("patched config must be a JSON object")
+	}
+	return nil
+}
+
+func isJSONObject(doc []byte) bool {
+	doc = bytes.TrimSpace(doc)
+	return len(doc) > 0 && doc[0] == '{'
+}
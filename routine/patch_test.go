@@ -0,0 +1,172 @@
+package routine
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// canonicalJSON re-encodes a document with sorted keys so documents compare as text
+func canonicalJSON(t *testing.T, data string) string {
+	t.Helper()
+	doc, err := decodeJSON([]byte(data))
+	if err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestMergePatch(t *testing.T) {
+	// The examples of RFC 7396 appendix A
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		// Large and fractional numbers keep their exact text
+		{`{"value":12345678901234567890}`, `{"rate":0.1}`, `{"value":12345678901234567890,"rate":0.1}`},
+	}
+	for _, test := range tests {
+		t.Run(test.target+" "+test.patch, func(t *testing.T) {
+			got, err := MergePatch(json.RawMessage(test.patch))([]byte(test.target))
+			if err != nil {
+				t.Fatalf("MergePatch: %v", err)
+			}
+			if want := canonicalJSON(t, test.want); string(got) != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestMergePatchInvalid(t *testing.T) {
+	if _, err := MergePatch(json.RawMessage(`{"a":`))([]byte(`{}`)); err == nil {
+		t.Error("an invalid patch should fail")
+	}
+	if _, err := MergePatch(json.RawMessage(`{}`))([]byte(`{"a"`)); err == nil {
+		t.Error("an invalid document should fail")
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	// Mostly the examples of RFC 6902 appendix A
+	tests := []struct {
+		name, doc, patch, want string
+	}{
+		{"add object member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{"add array element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{"add to array end", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{"add replaces existing member", `{"foo":"bar"}`, `[{"op":"add","path":"/foo","value":1}]`, `{"foo":1}`},
+		{"add at root", `{"foo":"bar"}`, `[{"op":"add","path":"","value":{"baz":true}}]`, `{"baz":true}`},
+		{"remove object member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{"remove array element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{"replace value", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{"replace root", `{"foo":"bar"}`, `[{"op":"replace","path":"","value":{"baz":1}}]`, `{"baz":1}`},
+		{"move value", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"move array element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{"copy does not alias", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`},
+		{"test value", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{"test compares numbers by value", `{"a":1,"b":[1e2]}`, `[{"op":"test","path":"/a","value":1.0},{"op":"test","path":"/b","value":[100]}]`, `{"a":1,"b":[1e2]}`},
+		{"test ignores member order", `{"a":{"x":1,"y":2}}`, `[{"op":"test","path":"/a","value":{"y":2,"x":1}}]`, `{"a":{"x":1,"y":2}}`},
+		{"escaped pointer", `{"a/b":1,"m~n":2}`, `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/m~0n"}]`, `{"a/b":3}`},
+		{"add nested member", `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{"operations apply in order", `{"n":1}`, `[{"op":"replace","path":"/n","value":2},{"op":"test","path":"/n","value":2}]`, `{"n":2}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ops []JSONPatchOperation
+			if err := json.Unmarshal([]byte(test.patch), &ops); err != nil {
+				t.Fatal(err)
+			}
+			got, err := JSONPatch(ops)([]byte(test.doc))
+			if err != nil {
+				t.Fatalf("JSONPatch: %v", err)
+			}
+			if want := canonicalJSON(t, test.want); string(got) != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	tests := []struct {
+		name, doc, patch string
+	}{
+		{"test fails", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+		{"test number against string", `{"a":1}`, `[{"op":"test","path":"/a","value":"1"}]`},
+		{"test arrays of different length", `{"a":[1,2]}`, `[{"op":"test","path":"/a","value":[1]}]`},
+		{"add to missing parent", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{"add past array end", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":1}]`},
+		{"remove missing member", `{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{"replace missing member", `{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`},
+		{"leading zero index", `{"foo":[1,2]}`, `[{"op":"remove","path":"/foo/01"}]`},
+		{"move into itself", `{"a":{"b":{}}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`},
+		{"missing value", `{"a":1}`, `[{"op":"add","path":"/b"}]`},
+		{"unknown op", `{"a":1}`, `[{"op":"merge","path":"/a","value":1}]`},
+		{"pointer without slash", `{"a":1}`, `[{"op":"remove","path":"a"}]`},
+		{"later failure rejects the whole patch", `{"a":1}`, `[{"op":"replace","path":"/a","value":2},{"op":"test","path":"/a","value":1}]`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ops []JSONPatchOperation
+			if err := json.Unmarshal([]byte(test.patch), &ops); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := JSONPatch(ops)([]byte(test.doc)); err == nil {
+				t.Errorf("JSONPatch succeeded with %s, want an error", got)
+			}
+		})
+	}
+}
+
+func TestPatchRoutineConfigKeepsAnObject(t *testing.T) {
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	id, err := s.StartRoutineWithOptions(&testConfig{Value: 1}, StartOptions{StartAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, err := s.loadControl(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		patch ConfigPatch
+	}{
+		{"merge patch null", MergePatch(json.RawMessage(`null`))},
+		{"merge patch string", MergePatch(json.RawMessage(`"x"`))},
+		{"merge patch array", MergePatch(json.RawMessage(`[1]`))},
+		{"json patch replacing the root", JSONPatch([]JSONPatchOperation{{Op: "replace", Path: "", Value: json.RawMessage(`null`)}})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patched, fieldErrors, err := s.patchRoutineConfig(SystemActor, nil, []string{id}, test.patch)
+			if patched != 0 || len(fieldErrors) > 0 || err == nil {
+				t.Errorf("got (%d, %v, %v), want the patch rejected", patched, fieldErrors, err)
+			}
+			if config, revision := ctrl.configAt(); config == nil || config.Value != 1 || revision != 1 {
+				t.Errorf("config %+v at revision %d, want it unchanged", config, revision)
+			}
+		})
+	}
+}
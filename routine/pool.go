@@ -0,0 +1,205 @@
+package routine
+
+import (
+	"container/heap"
+	"context"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ExecutionMode chooses how routines get CPU time
+type ExecutionMode string
+
+const (
+	// ExecGoroutine gives every running routine its own goroutine looping on Job
+	ExecGoroutine ExecutionMode = "goroutine"
+	// ExecPool runs iterations on a fixed set of workers that pull due routines
+	// from a queue ordered by next run time. Jobs should return quickly and
+	// leave waiting to Interval instead of sleeping.
+	ExecPool ExecutionMode = "pool"
+)
+
+// poolTask is one routine scheduled on the pool
+type poolTask struct {
+	due time.Time
+	// step runs one iteration and reports whether the routine continues and after how long
+	step func() (time.Duration, bool)
+	// priority reads the routine's priority when the task becomes due
+	priority func() int
+	// rank is the priority the task competes with for a worker once due
+	rank int
+	// index is the position in its heap, -1 while a worker runs the task
+	index int
+	ready bool
+}
+
+// taskHeap is a heap of tasks in the order given by less
+type taskHeap struct {
+	tasks []*poolTask
+	less  func(a, b *poolTask) bool
+}
+
+func (h *taskHeap) Len() int           { return len(h.tasks) }
+func (h *taskHeap) Less(i, j int) bool { return h.less(h.tasks[i], h.tasks[j]) }
+func (h *taskHeap) Swap(i, j int) {
+	h.tasks[i], h.tasks[j] = h.tasks[j], h.tasks[i]
+	h.tasks[i].index = i
+	h.tasks[j].index = j
+}
+
+func (h *taskHeap) Push(x any) {
+	task := x.(*poolTask)
+	task.index = len(h.tasks)
+	h.tasks = append(h.tasks, task)
+}
+
+func (h *taskHeap) Pop() any {
+	old := h.tasks
+	task := old[len(old)-1]
+	old[len(old)-1] = nil
+	task.index = -1
+	h.tasks = old[:len(old)-1]
+	return task
+}
+
+// workerPool runs due tasks on a bounded number of workers.
+// Tasks wait in timed, ordered by due time, until they are due, then in
+// ready, ordered by priority with aging, until a worker is free. A
+// dispatcher goroutine moves them along and hands them to idle workers;
+// workers reschedule tasks that continue.
+type workerPool struct {
+	mu    sync.Mutex
+	timed taskHeap
+	ready taskHeap
+	wake  chan struct{}
+	work  chan *poolTask
+}
+
+func newWorkerPool(workers int) *workerPool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	p := &workerPool{
+		timed: taskHeap{less: func(a, b *poolTask) bool { return a.due.Before(b.due) }},
+		ready: taskHeap{less: func(a, b *poolTask) bool { return agedBefore(a.due, a.rank, b.due, b.rank) }},
+		wake:  make(chan struct{}, 1),
+		work:  make(chan *poolTask),
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	go p.dispatch()
+	return p
+}
+
+// schedule queues a task to run at due
+func (p *workerPool) schedule(task *poolTask, due time.Time) {
+	p.mu.Lock()
+	task.due = due
+	task.ready = false
+	heap.Push(&p.timed, task)
+	p.mu.Unlock()
+	p.notify()
+}
+
+// expedite moves a queued task to the front, so a stopped routine is noticed without waiting for its turn
+func (p *workerPool) expedite(task *poolTask) {
+	p.mu.Lock()
+	if task.index >= 0 {
+		task.due = time.Time{}
+		task.rank = MaxPriority
+		if task.ready {
+			heap.Fix(&p.ready, task.index)
+		} else {
+			heap.Fix(&p.timed, task.index)
+		}
+	}
+	p.mu.Unlock()
+	p.notify()
+}
+
+func (p *workerPool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *workerPool) dispatch() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		p.mu.Lock()
+		now := time.Now()
+		for p.timed.Len() > 0 && !p.timed.tasks[0].due.After(now) {
+			task := heap.Pop(&p.timed).(*poolTask)
+			if !task.due.IsZero() {
+				task.rank = task.priority()
+			}
+			task.ready = true
+			heap.Push(&p.ready, task)
+		}
+		if p.ready.Len() > 0 {
+			next := heap.Pop(&p.ready).(*poolTask)
+			p.mu.Unlock()
+			// Blocks while every worker is busy, which is what bounds concurrency
+			p.work <- next
+			continue
+		}
+		if p.timed.Len() == 0 {
+			p.mu.Unlock()
+			<-p.wake
+			continue
+		}
+		wait := p.timed.tasks[0].due.Sub(now)
+		p.mu.Unlock()
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-p.wake:
+			timer.Stop()
+		}
+	}
+}
+
+func (p *workerPool) worker() {
+	for task := range p.work {
+		if wait, ok := task.step(); ok {
+			p.schedule(task, time.Now().Add(wait))
+		}
+	}
+}
+
+// pool returns the scheduler's worker pool, starting it on first use
+func (s *RoutineScheduler[TConfig, TOutput]) pool() *workerPool {
+	s.poolOnce.Do(func() {
+		s.workers = newWorkerPool(s.Workers)
+	})
+	return s.workers
+}
+
+// launch runs an admitted routine in the scheduler's execution mode
+func (s *RoutineScheduler[TConfig, TOutput]) launch(ctx context.Context, id string, ctrl *RoutineControl[TConfig, TOutput], done chan struct{}) {
+	ctrl.bounds.begin(time.Now())
+	if s.Mode != ExecPool {
+		go s.run(ctx, id, ctrl, done)
+		return
+	}
+	pool := s.pool()
+	task := &poolTask{index: -1, priority: ctrl.Priority}
+	stop := context.AfterFunc(ctx, func() { pool.expedite(task) })
+	task.step = func() (time.Duration, bool) {
+		if s.step(ctx, id, ctrl, done) {
+			// A stop that came in while the iteration ran could not expedite the
+			// task, so come straight back to bury it instead of waiting out the
+			// interval with tokens reserved for a stopped routine
+			if ctx.Err() != nil {
+				return 0, true
+			}
+			return s.throttle(ctrl, s.Interval), true
+		}
+		stop()
+		return 0, false
+	}
+	pool.schedule(task, time.Now().Add(s.throttle(ctrl, 0)))
+}
@@ -0,0 +1,89 @@
+package routine
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type benchConfig struct{}
+
+type benchOutput struct {
+	Iteration int64
+}
+
+// benchmarkIterations measures the cost of one iteration of a trivial job
+// while the given number of routines share the CPU in the given mode
+func benchmarkIterations(b *testing.B, mode ExecutionMode, routines int) {
+	var counter, target atomic.Int64
+	var reachedOnce sync.Once
+	reached := make(chan struct{})
+	// Jobs wait on begin until every routine is started and park on finished
+	// once the target is reached, so busy routines delay neither the starts
+	// nor the benchmark goroutine noticing the end
+	begin := make(chan struct{})
+	finished := make(chan struct{})
+
+	scheduler := NewRoutineScheduler(0, &Routine[*benchConfig, *benchOutput]{
+		Type: "bench",
+		Job: func(ctrl *RoutineControl[*benchConfig, *benchOutput]) (*benchOutput, error) {
+			<-begin
+			n := counter.Add(1)
+			if t := target.Load(); t > 0 && n >= t {
+				reachedOnce.Do(func() { close(reached) })
+				<-finished
+			}
+			return &benchOutput{Iteration: n}, nil
+		},
+		GenIdentity:     ULIDIdentity[*benchConfig]("bench-"),
+		SerializeConfig: func(*benchConfig) string { return "" },
+		SerializeOutput: func(*benchOutput) string { return "" },
+	}, false)
+	scheduler.Mode = mode
+
+	// Count only the goroutines this scheduler adds
+	baseline := runtime.NumGoroutine()
+	ids := make([]string, 0, routines)
+	for i := 0; i < routines; i++ {
+		id, err := scheduler.StartRoutineWithConfig(&benchConfig{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	goroutines := runtime.NumGoroutine() - baseline
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	target.Store(int64(b.N))
+	close(begin)
+	<-reached
+	b.StopTimer()
+
+	b.ReportMetric(float64(goroutines), "goroutines")
+	var stopped []chan struct{}
+	for _, id := range ids {
+		ctrl, err := scheduler.loadControl(id)
+		if err != nil {
+			continue
+		}
+		ctrl.Cancel()
+		stopped = append(stopped, ctrl.Done)
+	}
+	close(finished)
+	for _, done := range stopped {
+		<-done
+	}
+}
+
+func BenchmarkExecutionModes(b *testing.B) {
+	for _, mode := range []ExecutionMode{ExecGoroutine, ExecPool} {
+		for _, routines := range []int{100, 1000, 10000} {
+			b.Run(fmt.Sprintf("%s/routines=%d", mode, routines), func(b *testing.B) {
+				benchmarkIterations(b, mode, routines)
+			})
+		}
+	}
+}
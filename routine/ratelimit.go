@@ -0,0 +1,436 @@
+package routine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket for iterations: on average Rate iterations run
+// per second, with bursts of up to Burst after a quiet period.
+type RateLimit struct {
+	Rate float64 `json:"rate"`
+	// Burst is the bucket size; values below 1 mean 1
+	Burst int `json:"burst"`
+}
+
+// ParseRate parses a rate such as "10/s", "100/m", "3/5m" or a bare number
+// of iterations per second
+func ParseRate(value string) (float64, error) {
+	count, per, found := strings.Cut(strings.TrimSpace(value), "/")
+	rate, err := strconv.ParseFloat(count, 64)
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	if !found {
+		return rate, nil
+	}
+	// "10/s" means ten per one second
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	period, err := time.ParseDuration(per)
+	if err != nil || period <= 0 {
+		return 0, fmt.Errorf("invalid rate period in %q", value)
+	}
+	return rate / period.Seconds(), nil
+}
+
+// validate checks that the limit lets iterations through
+func (limit RateLimit) validate() error {
+	if !(limit.Rate > 0) || math.IsInf(limit.Rate, 0) {
+		return fmt.Errorf("rate must be a positive number, got %v", limit.Rate)
+	}
+	if limit.Burst < 0 {
+		return errors.New("burst must not be negative")
+	}
+	return nil
+}
+
+func (limit RateLimit) burst() float64 {
+	return math.Max(1, float64(limit.Burst))
+}
+
+// tokenBucket hands out one token per iteration. A routine that finds it
+// empty reserves the next token and waits until it has been refilled, so
+// routines sharing a bucket queue up instead of retrying.
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	// last is when tokens was counted; it lies ahead while iterations wait
+	// for the tokens they reserved
+	last time.Time
+	// waited adds up the delays the bucket imposed; delayed counts them
+	waited  time.Duration
+	delayed int64
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: limit.burst(), last: time.Now()}
+}
+
+// refillLocked returns the tokens available at now
+func (b *tokenBucket) refillLocked(now time.Time) float64 {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(b.limit.burst(), b.tokens+elapsed*b.limit.Rate)
+}
+
+// readyLocked returns when the bucket next has a whole token. Tokens already
+// promised to waiting iterations are spent at their run time, so a bucket
+// never refills before its last charge.
+func (b *tokenBucket) readyLocked(now time.Time) time.Time {
+	from := now
+	if b.last.After(from) {
+		from = b.last
+	}
+	tokens := b.refillLocked(from)
+	if tokens >= 1 {
+		return from
+	}
+	return from.Add(time.Duration((1 - tokens) / b.limit.Rate * float64(time.Second)))
+}
+
+// reserve takes a token from every bucket for one iteration and returns how
+// long to wait before running it: until the slowest bucket has a token. Every
+// bucket is charged a whole token at that run time, so a bucket shared with
+// slower ones still hands out no more than its rate. The buckets are checked
+// and charged together while they are all locked, so they must come in the
+// same order for every caller.
+func reserve(buckets []*tokenBucket, now time.Time) time.Duration {
+	for _, b := range buckets {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+	}
+	at := now
+	for _, b := range buckets {
+		ready := b.readyLocked(now)
+		if ready.After(now) {
+			b.waited += ready.Sub(now)
+			b.delayed++
+		}
+		if ready.After(at) {
+			at = ready
+		}
+	}
+	for _, b := range buckets {
+		b.tokens = b.refillLocked(at) - 1
+		b.last = at
+	}
+	return at.Sub(now)
+}
+
+// BucketStatus shows how full a shared bucket is and how much it held iterations back
+type BucketStatus struct {
+	RateLimit
+	// Tokens counts what is left once the iterations already reserved have run
+	Tokens   float64 `json:"tokens"`
+	WaitedMs float64 `json:"waited_ms"`
+	Delayed  int64   `json:"delayed"`
+}
+
+func (b *tokenBucket) status() BucketStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BucketStatus{
+		RateLimit: b.limit,
+		Tokens:    b.refillLocked(time.Now()),
+		WaitedMs:  milliseconds(b.waited),
+		Delayed:   b.delayed,
+	}
+}
+
+// GroupRateLimit is one bucket shared by every routine whose labels match Selector
+type GroupRateLimit struct {
+	Name     string `json:"name"`
+	Selector string `json:"selector"`
+	RateLimit
+}
+
+// RateLimits are the buckets shared between routines. A routine takes a token
+// from its own limit, its type's limit and every group it belongs to, and
+// waits for the slowest of them.
+type RateLimits struct {
+	PerType map[string]RateLimit `json:"per_type,omitempty"`
+	Groups  []GroupRateLimit     `json:"groups,omitempty"`
+}
+
+type groupBucket struct {
+	name     string
+	selector Selector
+	bucket   *tokenBucket
+}
+
+// rateLimiter holds the shared buckets. There is one per process, like the
+// concurrency limits, so a type's rate holds across every scheduler.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limits RateLimits
+	types  map[string]*tokenBucket
+	groups []groupBucket
+}
+
+var rateLimiting = &rateLimiter{types: make(map[string]*tokenBucket)}
+
+// SetRateLimits replaces the shared rate limits. Buckets start full.
+func SetRateLimits(limits RateLimits) error {
+	types := make(map[string]*tokenBucket, len(limits.PerType))
+	perType := make(map[string]RateLimit, len(limits.PerType))
+	for routineType, limit := range limits.PerType {
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("rate limit for type %s: %v", routineType, err)
+		}
+		types[routineType] = newTokenBucket(limit)
+		perType[routineType] = limit
+	}
+	groups := make([]groupBucket, 0, len(limits.Groups))
+	names := make(map[string]bool, len(limits.Groups))
+	for _, group := range limits.Groups {
+		if group.Name == "" || names[group.Name] {
+			return fmt.Errorf("rate limit groups need unique names, got %q", group.Name)
+		}
+		names[group.Name] = true
+		if err := group.validate(); err != nil {
+			return fmt.Errorf("rate limit group %s: %v", group.Name, err)
+		}
+		selector, err := ParseSelector(group.Selector)
+		if err != nil {
+			return fmt.Errorf("rate limit group %s: %v", group.Name, err)
+		}
+		groups = append(groups, groupBucket{name: group.Name, selector: selector, bucket: newTokenBucket(group.RateLimit)})
+	}
+	limits.PerType = perType
+	limits.Groups = append([]GroupRateLimit(nil), limits.Groups...)
+
+	rateLimiting.mu.Lock()
+	rateLimiting.limits = limits
+	rateLimiting.types = types
+	rateLimiting.groups = groups
+	rateLimiting.mu.Unlock()
+	return nil
+}
+
+// CurrentRateLimits returns the shared rate limits in effect
+func CurrentRateLimits() RateLimits {
+	rateLimiting.mu.Lock()
+	defer rateLimiting.mu.Unlock()
+	return rateLimiting.limits
+}
+
+// buckets returns the shared buckets a routine of the type with the labels draws from
+func (l *rateLimiter) buckets(routineType string, labels Labels) []*tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var buckets []*tokenBucket
+	if bucket, ok := l.types[routineType]; ok {
+		buckets = append(buckets, bucket)
+	}
+	for _, group := range l.groups {
+		if group.selector.Matches(labels) {
+			buckets = append(buckets, group.bucket)
+		}
+	}
+	return buckets
+}
+
+// RateLimitStatus is a snapshot of the shared buckets
+type RateLimitStatus struct {
+	Limits RateLimits              `json:"limits"`
+	Types  map[string]BucketStatus `json:"types"`
+	Groups map[string]BucketStatus `json:"groups"`
+}
+
+// RateLimiting returns the shared rate limits and how much they delay iterations
+func RateLimiting() RateLimitStatus {
+	rateLimiting.mu.Lock()
+	defer rateLimiting.mu.Unlock()
+	status := RateLimitStatus{
+		Limits: rateLimiting.limits,
+		Types:  make(map[string]BucketStatus, len(rateLimiting.types)),
+		Groups: make(map[string]BucketStatus, len(rateLimiting.groups)),
+	}
+	for routineType, bucket := range rateLimiting.types {
+		status.Types[routineType] = bucket.status()
+	}
+	for _, group := range rateLimiting.groups {
+		status.Groups[group.name] = group.bucket.status()
+	}
+	return status
+}
+
+// RateLimit returns the routine's own rate limit, or nil when it has none
+func (ctrl *RoutineControl[TConfig, TOutput]) RateLimit() *RateLimit {
+	bucket := ctrl.rateLimit.Load()
+	if bucket == nil {
+		return nil
+	}
+	limit := bucket.limit
+	return &limit
+}
+
+// throttle reserves the routine's next iteration from its own and the shared
+// rate limits and returns how long to wait before running it: at least pause,
+// unless the routine's run ends sooner
+func (s *RoutineScheduler[TConfig, TOutput]) throttle(ctrl *RoutineControl[TConfig, TOutput], pause time.Duration) time.Duration {
+	now := time.Now()
+	// The routine's own bucket comes first and the shared ones in a fixed order
+	var buckets []*tokenBucket
+	if bucket := ctrl.rateLimit.Load(); bucket != nil {
+		buckets = append(buckets, bucket)
+	}
+	buckets = append(buckets, rateLimiting.buckets(s.routineType(), ctrl.Labels())...)
+	wait := reserve(buckets, now)
+	// Only the part beyond the regular pause is time lost to rate limiting
+	ctrl.history.rateWait(max(wait-pause, 0))
+	return ctrl.bounds.clamp(max(wait, pause), now)
+}
+
+// SetRoutineRateLimit gives routines their own rate limit, or removes it when limit is nil.
+// The routines start with a full bucket.
+func (s *RoutineScheduler[TConfig, TOutput]) SetRoutineRateLimit(ids []string, limit *RateLimit) (int, error) {
+	if limit != nil {
+		if err := limit.validate(); err != nil {
+			return 0, err
+		}
+	}
+	var err error
+	updated := 0
+	for _, id := range ids {
+		ctrl, errLoad := s.loadControl(id)
+		if errLoad != nil {
+			err = errors.Join(err, errLoad)
+			continue
+		}
+		ctrl.setRateLimit(limit)
+		ctrl.history.event("", "rate-limit-changed", rateLimitString(limit))
+		updated++
+	}
+	return updated, err
+}
+
+func (ctrl *RoutineControl[TConfig, TOutput]) setRateLimit(limit *RateLimit) {
+	if limit == nil {
+		ctrl.rateLimit.Store(nil)
+		return
+	}
+	ctrl.rateLimit.Store(newTokenBucket(*limit))
+}
+
+// rateLimitString describes a limit for events and the audit log
+func rateLimitString(limit *RateLimit) string {
+	if limit == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%g/s burst %d", limit.Rate, limit.Burst)
+}
+
+// parseRateQuery reads the rate and burst query parameters of a start request
+func parseRateQuery(r *http.Request) (*RateLimit, error) {
+	query := r.URL.Query()
+	if !query.Has("rate") {
+		if query.Has("burst") {
+			return nil, errors.New("burst needs a rate")
+		}
+		return nil, nil
+	}
+	rate, err := ParseRate(query.Get("rate"))
+	if err != nil {
+		return nil, err
+	}
+	limit := &RateLimit{Rate: rate}
+	if value := query.Get("burst"); value != "" {
+		if limit.Burst, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid burst parameter %q", value)
+		}
+	}
+	return limit, limit.validate()
+}
+
+// handleRateLimits shows the shared rate limits and their buckets
+func (s *RoutineScheduler[TConfig, TOutput]) handleRateLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(RateLimiting())
+}
+
+// handleSetRateLimits replaces the shared rate limits
+func (s *RoutineScheduler[TConfig, TOutput]) handleSetRateLimits(w http.ResponseWriter, r *http.Request) {
+	var limits RateLimits
+	result := NewHandleResult(1, "Failed to set rate limits")
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		result.SetError(fmt.Errorf("invalid request format: %v", err)).Response(w)
+		return
+	}
+
+	audit := auditFrom(r)
+	audit.OldConfig = map[string]string{"rate_limits": rateLimitsJSON(CurrentRateLimits())}
+	if err := SetRateLimits(limits); err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+	audit.NewConfig = map[string]string{"rate_limits": rateLimitsJSON(limits)}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(RateLimiting())
+}
+
+func rateLimitsJSON(limits RateLimits) string {
+	data, _ := json.Marshal(limits)
+	return string(data)
+}
+
+// handleRoutineRateLimit sets or removes the own rate limit of routines chosen by ID or selector
+func (s *RoutineScheduler[TConfig, TOutput]) handleRoutineRateLimit(w http.ResponseWriter, r *http.Request) {
+	type RateLimitPayload struct {
+		IDs []string `json:"ids"`
+		// RateLimit is null to remove the routines' own limit
+		RateLimit *RateLimit `json:"rate_limit"`
+	}
+
+	var payload RateLimitPayload
+	result := NewHandleResult(0, "Failed to set the rate limit of all requested routines")
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		result.SetError(fmt.Errorf("invalid request format: %v", err)).Response(w)
+		return
+	}
+	if payload.RateLimit != nil {
+		if err := payload.RateLimit.validate(); err != nil {
+			result.SetError(err).Response(w)
+			return
+		}
+	}
+	ids, err := s.selectTargets(r, PermUpdateConfig, payload.IDs)
+	if err != nil {
+		targetError(w, result, err)
+		return
+	}
+
+	audit := auditFrom(r)
+	audit.IDs = ids
+	audit.OldConfig = s.snapshotRateLimits(ids)
+
+	updated, err := s.SetRoutineRateLimit(ids, payload.RateLimit)
+	audit.NewConfig = s.snapshotRateLimits(ids)
+
+	result.SetError(err)
+	result.Set(updated, len(ids)).Response(w)
+}
+
+// snapshotRateLimits captures the own rate limits of routines for the audit log
+func (s *RoutineScheduler[TConfig, TOutput]) snapshotRateLimits(ids []string) map[string]string {
+	snapshot := make(map[string]string, len(ids))
+	for _, id := range ids {
+		if ctrl, err := s.loadControl(id); err == nil {
+			snapshot[id] = rateLimitString(ctrl.RateLimit())
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,69 @@
+package routine
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	second := func(n float64) time.Duration { return time.Duration(n * float64(time.Second)) }
+	tests := []struct {
+		name   string
+		limits []RateLimit
+		// waits are the expected delays of consecutive reservations made at the same time
+		waits []time.Duration
+	}{
+		{"burst passes at once", []RateLimit{{Rate: 1, Burst: 3}}, []time.Duration{0, 0, 0, second(1), second(2)}},
+		{"an empty bucket queues iterations", []RateLimit{{Rate: 2}}, []time.Duration{0, second(0.5), second(1)}},
+		{"the slowest bucket sets the pace", []RateLimit{{Rate: 10, Burst: 1}, {Rate: 1, Burst: 1}}, []time.Duration{0, second(1), second(2)}},
+		// The fast bucket is charged when the iteration runs, so it never adds its own delay on top
+		{"a ready bucket is not charged for the wait", []RateLimit{{Rate: 1, Burst: 1}, {Rate: 1, Burst: 1}}, []time.Duration{0, second(1), second(2)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Now()
+			var buckets []*tokenBucket
+			for _, limit := range test.limits {
+				bucket := newTokenBucket(limit)
+				bucket.last = now
+				buckets = append(buckets, bucket)
+			}
+			for i, want := range test.waits {
+				if got := reserve(buckets, now); (got - want).Abs() > time.Millisecond {
+					t.Errorf("reservation %d waits %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReserveSharedBucketKeepsItsRate(t *testing.T) {
+	// Routines held back by their own empty buckets still take a whole token
+	// from the bucket they share when they run, so together they run no
+	// faster than its rate instead of all at once
+	now := time.Now()
+	shared := newTokenBucket(RateLimit{Rate: 1, Burst: 1})
+	shared.last = now
+	const routines = 10
+	for i := range routines {
+		own := newTokenBucket(RateLimit{Rate: 0.1, Burst: 1})
+		own.tokens, own.last = 0, now
+		want := time.Duration(10+i) * time.Second
+		if wait := reserve([]*tokenBucket{own, shared}, now); (wait - want).Abs() > time.Millisecond {
+			t.Errorf("routine %d waits %v, want %v", i, wait, want)
+		}
+	}
+	// The last reserved iteration runs at t=19s and empties the bucket
+	shared.mu.Lock()
+	tokens, last := shared.tokens, shared.last.Sub(now)
+	shared.mu.Unlock()
+	if math.Abs(tokens) > 0.01 || (last-19*time.Second).Abs() > time.Millisecond {
+		t.Errorf("shared bucket holds %.2f tokens at %v, want 0 at 19s", tokens, last)
+	}
+	// A routine with a token of its own queues behind the reserved iterations
+	own := newTokenBucket(RateLimit{Rate: 0.1, Burst: 1})
+	if wait := reserve([]*tokenBucket{own, shared}, now); (wait - 20*time.Second).Abs() > time.Millisecond {
+		t.Errorf("a later routine waits %v, want 20s", wait)
+	}
+}
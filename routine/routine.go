@@ -2,7 +2,10 @@ package routine
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // RoutineControl manages the execution of a routine.
@@ -13,6 +16,32 @@ type RoutineControl[TConfig any, TOutput any] struct {
 	Done   chan struct{}
 	Output atomic.Value // Stores TOutput
 	Config atomic.Value // Stores TConfig
+	// Tags are fixed when the routine starts and scope authorization grants
+	Tags []string
+
+	history  *routineHistory
+	versions *configVersions
+	labels   atomic.Value // Stores Labels; replaced as a whole on every change
+	labelsMu sync.Mutex   // Serializes label edits
+
+	// firstIteration is closed once the first iteration finished or the routine ended without one
+	firstIteration chan struct{}
+	firstOnce      sync.Once
+	firstErr       error
+	firstOutput    any // Stores TOutput
+
+	// ticket holds the routine's running slot, or its place in the admission queue
+	ticket *admissionTicket
+	// rateLimit is the routine's own token bucket, nil when it has none
+	rateLimit atomic.Pointer[tokenBucket]
+	// priority orders the routine against others waiting for a slot or a worker
+	priority atomic.Int64
+	// bounds end a finite routine; set before it first runs
+	bounds runBounds
+	// startAt is when a delayed routine was scheduled to start
+	startAt time.Time
+	// dependsOn lists the routines this one waited for
+	dependsOn []Dependency
 }
 
 // NewRoutineControl creates a new RoutineControl.
@@ -21,14 +50,39 @@ func NewRoutineControl[TConfig any, TOutput any](config TConfig, initOutput TOut
 	_, cancel := context.WithCancel(context.Background())
 	done := make(chan struct{})
 	ctrl := &RoutineControl[TConfig, TOutput]{
-		Cancel: cancel,
-		Done:   done,
+		Cancel:   cancel,
+		Done:     done,
+		history:  newRoutineHistory(),
+		versions: &configVersions{},
+
+		firstIteration: make(chan struct{}),
 	}
 	ctrl.Config.Store(config)
 	ctrl.Output.Store(initOutput)
+	ctrl.labels.Store(Labels{})
 	return ctrl
 }
 
+// Logf records a message in the routine's log, shown on its detail page
+func (ctrl *RoutineControl[TConfig, TOutput]) Logf(format string, args ...any) {
+	ctrl.history.log(fmt.Sprintf(format, args...))
+}
+
+// markFirstIteration records how the first iteration ended, keeping its output; later calls are ignored.
+// It runs on the routine's goroutine right after the iteration, so Output still holds the first output.
+func (ctrl *RoutineControl[TConfig, TOutput]) markFirstIteration(err error) {
+	ctrl.firstOnce.Do(func() {
+		ctrl.firstErr = err
+		ctrl.firstOutput = ctrl.Output.Load()
+		close(ctrl.firstIteration)
+	})
+}
+
+// State returns the current lifecycle state of the routine
+func (ctrl *RoutineControl[TConfig, TOutput]) State() RoutineState {
+	return ctrl.history.currentState()
+}
+
 // Generic function types for a Routine
 type RoutineJob[TConfig any, TOutput any] func(ctrl *RoutineControl[TConfig, TOutput]) (TOutput, error)
 type RoutineIdentity[TConfig any] func(config TConfig) string
@@ -41,10 +95,15 @@ type ConfigSerializer[TConfig any] func(config TConfig) string
 type ConfigDeserializer[TConfig any] func(configStr string) (TConfig, error)
 type OutputSerializer[TOutput any] func(output TOutput) string
 
+// ConfigValidator checks a deserialized config and returns one error per invalid field
+type ConfigValidator[TConfig any] func(config TConfig) []FieldError
+
 // Routine is a generic struct that represents a job to be executed.
 // It is parameterized by TConfig, the type of its configuration, and
 // TOutput, the type of its result.
 type Routine[TConfig any, TOutput any] struct {
+	// Type names the kind of routine, used to scope authorization grants
+	Type        string
 	Job         RoutineJob[TConfig, TOutput]
 	GenIdentity RoutineIdentity[TConfig]
 	// Serialization/deserialization functions
@@ -53,6 +112,8 @@ type Routine[TConfig any, TOutput any] struct {
 	SerializeOutput   OutputSerializer[TOutput]
 	Suspend           SuspendedRoutine[TConfig, TOutput]
 	Resume            ResumeRoutine[TConfig, TOutput]
+	// ValidateConfig is optional; configs it rejects are refused with 422
+	ValidateConfig ConfigValidator[TConfig]
 }
 
 // RoutineCreateFunc is a generic function type for creating routines.
@@ -0,0 +1,533 @@
+package routine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule actions, run in the order a rule lists them
+const (
+	ActionSuspend      = "suspend"
+	ActionStop         = "stop"
+	ActionUpdateConfig = "update-config"
+	ActionNotify       = "notify"
+)
+
+// Rule scopes
+const (
+	// ScopeRoutine counts each routine on its own and acts on the routine that triggered the rule
+	ScopeRoutine = "routine"
+	// ScopeGroup counts every routine the rule applies to together and acts on all of them
+	ScopeGroup = "group"
+)
+
+// Rule runs actions when a condition holds for the outputs of routines, e.g.
+//
+//	{"name": "cap", "selector": "env=prod", "when": "Count > 1000", "actions": ["suspend", "notify"]}
+//	{"name": "flaky", "when": "$error != null", "times": 3, "window": "5m", "scope": "group", "actions": ["stop"]}
+//
+// The condition is evaluated after every iteration, failed ones included. Once the
+// rule fires it does not fire again for the same routine until the condition has
+// been false, or for the group until it is false for every routine in it.
+type Rule struct {
+	Name string `json:"name"`
+	// IDs and Selector choose the routines the rule applies to; with neither it applies to all
+	IDs      []string `json:"ids,omitempty"`
+	Selector string   `json:"selector,omitempty"`
+	// When is an Expr over the JSON form of the output
+	When string `json:"when"`
+	// Times is how often the condition must hold within Window to fire; 0 means 1
+	Times int `json:"times,omitempty"`
+	// Window is a duration such as "5m"; empty counts without expiry
+	Window string `json:"window,omitempty"`
+	// Scope is ScopeRoutine (the default) or ScopeGroup
+	Scope   string   `json:"scope,omitempty"`
+	Actions []string `json:"actions"`
+	// Config is the config set by the update-config action
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// RuleStatus is a rule with what it has done so far
+type RuleStatus struct {
+	Rule
+	Fired     int64      `json:"fired"`
+	LastFired *time.Time `json:"last_fired,omitempty"`
+	// LastError is the last condition or action error
+	LastError string `json:"last_error,omitempty"`
+}
+
+// RuleNotification is sent by the notify action
+type RuleNotification struct {
+	Time    time.Time `json:"time"`
+	Rule    string    `json:"rule"`
+	Type    string    `json:"type"`
+	When    string    `json:"when"`
+	Trigger string    `json:"trigger"` // The routine whose output fired the rule
+	Targets []string  `json:"targets"`
+	Actions []string  `json:"actions"`
+	Output  any       `json:"output,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Notifier delivers the notifications of rules
+type Notifier interface {
+	Notify(ctx context.Context, notification RuleNotification) error
+}
+
+// WebhookNotifier posts notifications as JSON to a URL
+type WebhookNotifier struct {
+	URL string
+	// Client defaults to one with a 10 second timeout
+	Client *http.Client
+}
+
+// Notify implements Notifier
+func (n *WebhookNotifier) Notify(ctx context.Context, notification RuleNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// LoadRules reads a JSON array of rules from a file
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// compiledRule is a validated rule with its firing state
+type compiledRule[TConfig any] struct {
+	Rule
+	when     *Expr
+	selector Selector
+	window   time.Duration
+	config   TConfig
+
+	mu      sync.Mutex
+	hits    map[string][]time.Time // Times the condition held, per routine or "" for the group
+	latched map[string]bool        // Fired and waiting for the condition to be false
+	holding map[string]bool        // Routines whose last evaluation held, in group scope
+	status  RuleStatus
+}
+
+// applies reports whether the rule watches the routine
+func (rule *compiledRule[TConfig]) applies(id string, labels Labels) bool {
+	if len(rule.IDs) == 0 && rule.Selector == "" {
+		return true
+	}
+	return slices.Contains(rule.IDs, id) || rule.Selector != "" && rule.selector.Matches(labels)
+}
+
+// observe records one evaluation of the routine and reports whether the rule
+// fires. A group is released once none of its routines holds the condition.
+func (rule *compiledRule[TConfig]) observe(id string, held bool, err error, now time.Time) bool {
+	rule.mu.Lock()
+	defer rule.mu.Unlock()
+	if err != nil {
+		rule.status.LastError = err.Error()
+		return false
+	}
+	key := id
+	if rule.Scope == ScopeGroup {
+		key = ""
+		if held {
+			rule.holding[id] = true
+		} else {
+			delete(rule.holding, id)
+		}
+	}
+	if !held {
+		if len(rule.holding) == 0 {
+			delete(rule.latched, key)
+		}
+		return false
+	}
+	if rule.latched[key] {
+		return false
+	}
+	hits := append(rule.hits[key], now)
+	if rule.window > 0 {
+		hits = slices.DeleteFunc(hits, func(at time.Time) bool { return now.Sub(at) > rule.window })
+	}
+	if len(hits) < max(rule.Times, 1) {
+		rule.hits[key] = hits
+		return false
+	}
+	delete(rule.hits, key)
+	rule.latched[key] = true
+	rule.status.Fired++
+	rule.status.LastFired = &now
+	return true
+}
+
+// forget drops the state a routine that ended left behind, so its ID starts
+// afresh if reused and a group is not kept latched by a routine that is gone
+func (rule *compiledRule[TConfig]) forget(id string) {
+	rule.mu.Lock()
+	defer rule.mu.Unlock()
+	delete(rule.hits, id)
+	delete(rule.latched, id)
+	if rule.Scope == ScopeGroup && rule.holding[id] {
+		delete(rule.holding, id)
+		if len(rule.holding) == 0 {
+			delete(rule.latched, "")
+		}
+	}
+}
+
+func (rule *compiledRule[TConfig]) failed(err error) {
+	rule.mu.Lock()
+	defer rule.mu.Unlock()
+	rule.status.LastError = err.Error()
+}
+
+func (rule *compiledRule[TConfig]) snapshot() RuleStatus {
+	rule.mu.Lock()
+	defer rule.mu.Unlock()
+	status := rule.status
+	status.Rule = rule.Rule
+	return status
+}
+
+// ruleSet holds a scheduler's rules; the zero value has none
+type ruleSet[TConfig any] struct {
+	mu    sync.RWMutex
+	rules []*compiledRule[TConfig]
+}
+
+// compileRule validates a rule, decoding the config it sets
+func (s *RoutineScheduler[TConfig, TOutput]) compileRule(rule Rule) (*compiledRule[TConfig], error) {
+	if rule.Name == "" {
+		return nil, errors.New("rule needs a name")
+	}
+	compiled := &compiledRule[TConfig]{Rule: rule, hits: make(map[string][]time.Time), latched: make(map[string]bool), holding: make(map[string]bool)}
+	var err error
+	if compiled.when, err = ParseExpr(rule.When); err != nil {
+		return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+	}
+	if rule.Selector != "" {
+		if compiled.selector, err = ParseSelector(rule.Selector); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+	}
+	if rule.Times < 0 {
+		return nil, fmt.Errorf("rule %s: times must not be negative", rule.Name)
+	}
+	if rule.Window != "" {
+		if compiled.window, err = time.ParseDuration(rule.Window); err != nil || compiled.window <= 0 {
+			return nil, fmt.Errorf("rule %s: invalid window %q", rule.Name, rule.Window)
+		}
+	}
+	switch rule.Scope {
+	case "", ScopeRoutine, ScopeGroup:
+	default:
+		return nil, fmt.Errorf("rule %s: unknown scope %q", rule.Name, rule.Scope)
+	}
+	if len(rule.Actions) == 0 {
+		return nil, fmt.Errorf("rule %s needs at least one action", rule.Name)
+	}
+	for _, action := range rule.Actions {
+		switch action {
+		case ActionSuspend, ActionStop, ActionNotify:
+		case ActionUpdateConfig:
+			if len(rule.Config) == 0 {
+				return nil, fmt.Errorf("rule %s: update-config needs a config", rule.Name)
+			}
+			if compiled.config, err = s.Routine.DeserializeConfig(string(rule.Config)); err != nil {
+				return nil, fmt.Errorf("rule %s: invalid config: %v", rule.Name, err)
+			}
+			if fieldErrors := s.validateConfig(compiled.config); len(fieldErrors) > 0 {
+				return nil, fmt.Errorf("rule %s: invalid config: %s: %s", rule.Name, fieldErrors[0].Field, fieldErrors[0].Message)
+			}
+		default:
+			return nil, fmt.Errorf("rule %s: unknown action %q", rule.Name, action)
+		}
+	}
+	return compiled, nil
+}
+
+// SetRules replaces every rule of the scheduler. Rules live in this replica's
+// memory only: with leader election, rules changed through the API on the
+// leader are not seen by the replica that leads next, which starts with the
+// rules it was configured with.
+func (s *RoutineScheduler[TConfig, TOutput]) SetRules(rules []Rule) error {
+	compiled := make([]*compiledRule[TConfig], 0, len(rules))
+	for _, rule := range rules {
+		if slices.ContainsFunc(compiled, func(c *compiledRule[TConfig]) bool { return c.Name == rule.Name }) {
+			return fmt.Errorf("duplicate rule %s", rule.Name)
+		}
+		c, err := s.compileRule(rule)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, c)
+	}
+	s.rules.mu.Lock()
+	defer s.rules.mu.Unlock()
+	s.rules.rules = compiled
+	return nil
+}
+
+// PutRule adds a rule, replacing the rule of the same name and its state
+func (s *RoutineScheduler[TConfig, TOutput]) PutRule(rule Rule) error {
+	compiled, err := s.compileRule(rule)
+	if err != nil {
+		return err
+	}
+	s.rules.mu.Lock()
+	defer s.rules.mu.Unlock()
+	if i := slices.IndexFunc(s.rules.rules, func(c *compiledRule[TConfig]) bool { return c.Name == rule.Name }); i >= 0 {
+		s.rules.rules[i] = compiled
+	} else {
+		s.rules.rules = append(s.rules.rules, compiled)
+	}
+	return nil
+}
+
+// DeleteRule removes a rule and reports whether it existed
+func (s *RoutineScheduler[TConfig, TOutput]) DeleteRule(name string) bool {
+	s.rules.mu.Lock()
+	defer s.rules.mu.Unlock()
+	n := len(s.rules.rules)
+	s.rules.rules = slices.DeleteFunc(s.rules.rules, func(c *compiledRule[TConfig]) bool { return c.Name == name })
+	return len(s.rules.rules) < n
+}
+
+// forgetRules drops the firing state of a routine that ended
+func (s *RoutineScheduler[TConfig, TOutput]) forgetRules(id string) {
+	s.rules.mu.RLock()
+	defer s.rules.mu.RUnlock()
+	for _, rule := range s.rules.rules {
+		rule.forget(id)
+	}
+}
+
+// Rules returns the scheduler's rules with their status
+func (s *RoutineScheduler[TConfig, TOutput]) Rules() []RuleStatus {
+	s.rules.mu.RLock()
+	defer s.rules.mu.RUnlock()
+	statuses := make([]RuleStatus, 0, len(s.rules.rules))
+	for _, rule := range s.rules.rules {
+		statuses = append(statuses, rule.snapshot())
+	}
+	return statuses
+}
+
+// evaluateRules checks the rules watching a routine after one of its iterations.
+// Actions run on their own goroutine so the routine is not held up by them.
+func (s *RoutineScheduler[TConfig, TOutput]) evaluateRules(id string, ctrl *RoutineControl[TConfig, TOutput], iterErr error) {
+	s.rules.mu.RLock()
+	var rules []*compiledRule[TConfig]
+	labels := ctrl.Labels()
+	for _, rule := range s.rules.rules {
+		if rule.applies(id, labels) {
+			rules = append(rules, rule)
+		}
+	}
+	s.rules.mu.RUnlock()
+	if len(rules) == 0 {
+		return
+	}
+
+	// A failed iteration has no output; conditions on output fields do not hold
+	var output any
+	vars := map[string]any{"$error": nil, "$iteration": float64(ctrl.history.iterationCount()), "$id": id, "$state": string(ctrl.State())}
+	if iterErr != nil && !errors.Is(iterErr, ErrDone) {
+		vars["$error"] = iterErr.Error()
+	} else if data, err := json.Marshal(ctrl.Output.Load()); err == nil {
+		_ = json.Unmarshal(data, &output)
+	}
+	vars["$output"] = output
+
+	now := time.Now()
+	for _, rule := range rules {
+		held, err := rule.when.Eval(output, vars)
+		if !rule.observe(id, held, err, now) {
+			continue
+		}
+		targets := []string{id}
+		if rule.Scope == ScopeGroup {
+			targets = s.ruleTargets(rule)
+		}
+		notification := RuleNotification{
+			Time:    now,
+			Rule:    rule.Name,
+			Type:    s.Routine.Type,
+			When:    rule.When,
+			Trigger: id,
+			Targets: targets,
+			Actions: rule.Actions,
+			Output:  output,
+		}
+		if msg, ok := vars["$error"].(string); ok {
+			notification.Error = msg
+		}
+		go s.fireRule(rule, notification)
+	}
+}
+
+// ruleTargets lists the live routines a group rule applies to
+func (s *RoutineScheduler[TConfig, TOutput]) ruleTargets(rule *compiledRule[TConfig]) []string {
+	var ids []string
+	routineMap.Range(func(key, val any) bool {
+		if ctrl, ok := val.(*RoutineControl[TConfig, TOutput]); ok && rule.applies(key.(string), ctrl.Labels()) {
+			ids = append(ids, key.(string))
+		}
+		return true
+	})
+	slices.Sort(ids)
+	return ids
+}
+
+// fireRule runs a rule's actions through the scheduler, as the rule's actor
+func (s *RoutineScheduler[TConfig, TOutput]) fireRule(rule *compiledRule[TConfig], notification RuleNotification) {
+	actor := "rule:" + rule.Name
+	detail := rule.Name + ": " + strings.Join(rule.Actions, ",")
+	for _, id := range notification.Targets {
+		if ctrl, err := s.loadControl(id); err == nil {
+			ctrl.history.event("", "rule-fired", detail)
+		}
+	}
+	log.Printf("rule %s fired on %s: %s", rule.Name, notification.Trigger, strings.Join(rule.Actions, ", "))
+
+	var oldConfig map[string]string
+	if slices.Contains(rule.Actions, ActionUpdateConfig) {
+		oldConfig = s.snapshotConfigs(notification.Targets)
+	}
+	var err error
+	for _, action := range rule.Actions {
+		var errAction error
+		switch action {
+		case ActionSuspend:
+			_, errAction = s.suspendRoutines(actor, notification.Targets)
+		case ActionStop:
+			_, errAction = s.StopRoutines(notification.Targets)
+		case ActionUpdateConfig:
+			_, errAction = s.updateRoutineConfig(actor, nil, notification.Targets, rule.config)
+		case ActionNotify:
+			errAction = s.notify(notification)
+		}
+		if errAction != nil {
+			err = errors.Join(err, fmt.Errorf("%s: %v", action, errAction))
+		}
+	}
+	if err != nil {
+		log.Printf("rule %s: %v", rule.Name, err)
+		rule.failed(err)
+	}
+
+	// Rule actions go to the audit log like the API calls they stand for
+	if s.Audit != nil {
+		entry := &AuditEntry{Time: time.Now(), Caller: actor, Action: "rule", IDs: notification.Targets, OldConfig: oldConfig, Status: http.StatusOK}
+		if oldConfig != nil {
+			entry.NewConfig = s.snapshotConfigs(notification.Targets)
+		}
+		if err != nil {
+			entry.Status = http.StatusInternalServerError
+		}
+		entry.Result, _ = json.Marshal(notification)
+		if errRecord := s.Audit.Record(entry); errRecord != nil {
+			log.Printf("Error: could not write audit entry: %v", errRecord)
+		}
+	}
+}
+
+// notify hands a notification to the Notifier, or logs it when there is none
+func (s *RoutineScheduler[TConfig, TOutput]) notify(notification RuleNotification) error {
+	if s.Notifier == nil {
+		data, _ := json.Marshal(notification)
+		log.Printf("rule notification: %s", data)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return s.Notifier.Notify(ctx, notification)
+}
+
+// handleRules lists the rules and their status
+func (s *RoutineScheduler[TConfig, TOutput]) handleRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.Rules())
+}
+
+// handlePutRule adds or replaces the rule in the body. Like SetRules, the
+// change only lasts as long as the replica that received it.
+func (s *RoutineScheduler[TConfig, TOutput]) handlePutRule(w http.ResponseWriter, r *http.Request) {
+	var rule Rule
+	// No total yet, so a rejected rule reports why instead of the default message
+	result := NewHandleResult(0, "Failed to set rule")
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		result.SetError(fmt.Errorf("invalid request format: %v", err)).Response(w)
+		return
+	}
+
+	audit := auditFrom(r)
+	for _, existing := range s.Rules() {
+		if existing.Name == rule.Name {
+			audit.OldConfig = map[string]string{rule.Name: ruleJSON(existing.Rule)}
+		}
+	}
+	if err := s.PutRule(rule); err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+	audit.NewConfig = map[string]string{rule.Name: ruleJSON(rule)}
+	result.Set(1, 1).Response(w)
+}
+
+// handleDeleteRule removes the rule named by the name query parameter
+func (s *RoutineScheduler[TConfig, TOutput]) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	result := NewHandleResult(0, "Failed to delete rule")
+	audit := auditFrom(r)
+	for _, existing := range s.Rules() {
+		if existing.Name == name {
+			audit.OldConfig = map[string]string{name: ruleJSON(existing.Rule)}
+		}
+	}
+	if !s.DeleteRule(name) {
+		result.SetError(fmt.Errorf("rule %s not found", name)).Status(http.StatusNotFound).Response(w)
+		return
+	}
+	result.Set(1, 1).Response(w)
+}
+
+func ruleJSON(rule Rule) string {
+	data, _ := json.Marshal(rule)
+	return string(data)
+}
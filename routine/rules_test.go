@@ -0,0 +1,192 @@
+package routine
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestRule(times int, window time.Duration, scope string) *compiledRule[int] {
+	return &compiledRule[int]{
+		Rule:    Rule{Name: "test", Times: times, Scope: scope},
+		window:  window,
+		hits:    make(map[string][]time.Time),
+		latched: make(map[string]bool),
+		holding: make(map[string]bool),
+	}
+}
+
+// observation is one evaluation of a rule: the routine, whether the condition
+// held, the time since the start of the test and whether the rule should fire
+type observation struct {
+	id    string
+	held  bool
+	at    time.Duration
+	fires bool
+}
+
+func TestRuleObserve(t *testing.T) {
+	tests := []struct {
+		name         string
+		times        int
+		window       time.Duration
+		scope        string
+		observations []observation
+	}{
+		{
+			name: "fires once until the condition is false",
+			observations: []observation{
+				{"r1", true, 0, true},
+				{"r1", true, time.Second, false},
+				{"r1", false, 2 * time.Second, false},
+				{"r1", true, 3 * time.Second, true},
+			},
+		},
+		{
+			name:   "3 hits within 5m",
+			times:  3,
+			window: 5 * time.Minute,
+			observations: []observation{
+				{"r1", true, 0, false},
+				{"r1", true, time.Minute, false},
+				{"r1", true, 2 * time.Minute, true},
+			},
+		},
+		{
+			name:   "hits older than the window expire",
+			times:  3,
+			window: 5 * time.Minute,
+			observations: []observation{
+				{"r1", true, 0, false},
+				{"r1", true, 4 * time.Minute, false},
+				{"r1", true, 6 * time.Minute, false}, // The first hit expired
+				{"r1", true, 7 * time.Minute, true},
+			},
+		},
+		{
+			name:  "false evaluations between hits do not reset the count",
+			times: 2,
+			observations: []observation{
+				{"r1", true, 0, false},
+				{"r1", false, time.Second, false},
+				{"r1", true, 2 * time.Second, true},
+			},
+		},
+		{
+			name:  "the count starts over after firing",
+			times: 2,
+			observations: []observation{
+				{"r1", true, 0, false},
+				{"r1", true, time.Second, true},
+				{"r1", false, 2 * time.Second, false},
+				{"r1", true, 3 * time.Second, false},
+				{"r1", true, 4 * time.Second, true},
+			},
+		},
+		{
+			name:  "routines are counted on their own",
+			times: 2,
+			observations: []observation{
+				{"r1", true, 0, false},
+				{"r2", true, time.Second, false},
+				{"r1", true, 2 * time.Second, true},
+				{"r2", true, 3 * time.Second, true},
+			},
+		},
+		{
+			name:  "a group counts its routines together",
+			times: 2,
+			scope: ScopeGroup,
+			observations: []observation{
+				{"r1", true, 0, false},
+				{"r2", true, time.Second, true},
+				{"r1", true, 2 * time.Second, false},
+			},
+		},
+		{
+			name:  "a group stays latched while any routine holds the condition",
+			scope: ScopeGroup,
+			observations: []observation{
+				{"r1", true, 0, true},
+				{"r2", true, time.Second, false},
+				{"r1", false, 2 * time.Second, false},
+				{"r1", true, 3 * time.Second, false}, // r2 still holds it
+				{"r1", false, 4 * time.Second, false},
+				{"r2", false, 5 * time.Second, false},
+				{"r2", true, 6 * time.Second, true},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := newTestRule(test.times, test.window, test.scope)
+			start := time.Now()
+			for i, o := range test.observations {
+				if got := rule.observe(o.id, o.held, nil, start.Add(o.at)); got != o.fires {
+					t.Fatalf("observation %d (%s held=%v at %v): fired %v, want %v", i, o.id, o.held, o.at, got, o.fires)
+				}
+			}
+		})
+	}
+}
+
+func TestRuleForget(t *testing.T) {
+	now := time.Now()
+	t.Run("a routine that ended does not keep the group latched", func(t *testing.T) {
+		rule := newTestRule(0, 0, ScopeGroup)
+		if !rule.observe("r1", true, nil, now) {
+			t.Fatal("first hit should fire")
+		}
+		rule.observe("r2", true, nil, now)
+		// r2 ends while holding the condition
+		rule.forget("r2")
+		rule.observe("r1", false, nil, now)
+		if !rule.observe("r1", true, nil, now) {
+			t.Error("the group should fire again once no live routine holds the condition")
+		}
+	})
+	t.Run("the last holder ending releases the group", func(t *testing.T) {
+		rule := newTestRule(0, 0, ScopeGroup)
+		rule.observe("r1", true, nil, now)
+		rule.forget("r1")
+		if !rule.observe("r2", true, nil, now) {
+			t.Error("the group stayed latched after its only holder ended")
+		}
+	})
+	t.Run("a reused routine ID starts afresh", func(t *testing.T) {
+		rule := newTestRule(2, 0, "")
+		rule.observe("r1", true, nil, now)
+		if !rule.observe("r1", true, nil, now) {
+			t.Fatal("second hit should fire")
+		}
+		rule.observe("r2", true, nil, now)
+		rule.forget("r1")
+		rule.forget("r2")
+		if len(rule.hits) != 0 || len(rule.latched) != 0 {
+			t.Errorf("state left behind: hits %v, latched %v", rule.hits, rule.latched)
+		}
+		if rule.observe("r1", true, nil, now) {
+			t.Error("a new routine with the ID fired on its first hit")
+		}
+		if !rule.observe("r1", true, nil, now) {
+			t.Error("a new routine with the ID started latched")
+		}
+	})
+}
+
+func TestRuleObserveError(t *testing.T) {
+	rule := newTestRule(0, 0, "")
+	now := time.Now()
+	if rule.observe("r1", true, errors.New("cannot compare"), now) {
+		t.Error("an evaluation error must not fire the rule")
+	}
+	if status := rule.snapshot(); status.LastError != "cannot compare" || status.Fired != 0 {
+		t.Errorf("status = %+v, want the error recorded and nothing fired", status)
+	}
+	if !rule.observe("r1", true, nil, now) {
+		t.Error("the rule should fire after the error")
+	}
+	if status := rule.snapshot(); status.Fired != 1 || status.LastFired == nil || !status.LastFired.Equal(now) {
+		t.Errorf("status = %+v, want one firing at %v", status, now)
+	}
+}
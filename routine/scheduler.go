@@ -3,9 +3,14 @@ package routine
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"runtime/debug"
+	"slices"
 	"sync"
+	"text/template"
+	"time"
 )
 
 // RoutineScheduler manages the creation, execution, and termination of routines
@@ -13,10 +18,70 @@ import (
 // TOutput, the type of its result.
 type RoutineScheduler[TConfig, TOutput any] struct {
 	Port int
+	// Server controls the bind address, TLS and HTTP/2
+	Server ServerOptions
+	// AssetsDir serves the dashboard from disk instead of the embedded copy, for live editing
+	AssetsDir string
 	// Routine is the stateless routine definition to use for all instances
 	Routine *Routine[TConfig, TOutput]
 	// InteractiveMode indicates whether the application is running in interactive mode
 	InteractiveMode bool
+	// Audit records control-plane actions; nil disables auditing
+	Audit *AuditLog
+	// Auth authenticates callers of the control API; nil disables authentication
+	Auth Authenticator
+	// Policy decides what authenticated callers may do; nil lets every caller do everything
+	Policy *Policy
+	// IDTemplate builds routine IDs from IdentityData; nil uses Routine.GenIdentity as is
+	IDTemplate *template.Template
+	// IdempotencyWindow is how long /start results are replayed for a repeated Idempotency-Key;
+	// 0 means DefaultIdempotencyWindow
+	IdempotencyWindow time.Duration
+
+	// Mode selects per-routine goroutines (the default) or a shared worker pool
+	Mode ExecutionMode
+	// Workers sizes the pool in ExecPool mode; 0 means GOMAXPROCS
+	Workers int
+	// Interval is the pause between two iterations of a routine, in either mode
+	Interval time.Duration
+	// Retention is how long tombstones of finished routines are kept; 0 means DefaultRetention
+	Retention time.Duration
+	// MaxTombstones bounds the number of tombstones, dropping the oldest; 0 means DefaultMaxTombstones
+	MaxTombstones int
+	// Notifier delivers the notify action of rules; nil logs notifications
+	Notifier Notifier
+	// Election lets only one replica run routines; nil runs them on this one
+	Election *Election
+
+	idempotency idempotencyCache
+	tombstones  tombstoneStore[TConfig, TOutput]
+	rules       ruleSet[TConfig]
+	poolOnce    sync.Once
+	workers     *workerPool
+}
+
+// StartOptions holds per-instance settings given when a routine is started
+type StartOptions struct {
+	// Tags scope which callers may operate on the routine
+	Tags []string
+	// Actor is recorded as the author of the first config version; empty means SystemActor
+	Actor string
+	// Labels group the routine for selectors and can be changed later with LabelRoutines
+	Labels Labels
+	// Name is used as the routine ID instead of a generated one; a taken name fails with ErrIDConflict
+	Name string
+	// RateLimit throttles the routine's own iterations; nil means only shared limits apply
+	RateLimit *RateLimit
+	// Priority orders the routine when routines wait for a slot or a pool worker; higher goes first
+	Priority int
+	// Bounds make the routine complete after a number of iterations or at a time
+	Bounds RunBounds
+	// StartAt delays the routine: it is scheduled until then and admitted afterwards
+	StartAt time.Time
+	// DependsOn holds the routine back until other routines of this scheduler reach a state
+	DependsOn []Dependency
+	// ConfigTemplate renders the config from DependencyData once the dependencies are met
+	ConfigTemplate *template.Template
 }
 
 func (s *RoutineScheduler[TConfig, TOutput]) StopRoutines(ids []string) (int, error) {
@@ -38,6 +103,18 @@ func (s *RoutineScheduler[TConfig, TOutput]) StopRoutines(ids []string) (int, er
 }
 
 func (s *RoutineScheduler[TConfig, TOutput]) UpdateRoutineConfig(ids []string, newConfig TConfig) (int, error) {
+	return s.updateRoutineConfig(SystemActor, nil, ids, newConfig)
+}
+
+// UpdateRoutineConfigIfMatch is UpdateRoutineConfig with optimistic concurrency:
+// routines whose config moved past the expected revision are left unchanged and
+// reported as *ConflictError values joined into the returned error.
+func (s *RoutineScheduler[TConfig, TOutput]) UpdateRoutineConfigIfMatch(ids []string, newConfig TConfig, expected Revisions) (int, error) {
+	return s.updateRoutineConfig(SystemActor, expected, ids, newConfig)
+}
+
+// updateRoutineConfig replaces the config of each routine, recording actor as the author
+func (s *RoutineScheduler[TConfig, TOutput]) updateRoutineConfig(actor string, expected Revisions, ids []string, newConfig TConfig) (int, error) {
 	var err error
 	updated := 0
 	for _, id := range ids {
@@ -46,14 +123,20 @@ func (s *RoutineScheduler[TConfig, TOutput]) UpdateRoutineConfig(ids []string, n
 			ctrl, ok := val.(*RoutineControl[TConfig, TOutput])
 
 			if !ok {
-				err = fmt.Errorf("could not convert routine %s to expected type", id)
+				err = errors.Join(err, fmt.Errorf("could not convert routine %s to expected type", id))
 				continue
+			} else if errStore := ctrl.storeConfigIf(newConfig, expected[id], actor, "update-config"); errStore != nil {
+				var conflict *ConflictError
+				if errors.As(errStore, &conflict) {
+					conflict.ID = id
+				}
+				err = errors.Join(err, errStore)
 			} else {
-				ctrl.Config.Store(newConfig)
+				ctrl.history.event("", "config-updated", s.Routine.SerializeConfig(newConfig))
 				updated++
 			}
 		} else {
-			err = fmt.Errorf("routine %s not found", id)
+			err = errors.Join(err, fmt.Errorf("routine %s not found", id))
 		}
 	}
 	return updated, err
@@ -64,6 +147,7 @@ func (s *RoutineScheduler[TConfig, TOutput]) UpdateRoutineConfig(ids []string, n
 func NewRoutineScheduler[TConfig, TOutput any](port int, routine *Routine[TConfig, TOutput], interactiveMode bool) *RoutineScheduler[TConfig, TOutput] {
 	return &RoutineScheduler[TConfig, TOutput]{
 		Port:            port,
+		Server:          ServerOptions{HTTP2: true},
 		Routine:         routine,
 		InteractiveMode: interactiveMode,
 	}
@@ -76,44 +160,294 @@ var (
 
 // startRoutineWithConfig creates and starts a new routine with the given ID and config
 func (s *RoutineScheduler[TConfig, TOutput]) StartRoutineWithConfig(config TConfig) (string, error) {
-	// Use the routine instance from the scheduler
-	routine := s.Routine
-	id := routine.GenIdentity(config)
+	return s.StartRoutineWithOptions(config, StartOptions{})
+}
 
+// StartRoutineWithOptions creates and starts a new routine with the given config and options
+func (s *RoutineScheduler[TConfig, TOutput]) StartRoutineWithOptions(config TConfig, opts StartOptions) (string, error) {
+	if !s.Leading() {
+		return "", ErrNotLeader
+	}
 	// Initialize the control with the config and default output
 	ctrl := NewRoutineControl(config, *new(TOutput)) // Zero value for TOutput
-
-	// Store the control in the map
-	routineMap.Store(id, ctrl)
+	ctrl.Tags = opts.Tags
+	if err := ValidateLabels(opts.Labels); err != nil {
+		return "", err
+	}
+	ctrl.labels.Store(copyLabels(opts.Labels))
+	if err := validatePriority(opts.Priority); err != nil {
+		return "", err
+	}
+	ctrl.priority.Store(int64(opts.Priority))
+	if err := opts.Bounds.validate(); err != nil {
+		return "", err
+	}
+	ctrl.bounds = runBounds{RunBounds: opts.Bounds}
+	ctrl.startAt = opts.StartAt
+	if err := s.checkDependencies(opts.DependsOn); err != nil {
+		return "", err
+	}
+	ctrl.dependsOn = opts.DependsOn
+	if opts.RateLimit != nil {
+		if err := opts.RateLimit.validate(); err != nil {
+			return "", err
+		}
+		ctrl.setRateLimit(opts.RateLimit)
+	}
+	if opts.Actor == "" {
+		opts.Actor = SystemActor
+	}
+	ctrl.storeConfig(config, opts.Actor, "start")
 
 	// Create context and channels
 	ctx, cancel := context.WithCancel(context.Background())
-	ctrl.Cancel = cancel
 	done := make(chan struct{})
 	ctrl.Done = done
 
-	go func() {
-		defer close(done)
-		// Make sure to remove the routine from the map when the goroutine exits
-		defer routineMap.Delete(id)
+	// ready holds back a routine admitted from the queue until it is fully set up here
+	ready := make(chan struct{})
+	var id string
+	ctrl.ticket = newAdmissionTicket(s.routineType(), ctrl.Priority, func() {
+		go func() {
+			<-ready
+			ctrl.history.event(StateRunning, "admitted", "")
+			s.launch(ctx, id, ctrl, done)
+		}()
+	})
+	defer close(ready)
 
-		for {
+	// The routine can be stopped by ID as soon as it is claimed, before it knows
+	// how; a stop that comes in first cancels it and is repeated once it does
+	var stopMu sync.Mutex
+	var stop context.CancelFunc
+	stopped := false
+	ctrl.Cancel = func() {
+		stopMu.Lock()
+		defer stopMu.Unlock()
+		stopped = true
+		if stop != nil {
+			stop()
+			return
+		}
+		cancel()
+	}
+	setStop := func(f context.CancelFunc) {
+		stopMu.Lock()
+		defer stopMu.Unlock()
+		stop = f
+		if stopped {
+			f()
+		}
+	}
+
+	// Store the control in the map under an ID no other routine holds
+	id, err := s.claimID(ctrl, config, opts)
+	if err != nil {
+		cancel()
+		return "", err
+	}
+
+	if len(opts.DependsOn) > 0 {
+		// The ID is only known now; a routine replacing a finished one of the same name cannot wait for itself
+		if slices.ContainsFunc(opts.DependsOn, func(dep Dependency) bool { return dep.ID == id }) {
+			cancel()
+			routineMap.Delete(id)
+			return "", fmt.Errorf("routine %s cannot depend on itself", id)
+		}
+		setStop(s.await(ctx, cancel, id, ctrl, done, ready, opts))
+		return id, nil
+	}
+	if opts.StartAt.After(time.Now()) {
+		setStop(s.schedule(ctx, cancel, id, ctrl, done, ready, opts.StartAt))
+		return id, nil
+	}
+	admitted, err := s.admit(ctx, cancel, id, ctrl, done)
+	if err != nil {
+		routineMap.Delete(id)
+		return "", err
+	}
+	setStop(admitted)
+	return id, nil
+}
+
+// admit takes a running slot and launches the routine, or queues it for one.
+// It returns the function that stops the routine.
+func (s *RoutineScheduler[TConfig, TOutput]) admit(ctx context.Context, cancel context.CancelFunc, id string, ctrl *RoutineControl[TConfig, TOutput], done chan struct{}) (context.CancelFunc, error) {
+	config := s.Routine.SerializeConfig(ctrl.Config.Load().(TConfig))
+	queued, err := admission.acquire(ctrl.ticket)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if !queued {
+		ctrl.history.event(StateRunning, "started", config)
+		s.launch(ctx, id, ctrl, done)
+		return cancel, nil
+	}
+
+	// A pending routine has no goroutine yet, so stopping it must leave the queue and clean up here
+	var stopPending sync.Once
+	stop := func() {
+		cancel()
+		if admission.withdraw(ctrl.ticket) {
+			stopPending.Do(func() { s.discard(id, ctrl, done, nil) })
+		}
+	}
+	ctrl.history.event(StatePending, "queued", config)
+	return stop, nil
+}
+
+// schedule holds a routine until at and then admits it like a fresh start.
+// It returns the function that stops the routine, cancelling the timer before then.
+func (s *RoutineScheduler[TConfig, TOutput]) schedule(ctx context.Context, cancel context.CancelFunc, id string, ctrl *RoutineControl[TConfig, TOutput], done chan struct{}, ready <-chan struct{}, at time.Time) context.CancelFunc {
+	var mu sync.Mutex
+	var stop context.CancelFunc // Set once the routine is admitted
+	var discard sync.Once
+	// Recorded first, as the timer may fire at once when the routine was held by dependencies
+	ctrl.history.event(StateScheduled, "scheduled", at.Format(time.RFC3339))
+	timer := time.AfterFunc(time.Until(at), func() {
+		<-ready
+		mu.Lock()
+		defer mu.Unlock()
+		if ctx.Err() != nil {
+			discard.Do(func() { s.discard(id, ctrl, done, nil) })
+			return
+		}
+		var err error
+		if stop, err = s.admit(ctx, cancel, id, ctrl, done); err != nil {
+			log.Printf("scheduled routine %s could not start: %v", id, err)
+			discard.Do(func() { s.discard(id, ctrl, done, err) })
+		}
+	})
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if stop != nil {
+			stop()
+			return
+		}
+		cancel()
+		if timer.Stop() {
+			discard.Do(func() { s.discard(id, ctrl, done, nil) })
+		}
+	}
+}
+
+// discard ends a routine that never started running: stopped when err is nil, failed otherwise
+func (s *RoutineScheduler[TConfig, TOutput]) discard(id string, ctrl *RoutineControl[TConfig, TOutput], done chan struct{}, err error) {
+	if err == nil {
+		ctrl.history.event(StateStopped, "stopped", "")
+		ctrl.markFirstIteration(errStoppedBeforeFirstIteration)
+		s.bury(id, ctrl, ExitStopped)
+	} else {
+		ctrl.history.failure(err)
+		ctrl.history.event(StateFailed, "failed", err.Error())
+		ctrl.markFirstIteration(err)
+		s.bury(id, ctrl, ExitFailed)
+	}
+	routineMap.Delete(id)
+	close(done)
+}
+
+// run executes the routine's iterations on its own goroutine until it is stopped or fails,
+// pausing between them for Interval and rate limits
+func (s *RoutineScheduler[TConfig, TOutput]) run(ctx context.Context, id string, ctrl *RoutineControl[TConfig, TOutput], done chan struct{}) {
+	for wait := s.throttle(ctrl, 0); ; wait = s.throttle(ctrl, s.Interval) {
+		if wait > 0 {
 			select {
 			case <-ctx.Done():
-				return
-			default:
-				// Execute the routine job and update the output
-				newOutput, err := routine.Job(ctrl)
-				if err != nil {
-					log.Printf("job runtime error: %v", err)
-					return
-				} else {
-					ctrl.Output.Store(newOutput)
-				}
+			case <-time.After(wait):
+			}
+		}
+		if !s.step(ctx, id, ctrl, done) {
+			return
+		}
+	}
+}
+
+// step runs one iteration of a routine and reports whether it should run again.
+// When the routine is stopped, fails or completes, step records why and releases it.
+func (s *RoutineScheduler[TConfig, TOutput]) step(ctx context.Context, id string, ctrl *RoutineControl[TConfig, TOutput], done chan struct{}) bool {
+	var completed string
+	reason := ExitStopped
+	select {
+	case <-ctx.Done():
+		ctrl.history.event(StateStopped, "stopped", "")
+		ctrl.markFirstIteration(errStoppedBeforeFirstIteration)
+	default:
+		if completed = ctrl.bounds.reached(time.Now(), ctrl.history.iterationCount()); completed != "" {
+			ctrl.markFirstIteration(errCompletedBeforeFirstIteration)
+			break
+		}
+		// Execute the routine job and update the output
+		err := s.runIteration(ctrl)
+		s.evaluateRules(id, ctrl, err)
+		if err == nil || errors.Is(err, ErrDone) {
+			ctrl.markFirstIteration(nil)
+			if err != nil {
+				completed = CompletedDone
+			} else if completed = ctrl.bounds.reached(time.Now(), ctrl.history.iterationCount()); completed == "" {
+				return true
 			}
+			break
+		}
+		log.Printf("job runtime error: %v", err)
+		ctrl.history.failure(err)
+		ctrl.history.event(StateFailed, "failed", err.Error())
+		ctrl.markFirstIteration(err)
+		reason = ExitFailed
+	}
+
+	admission.release(ctrl.ticket)
+	if completed != "" {
+		ctrl.history.event(StateCompleted, "completed", completed)
+		reason = completed
+	}
+	// The routine leaves the map when it ends and is kept as a tombstone
+	s.bury(id, ctrl, reason)
+	routineMap.Delete(id)
+	close(done)
+	return false
+}
+
+// runIteration runs the job once, storing its output and timing.
+// A panicking job is recovered and reported as a *PanicError.
+func (s *RoutineScheduler[TConfig, TOutput]) runIteration(ctrl *RoutineControl[TConfig, TOutput]) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
 		}
 	}()
-	return id, nil
+
+	start := time.Now()
+	newOutput, err := s.Routine.Job(ctrl)
+	if err != nil && !errors.Is(err, ErrDone) {
+		return err
+	}
+	ctrl.Output.Store(newOutput)
+	ctrl.history.iteration(time.Since(start), numericValues(newOutput))
+	return err
+}
+
+var errStoppedBeforeFirstIteration = errors.New("routine stopped before its first iteration")
+
+// WaitFirstOutput blocks until the routine has completed its first iteration and returns that output.
+// It fails with the job's error if the first iteration failed, or with ctx's error on timeout.
+func (s *RoutineScheduler[TConfig, TOutput]) WaitFirstOutput(ctx context.Context, id string) (TOutput, error) {
+	var zero TOutput
+	ctrl, err := s.loadControl(id)
+	if err != nil {
+		return zero, err
+	}
+	select {
+	case <-ctrl.firstIteration:
+	case <-ctx.Done():
+		return zero, fmt.Errorf("routine %s: waiting for the first iteration: %w", id, ctx.Err())
+	}
+	if ctrl.firstErr != nil {
+		return zero, fmt.Errorf("routine %s: first iteration failed: %w", id, ctrl.firstErr)
+	}
+	return ctrl.firstOutput.(TOutput), nil
 }
 
 // stopRoutine stops a running routine with the given ID
@@ -130,8 +464,26 @@ func (s *RoutineScheduler[TConfig, TOutput]) StopRoutine(id string) error {
 	return nil
 }
 
+// ErrNotAdmitted is returned when suspending or resuming a routine that still
+// waits for its dependencies, its start time or admission
+var ErrNotAdmitted = errors.New("routine has not been admitted yet")
+
+// admittedCheck refuses routines that are not running yet, so a suspend or
+// resume never overwrites the state they wait in
+func admittedCheck(id string, state RoutineState) error {
+	switch state {
+	case StatePending, StateScheduled, StateWaiting:
+		return fmt.Errorf("%w: routine %s is %s", ErrNotAdmitted, id, state)
+	}
+	return nil
+}
+
 // SuspendRoutine suspends a running routine with the given ID
 func (s *RoutineScheduler[TConfig, TOutput]) SuspendRoutine(id string) error {
+	return s.suspendRoutine(SystemActor, id)
+}
+
+func (s *RoutineScheduler[TConfig, TOutput]) suspendRoutine(actor, id string) error {
 	if val, ok := routineMap.Load(id); ok {
 		// Type assertion to get the control object
 		ctrl, ok := val.(*RoutineControl[TConfig, TOutput])
@@ -139,10 +491,14 @@ func (s *RoutineScheduler[TConfig, TOutput]) SuspendRoutine(id string) error {
 			return fmt.Errorf("could not convert routine %s to expected type", id)
 		}
 
+		if err := admittedCheck(id, ctrl.State()); err != nil {
+			return err
+		}
 		// Call the routine's suspend function if available
 		if s.Routine.Suspend != nil {
-			s.Routine.Suspend(ctrl)
+			ctrl.changeConfig(actor, "suspend", func() { s.Routine.Suspend(ctrl) })
 		}
+		ctrl.history.event(StateSuspended, "suspended", "")
 		return nil
 	}
 	return fmt.Errorf("routine %s not found", id)
@@ -150,6 +506,10 @@ func (s *RoutineScheduler[TConfig, TOutput]) SuspendRoutine(id string) error {
 
 // ResumeRoutine resumes a suspended routine with the given ID
 func (s *RoutineScheduler[TConfig, TOutput]) ResumeRoutine(id string) error {
+	return s.resumeRoutine(SystemActor, id)
+}
+
+func (s *RoutineScheduler[TConfig, TOutput]) resumeRoutine(actor, id string) error {
 	if val, ok := routineMap.Load(id); ok {
 		// Type assertion to get the control object
 		ctrl, ok := val.(*RoutineControl[TConfig, TOutput])
@@ -157,10 +517,14 @@ func (s *RoutineScheduler[TConfig, TOutput]) ResumeRoutine(id string) error {
 			return fmt.Errorf("could not convert routine %s to expected type", id)
 		}
 
+		if err := admittedCheck(id, ctrl.State()); err != nil {
+			return err
+		}
 		// Call the routine's resume function if available
 		if s.Routine.Resume != nil {
-			s.Routine.Resume(ctrl)
+			ctrl.changeConfig(actor, "resume", func() { s.Routine.Resume(ctrl) })
 		}
+		ctrl.history.event(StateRunning, "resumed", "")
 		return nil
 	}
 	return fmt.Errorf("routine %s not found", id)
@@ -168,12 +532,16 @@ func (s *RoutineScheduler[TConfig, TOutput]) ResumeRoutine(id string) error {
 
 // SuspendRoutines suspends multiple routines with the given IDs
 func (s *RoutineScheduler[TConfig, TOutput]) SuspendRoutines(ids []string) (int, error) {
+	return s.suspendRoutines(SystemActor, ids)
+}
+
+func (s *RoutineScheduler[TConfig, TOutput]) suspendRoutines(actor string, ids []string) (int, error) {
 	suspended := 0
 	var err error
 	for _, id := range ids {
-		errSuspend := s.SuspendRoutine(id)
+		errSuspend := s.suspendRoutine(actor, id)
 		if errSuspend != nil {
-			err = errSuspend
+			err = errors.Join(err, errSuspend)
 			continue
 		}
 		suspended++
@@ -183,12 +551,16 @@ func (s *RoutineScheduler[TConfig, TOutput]) SuspendRoutines(ids []string) (int,
 
 // ResumeRoutines resumes multiple routines with the given IDs
 func (s *RoutineScheduler[TConfig, TOutput]) ResumeRoutines(ids []string) (int, error) {
+	return s.resumeRoutines(SystemActor, ids)
+}
+
+func (s *RoutineScheduler[TConfig, TOutput]) resumeRoutines(actor string, ids []string) (int, error) {
 	resumed := 0
 	var err error
 	for _, id := range ids {
-		errResume := s.ResumeRoutine(id)
+		errResume := s.resumeRoutine(actor, id)
 		if errResume != nil {
-			err = errResume
+			err = errors.Join(err, errResume)
 			continue
 		}
 		resumed++
@@ -0,0 +1,92 @@
+package routine
+
+import (
+	"encoding/json"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Value int `json:"value"`
+}
+
+// newTestScheduler returns a scheduler running job, and stops every routine it
+// started when the test ends
+func newTestScheduler(t *testing.T, job RoutineJob[*testConfig, int]) *RoutineScheduler[*testConfig, int] {
+	t.Helper()
+	s := NewRoutineScheduler(0, &Routine[*testConfig, int]{
+		Type:            "test",
+		Job:             job,
+		GenIdentity:     ULIDIdentity[*testConfig]("test-"),
+		SerializeConfig: func(config *testConfig) string { data, _ := json.Marshal(config); return string(data) },
+		DeserializeConfig: func(data string) (*testConfig, error) {
+			var config testConfig
+			return &config, json.Unmarshal([]byte(data), &config)
+		},
+		SerializeOutput: func(output int) string { return strconv.Itoa(output) },
+	}, false)
+	s.Interval = time.Millisecond
+	t.Cleanup(func() {
+		routineMap.Range(func(key, val any) bool {
+			if ctrl, ok := val.(*RoutineControl[*testConfig, int]); ok {
+				ctrl.Cancel()
+				<-ctrl.Done
+			}
+			return true
+		})
+	})
+	return s
+}
+
+// waitDone fails the test unless the routine ends in time
+func waitDone(t *testing.T, ctrl *RoutineControl[*testConfig, int]) {
+	t.Helper()
+	select {
+	case <-ctrl.Done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the routine is still %s", ctrl.State())
+	}
+}
+
+func TestStopWhileStarting(t *testing.T) {
+	tests := []struct {
+		name string
+		opts StartOptions
+	}{
+		{"admitted", StartOptions{Name: "racer"}},
+		{"scheduled", StartOptions{Name: "racer", StartAt: time.Now().Add(time.Hour)}},
+		{"waiting", StartOptions{Name: "racer", DependsOn: []Dependency{{ID: "upstream"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+			if len(test.opts.DependsOn) > 0 {
+				if _, err := s.StartRoutineWithOptions(&testConfig{}, StartOptions{Name: "upstream", StartAt: time.Now().Add(time.Hour)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Stop the routine the moment it can be found, while it is still being set up
+			found := make(chan *RoutineControl[*testConfig, int])
+			go func() {
+				for {
+					if ctrl, err := s.loadControl("racer"); err == nil {
+						ctrl.Cancel()
+						found <- ctrl
+						return
+					}
+					runtime.Gosched()
+				}
+			}()
+			if _, err := s.StartRoutineWithOptions(&testConfig{}, test.opts); err != nil {
+				t.Fatal(err)
+			}
+			ctrl := <-found
+			waitDone(t, ctrl)
+			if state := ctrl.State(); state != StateStopped {
+				t.Errorf("state %s, want %s", state, StateStopped)
+			}
+		})
+	}
+}
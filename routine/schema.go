@@ -0,0 +1,200 @@
+package routine
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONSchema is the subset of JSON Schema derived from config types
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	PropertyOrder        []string               `json:"x-order,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	AdditionalProperties *JSONSchema            `json:"additionalProperties,omitempty"`
+	Enum                 []any                  `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// SchemaFor derives a JSON Schema for T from its struct fields and tags.
+//
+// Field names follow the `json` tag. A `validate` tag adds constraints:
+// required, min=N, max=N and oneof=a b c (or enum=a|b|c). Numbers get
+// minimum/maximum, strings minLength/maxLength and slices minItems/maxItems.
+// A `description` tag is copied into the schema.
+func SchemaFor[T any]() *JSONSchema {
+	schema := schemaForType(reflect.TypeOf((*T)(nil)).Elem(), map[reflect.Type]bool{})
+	schema.Schema = "https://json-schema.org/draft/2020-12/schema"
+	return schema
+}
+
+func schemaForType(t reflect.Type, seen map[reflect.Type]bool) *JSONSchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &JSONSchema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return &JSONSchema{Type: "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case t.Kind() == reflect.String:
+		return &JSONSchema{Type: "string"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json writes byte slices as base64 strings
+			return &JSONSchema{Type: "string", Format: "byte"}
+		}
+		return &JSONSchema{Type: "array", Items: schemaForType(t.Elem(), seen)}
+	case t.Kind() == reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: schemaForType(t.Elem(), seen)}
+	case t.Kind() == reflect.Struct:
+		if seen[t] {
+			// Recursive types are left open rather than expanded forever
+			return &JSONSchema{Type: "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		schema := &JSONSchema{Type: "object", Title: t.Name(), Properties: map[string]*JSONSchema{}}
+		addStructFields(schema, t, seen)
+		return schema
+	}
+	// Interfaces and anything else accept any JSON value
+	return &JSONSchema{}
+}
+
+// addStructFields adds the exported fields of t, flattening embedded structs like encoding/json does
+func addStructFields(schema *JSONSchema, t reflect.Type, seen map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := jsonFieldName(field)
+		if !ok {
+			continue
+		}
+
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && fieldType.Kind() == reflect.Struct && field.Tag.Get("json") == "" {
+			addStructFields(schema, fieldType, seen)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		property := schemaForType(field.Type, seen)
+		property.Description = field.Tag.Get("description")
+		if applyValidateTag(property, field.Tag.Get("validate")) {
+			schema.Required = append(schema.Required, name)
+		}
+		schema.Properties[name] = property
+		schema.PropertyOrder = append(schema.PropertyOrder, name)
+	}
+}
+
+// jsonFieldName returns the JSON name of a field, or false if encoding/json skips it
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	if !field.IsExported() && !field.Anonymous {
+		return "", false
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name, true
+}
+
+// applyValidateTag adds constraints from a validate tag and reports whether the field is required
+func applyValidateTag(schema *JSONSchema, tag string) bool {
+	required := false
+	for _, rule := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch key {
+		case "required":
+			required = true
+		case "min", "max":
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			setBound(schema, key == "min", number)
+		case "oneof", "enum":
+			schema.Enum = enumValues(schema.Type, value)
+		}
+	}
+	return required
+}
+
+// setBound applies min/max to the keyword matching the schema type
+func setBound(schema *JSONSchema, isMin bool, number float64) {
+	count := int(number)
+	switch schema.Type {
+	case "string":
+		if isMin {
+			schema.MinLength = &count
+		} else {
+			schema.MaxLength = &count
+		}
+	case "array":
+		if isMin {
+			schema.MinItems = &count
+		} else {
+			schema.MaxItems = &count
+		}
+	default:
+		if isMin {
+			schema.Minimum = &number
+		} else {
+			schema.Maximum = &number
+		}
+	}
+}
+
+// enumValues splits an enum list on spaces or | and converts items to the schema type
+func enumValues(schemaType, list string) []any {
+	var values []any
+	for _, item := range strings.FieldsFunc(list, func(r rune) bool { return r == ' ' || r == '|' }) {
+		switch schemaType {
+		case "integer", "number":
+			if number, err := strconv.ParseFloat(item, 64); err == nil {
+				values = append(values, number)
+			}
+		default:
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+// handleConfigSchema returns the JSON Schema of the routine's config type
+func (s *RoutineScheduler[TConfig, TOutput]) handleConfigSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	_ = json.NewEncoder(w).Encode(SchemaFor[TConfig]())
+}
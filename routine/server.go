@@ -0,0 +1,253 @@
+package routine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ServerOptions controls where and how Serve listens
+type ServerOptions struct {
+	// Addr is the host or IP to bind; empty binds every interface
+	Addr string `json:"addr"`
+	// UnixSocket, when set, listens on a Unix domain socket instead of TCP
+	UnixSocket string `json:"unix_socket"`
+	// TLSCert and TLSKey are PEM files; they are reloaded when they change on disk
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// DevCert serves TLS with a self-signed certificate generated at startup
+	DevCert bool `json:"dev_cert"`
+	// HTTP2 enables HTTP/2, negotiated over TLS or as h2c on cleartext connections
+	HTTP2 bool `json:"http2"`
+	// ClientCAs verifies client certificates for mTLS authentication
+	ClientCAs *x509.CertPool `json:"-"`
+}
+
+// LoadServerOptions reads ServerOptions from a JSON file
+func LoadServerOptions(path string) (*ServerOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// HTTP/2 stays on unless the file turns it off
+	opts := &ServerOptions{HTTP2: true}
+	if err := json.Unmarshal(data, opts); err != nil {
+		return nil, fmt.Errorf("invalid server config %s: %v", path, err)
+	}
+	return opts, nil
+}
+
+// UseTLS reports whether the server should speak TLS
+func (o *ServerOptions) UseTLS() bool {
+	return o.DevCert || o.TLSCert != "" || o.TLSKey != ""
+}
+
+// listen opens the listener described by the options
+func (s *RoutineScheduler[TConfig, TOutput]) listen() (net.Listener, error) {
+	opts := &s.Server
+	if opts.UnixSocket == "" {
+		return net.Listen("tcp", net.JoinHostPort(opts.Addr, strconv.Itoa(s.Port)))
+	}
+
+	// Remove a socket left behind by a previous run, but never a regular file
+	if info, err := os.Lstat(opts.UnixSocket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", opts.UnixSocket)
+		}
+		if err := os.Remove(opts.UnixSocket); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", opts.UnixSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(opts.UnixSocket, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// newServer builds the http.Server for the handler according to the options
+func (s *RoutineScheduler[TConfig, TOutput]) newServer(handler http.Handler) (*http.Server, error) {
+	opts := &s.Server
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		Protocols:         new(http.Protocols),
+	}
+	server.Protocols.SetHTTP1(true)
+
+	if !opts.UseTLS() {
+		// Client certificates only exist over TLS, so mTLS callers could never authenticate
+		if opts.ClientCAs != nil {
+			return nil, errors.New("client CAs need TLS: set a certificate and key or dev_cert")
+		}
+		server.Protocols.SetUnencryptedHTTP2(opts.HTTP2)
+		return server, nil
+	}
+	server.Protocols.SetHTTP2(opts.HTTP2)
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.ClientCAs != nil {
+		// Certificates are optional so token and password callers can still connect
+		tlsConfig.ClientCAs = opts.ClientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if opts.DevCert {
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate dev certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else {
+		if opts.TLSCert == "" || opts.TLSKey == "" {
+			return nil, errors.New("both a TLS certificate and key are required")
+		}
+		reloader, err := newCertReloader(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		// The reloader stops polling once the server shuts down
+		stop := make(chan struct{})
+		server.RegisterOnShutdown(sync.OnceFunc(func() { close(stop) }))
+		go reloader.watch(5*time.Second, stop)
+		tlsConfig.GetCertificate = reloader.GetCertificate
+	}
+
+	server.TLSConfig = tlsConfig
+	return server, nil
+}
+
+// certReloader serves a certificate pair and reloads it when either file changes
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// latestModTime returns the newer modification time of the two files
+func (c *certReloader) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// watch polls the files and reloads them when they change, until stop is closed.
+// A broken pair is logged and the previous certificate stays in use.
+func (c *certReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		modTime, err := c.latestModTime()
+		if err != nil {
+			continue
+		}
+		c.mu.RLock()
+		changed := modTime.After(c.modTime)
+		c.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := c.reload(); err != nil {
+			log.Printf("Error: keeping previous TLS certificate: %v", err)
+			continue
+		}
+		log.Printf("Reloaded TLS certificate from %s", c.certFile)
+	}
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// selfSignedCertificate creates a short-lived certificate for localhost development
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "routine dev certificate"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	log.Printf("Generated self-signed dev certificate, SHA-256 fingerprint %x", sha256.Sum256(der))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
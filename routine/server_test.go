@@ -0,0 +1,80 @@
+package routine
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewServerClientCAsNeedTLS(t *testing.T) {
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	s.Server.ClientCAs = x509.NewCertPool()
+	if _, err := s.newServer(s.routes()); err == nil {
+		t.Error("client CAs were accepted without TLS")
+	}
+	s.Server.DevCert = true
+	server, err := s.newServer(s.routes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.TLSConfig.ClientCAs == nil {
+		t.Error("the client CAs are not used over TLS")
+	}
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert := func(modTime time.Time) []byte {
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for file, block := range map[string]*pem.Block{certFile: {Type: "CERTIFICATE", Bytes: cert.Certificate[0]}, keyFile: {Type: "EC PRIVATE KEY", Bytes: key}} {
+			if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(file, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return cert.Certificate[0]
+	}
+	current := func(reloader *certReloader) []byte {
+		cert, _ := reloader.GetCertificate(nil)
+		return cert.Certificate[0]
+	}
+
+	writeCert(time.Now().Add(-time.Hour))
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		reloader.watch(time.Millisecond, stop)
+	}()
+
+	renewed := writeCert(time.Now())
+	for deadline := time.Now().Add(5 * time.Second); string(current(reloader)) != string(renewed); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the renewed certificate was not loaded")
+		}
+	}
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reloader kept polling after it was stopped")
+	}
+}
@@ -0,0 +1,33 @@
+// Shared helpers for the dashboard pages.
+
+// Credentials are kept for the browser session and sent on every API call
+function authHeader() {
+    return sessionStorage.getItem('authorization');
+}
+
+// Pages set this to react when the server asks for credentials
+let onUnauthorized = () => { window.location.href = '/'; };
+
+// apiFetch wraps fetch with the stored credentials and calls onUnauthorized on 401
+function apiFetch(url, options = {}) {
+    const headers = { ...(options.headers || {}) };
+    const auth = authHeader();
+    if (auth) {
+        headers['Authorization'] = auth;
+    }
+    return fetch(url, { ...options, headers }).then(response => {
+        if (response.status === 401) {
+            onUnauthorized();
+            throw new Error('authentication required');
+        }
+        return response;
+    });
+}
+
+// escapeHTML makes server-provided text safe to insert with innerHTML
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text == null ? '' : String(text);
+    // innerHTML leaves quotes as they are; escape them so the result is safe in attributes too
+    return div.innerHTML.replace(/"/g, '&quot;').replace(/'/g, '&#39;');
+}
@@ -0,0 +1,136 @@
+// Renders and reads config forms generated from the server's JSON Schema.
+
+// propertyNames returns the properties of an object schema in declaration order
+function propertyNames(schema) {
+    return schema['x-order'] || Object.keys(schema.properties || {});
+}
+
+// renderSchemaForm builds one input per property of the object schema inside container
+function renderSchemaForm(container, schema, values = {}) {
+    container.innerHTML = '';
+    propertyNames(schema).forEach(name => {
+        const prop = schema.properties[name];
+        const required = (schema.required || []).includes(name);
+        const label = document.createElement('label');
+        label.style.marginRight = '8px';
+        label.title = prop.description || '';
+        label.appendChild(document.createTextNode(name + (required ? '*' : '') + ': '));
+
+        let input;
+        if (prop.enum) {
+            input = document.createElement('select');
+            if (!required) {
+                input.appendChild(new Option('', ''));
+            }
+            prop.enum.forEach(option => input.appendChild(new Option(String(option), String(option))));
+        } else if (prop.type === 'boolean') {
+            input = document.createElement('input');
+            input.type = 'checkbox';
+        } else if (prop.type === 'integer' || prop.type === 'number') {
+            input = document.createElement('input');
+            input.type = 'number';
+            input.step = prop.type === 'integer' ? '1' : 'any';
+            if (prop.minimum !== undefined) input.min = prop.minimum;
+            if (prop.maximum !== undefined) input.max = prop.maximum;
+            input.style.width = '80px';
+        } else if (prop.type === 'string') {
+            input = document.createElement('input');
+            input.type = 'text';
+            input.style.width = '120px';
+        } else {
+            // Nested objects and arrays are edited as raw JSON
+            input = document.createElement('input');
+            input.type = 'text';
+            input.placeholder = 'JSON';
+            input.style.width = '150px';
+        }
+        input.dataset.field = name;
+        input.addEventListener('change', () => { input.dataset.dirty = '1'; });
+
+        const value = values[name];
+        if (value !== undefined) {
+            if (input.type === 'checkbox') {
+                input.checked = Boolean(value);
+            } else if (typeof value === 'object') {
+                input.value = JSON.stringify(value);
+            } else {
+                input.value = String(value);
+            }
+        }
+
+        label.appendChild(input);
+        container.appendChild(label);
+    });
+}
+
+// readSchemaForm collects the form into an object and checks it against the schema.
+// Empty optional fields are left out. With partial set, the result is a merge patch:
+// required fields may be empty and checkboxes count only once they were changed.
+// Returns { value, errors }.
+function readSchemaForm(container, schema, partial = false) {
+    const value = {};
+    const errors = [];
+    propertyNames(schema).forEach(name => {
+        const prop = schema.properties[name];
+        const required = !partial && (schema.required || []).includes(name);
+        const input = container.querySelector(`[data-field="${CSS.escape(name)}"]`);
+        if (!input) {
+            return;
+        }
+
+        if (input.type === 'checkbox') {
+            if (!partial || input.dataset.dirty) {
+                value[name] = input.checked;
+            }
+            return;
+        }
+        const raw = input.value.trim();
+        if (raw === '') {
+            if (required) {
+                errors.push(`${name} is required`);
+            }
+            return;
+        }
+
+        let parsed = raw;
+        if (prop.type === 'integer' || prop.type === 'number') {
+            parsed = Number(raw);
+            if (Number.isNaN(parsed) || (prop.type === 'integer' && !Number.isInteger(parsed))) {
+                errors.push(`${name} must be ${prop.type === 'integer' ? 'an integer' : 'a number'}`);
+                return;
+            }
+        } else if (prop.type !== 'string' && !prop.enum) {
+            try {
+                parsed = JSON.parse(raw);
+            } catch (e) {
+                errors.push(`${name} is not valid JSON`);
+                return;
+            }
+        }
+
+        errors.push(...checkSchemaValue(name, prop, parsed));
+        value[name] = parsed;
+    });
+    return { value, errors };
+}
+
+// checkSchemaValue applies the constraints the server derives from validate tags
+function checkSchemaValue(name, prop, value) {
+    const errors = [];
+    if (prop.enum && !prop.enum.map(String).includes(String(value))) {
+        errors.push(`${name} must be one of ${prop.enum.join(', ')}`);
+    }
+    if (typeof value === 'number') {
+        if (prop.minimum !== undefined && value < prop.minimum) errors.push(`${name} must be at least ${prop.minimum}`);
+        if (prop.maximum !== undefined && value > prop.maximum) errors.push(`${name} must be at most ${prop.maximum}`);
+    }
+    if (typeof value === 'string') {
+        if (prop.minLength !== undefined && value.length < prop.minLength) errors.push(`${name} must be at least ${prop.minLength} characters`);
+        if (prop.maxLength !== undefined && value.length > prop.maxLength) errors.push(`${name} must be at most ${prop.maxLength} characters`);
+    }
+    if (Array.isArray(value)) {
+        if (prop.minItems !== undefined && value.length < prop.minItems) errors.push(`${name} needs at least ${prop.minItems} items`);
+        if (prop.maxItems !== undefined && value.length > prop.maxItems) errors.push(`${name} allows at most ${prop.maxItems} items`);
+    }
+    return errors;
+}
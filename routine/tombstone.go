@@ -0,0 +1,273 @@
+package routine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxTombstones bounds the number of finished routines kept when MaxTombstones is unset
+const DefaultMaxTombstones = 1000
+
+// Exit reasons of routines that did not complete
+const (
+	ExitStopped = "stopped"
+	ExitFailed  = "failed"
+)
+
+// Tombstone is what remains of a finished routine: how and when it ended and
+// its final output. Completed routines give their completion reason, such as
+// CompletedMaxIterations, as ExitReason.
+type Tombstone struct {
+	ID         string       `json:"id"`
+	Type       string       `json:"type"`
+	Tags       []string     `json:"tags,omitempty"`
+	Labels     Labels       `json:"labels,omitempty"`
+	State      RoutineState `json:"state"`
+	ExitReason string       `json:"exit_reason"`
+	Output     string       `json:"output"`
+	Config     string       `json:"config"`
+	LastError  string       `json:"last_error,omitempty"`
+	Iterations int64        `json:"iterations"`
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+}
+
+// tombstone adds what dependents still read of a finished routine: the states
+// it went through, what it waited for and its final output. Its history and
+// config versions are dropped with the control.
+type tombstone[TConfig, TOutput any] struct {
+	Tombstone
+	reached   map[RoutineState]bool
+	dependsOn []Dependency
+	output    TOutput
+}
+
+// upstream is what a config template sees of the finished routine
+func (entry *tombstone[TConfig, TOutput]) upstream() UpstreamData {
+	return UpstreamData{ID: entry.ID, State: entry.State, Output: entry.output}
+}
+
+// tombstoneStore keeps finished routines by ID, oldest first.
+// The zero value is ready to use.
+type tombstoneStore[TConfig, TOutput any] struct {
+	mu      sync.Mutex
+	entries []*tombstone[TConfig, TOutput]
+}
+
+// sweepLocked drops tombstones past the TTL and the oldest beyond the count limit
+func (t *tombstoneStore[TConfig, TOutput]) sweepLocked(now time.Time, ttl time.Duration, limit int) {
+	expired := 0
+	for expired < len(t.entries) && now.Sub(t.entries[expired].FinishedAt) > ttl {
+		expired++
+	}
+	if extra := len(t.entries) - expired - limit; extra > 0 {
+		expired += extra
+	}
+	if expired > 0 {
+		clear(t.entries[:expired])
+		t.entries = t.entries[expired:]
+	}
+}
+
+// add stores a tombstone, replacing an older one with the same ID
+func (t *tombstoneStore[TConfig, TOutput]) add(entry *tombstone[TConfig, TOutput], ttl time.Duration, limit int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = slices.DeleteFunc(t.entries, func(old *tombstone[TConfig, TOutput]) bool { return old.ID == entry.ID })
+	t.entries = append(t.entries, entry)
+	t.sweepLocked(entry.FinishedAt, ttl, limit)
+}
+
+// snapshot returns the tombstones still retained, oldest first
+func (t *tombstoneStore[TConfig, TOutput]) snapshot(ttl time.Duration, limit int) []*tombstone[TConfig, TOutput] {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweepLocked(time.Now(), ttl, limit)
+	return slices.Clone(t.entries)
+}
+
+// purge removes the tombstones matching drop and returns how many it removed
+func (t *tombstoneStore[TConfig, TOutput]) purge(drop func(*tombstone[TConfig, TOutput]) bool) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	before := len(t.entries)
+	t.entries = slices.DeleteFunc(t.entries, drop)
+	return before - len(t.entries)
+}
+
+// tombstoneLimits returns the retention TTL and count in effect
+func (s *RoutineScheduler[TConfig, TOutput]) tombstoneLimits() (time.Duration, int) {
+	limit := s.MaxTombstones
+	if limit <= 0 {
+		limit = DefaultMaxTombstones
+	}
+	return s.retention(), limit
+}
+
+// bury records a routine that just finished, before it leaves routineMap
+func (s *RoutineScheduler[TConfig, TOutput]) bury(id string, ctrl *RoutineControl[TConfig, TOutput], reason string) {
+	history := ctrl.history
+	output := ctrl.Output.Load().(TOutput)
+	history.mu.Lock()
+	entry := &tombstone[TConfig, TOutput]{
+		Tombstone: Tombstone{
+			ID:         id,
+			Type:       s.routineType(),
+			Tags:       ctrl.Tags,
+			Labels:     ctrl.Labels(),
+			State:      history.state,
+			ExitReason: reason,
+			Output:     s.Routine.SerializeOutput(output),
+			Config:     s.Routine.SerializeConfig(ctrl.Config.Load().(TConfig)),
+			Iterations: history.iterations,
+			StartedAt:  history.startedAt,
+			FinishedAt: time.Now(),
+		},
+		reached:   maps.Clone(history.reached),
+		dependsOn: ctrl.Dependencies(),
+		output:    output,
+	}
+	if traces := history.errors.slice(); len(traces) > 0 {
+		entry.LastError = traces[len(traces)-1].Error
+	}
+	history.mu.Unlock()
+
+	ttl, limit := s.tombstoneLimits()
+	s.tombstones.add(entry, ttl, limit)
+	s.forgetRules(id)
+}
+
+// Tombstones returns the finished routines still retained, oldest first
+func (s *RoutineScheduler[TConfig, TOutput]) Tombstones() []Tombstone {
+	ttl, limit := s.tombstoneLimits()
+	entries := s.tombstones.snapshot(ttl, limit)
+	list := make([]Tombstone, len(entries))
+	for i, entry := range entries {
+		list[i] = entry.Tombstone
+	}
+	return list
+}
+
+// loadTombstone returns the retained tombstone of a finished routine
+func (s *RoutineScheduler[TConfig, TOutput]) loadTombstone(id string) (*tombstone[TConfig, TOutput], bool) {
+	ttl, limit := s.tombstoneLimits()
+	for _, entry := range s.tombstones.snapshot(ttl, limit) {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// PurgeTombstones removes tombstones of the given routines, or all of them when ids is nil.
+// Only tombstones that finished before olderThan ago are removed.
+func (s *RoutineScheduler[TConfig, TOutput]) PurgeTombstones(ids []string, olderThan time.Duration) int {
+	cutoff := time.Now().Add(-olderThan)
+	return s.tombstones.purge(func(entry *tombstone[TConfig, TOutput]) bool {
+		return (ids == nil || slices.Contains(ids, entry.ID)) && entry.FinishedAt.Before(cutoff)
+	})
+}
+
+// visibleTombstones returns the tombstones the caller may see matching the
+// selector and state query parameters
+func (s *RoutineScheduler[TConfig, TOutput]) visibleTombstones(r *http.Request, perm Permission) ([]Tombstone, error) {
+	selector, err := ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		return nil, err
+	}
+	state := RoutineState(r.URL.Query().Get("state"))
+	list := []Tombstone{}
+	for _, entry := range s.Tombstones() {
+		if !s.can(r, perm, entry.Tags) || !selector.Matches(entry.Labels) || (state != "" && entry.State != state) {
+			continue
+		}
+		list = append(list, entry)
+	}
+	return list, nil
+}
+
+// handleTombstones lists finished routines, most recent first
+func (s *RoutineScheduler[TConfig, TOutput]) handleTombstones(w http.ResponseWriter, r *http.Request) {
+	list, err := s.visibleTombstones(r, PermViewStatus)
+	if err != nil {
+		NewHandleResult(0, "Invalid selector").SetError(err).Response(w)
+		return
+	}
+	slices.Reverse(list)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// handlePurgeTombstones removes tombstones chosen by a JSON array of IDs or by
+// selector, or every tombstone the caller may stop when neither is given.
+// older_than keeps the ones that finished more recently.
+func (s *RoutineScheduler[TConfig, TOutput]) handlePurgeTombstones(w http.ResponseWriter, r *http.Request) {
+	result := NewHandleResult(0, "Failed to purge tombstones")
+	var olderThan time.Duration
+	if value := r.URL.Query().Get("older_than"); value != "" {
+		var err error
+		if olderThan, err = time.ParseDuration(value); err != nil || olderThan < 0 {
+			result.SetError(fmt.Errorf("invalid older_than parameter %q", value)).Response(w)
+			return
+		}
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		result.SetError(fmt.Errorf("invalid request format: %v", err)).Response(w)
+		return
+	}
+	var ids []string
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, &ids); err != nil {
+			result.SetError(fmt.Errorf("invalid request format: %v", err)).Response(w)
+			return
+		}
+		if r.URL.Query().Has("selector") {
+			result.SetError(errors.New("give either routine IDs or a selector, not both")).Response(w)
+			return
+		}
+	}
+
+	// Purging everything takes an empty request, not an empty selector
+	if emptySelector(r.URL.Query()) {
+		result.SetError(errEmptySelector).Response(w)
+		return
+	}
+
+	// Only tombstones of routines the caller could have stopped may be purged
+	visible, err := s.visibleTombstones(r, PermStop)
+	if err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+	targets := []string{}
+	for _, entry := range visible {
+		if olderThan > 0 && time.Since(entry.FinishedAt) < olderThan {
+			continue
+		}
+		if ids == nil || slices.Contains(ids, entry.ID) {
+			targets = append(targets, entry.ID)
+		}
+	}
+	for _, id := range ids {
+		if !slices.ContainsFunc(visible, func(entry Tombstone) bool { return entry.ID == id }) {
+			if _, ok := s.loadTombstone(id); ok {
+				denied(w, &PermissionError{Permission: PermStop, ID: id})
+				return
+			}
+		}
+	}
+
+	audit := auditFrom(r)
+	audit.IDs = targets
+	purged := s.PurgeTombstones(targets, olderThan)
+	result.Set(purged, len(targets)).Response(w)
+}
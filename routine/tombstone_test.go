@@ -0,0 +1,138 @@
+package routine
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTombstoneStoreEviction(t *testing.T) {
+	now := time.Now()
+	entry := func(id string, age time.Duration) *tombstone[*testConfig, int] {
+		return &tombstone[*testConfig, int]{Tombstone: Tombstone{ID: id, FinishedAt: now.Add(-age)}}
+	}
+	ids := func(entries []*tombstone[*testConfig, int]) []string {
+		var ids []string
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+	tests := []struct {
+		name    string
+		entries []*tombstone[*testConfig, int]
+		ttl     time.Duration
+		limit   int
+		want    []string
+	}{
+		{"all kept", []*tombstone[*testConfig, int]{entry("a", 3*time.Second), entry("b", 2*time.Second), entry("c", time.Second)}, time.Minute, 10, []string{"a", "b", "c"}},
+		{"expired by age", []*tombstone[*testConfig, int]{entry("a", 3*time.Minute), entry("b", 2*time.Minute), entry("c", time.Second)}, time.Minute, 10, []string{"c"}},
+		{"oldest dropped beyond the count", []*tombstone[*testConfig, int]{entry("a", 3*time.Second), entry("b", 2*time.Second), entry("c", time.Second)}, time.Minute, 2, []string{"b", "c"}},
+		{"age and count together", []*tombstone[*testConfig, int]{entry("a", 3*time.Minute), entry("b", 3*time.Second), entry("c", 2*time.Second), entry("d", time.Second)}, time.Minute, 2, []string{"c", "d"}},
+		{"a reused ID replaces its tombstone", []*tombstone[*testConfig, int]{entry("a", 3*time.Second), entry("b", 2*time.Second), entry("a", time.Second)}, time.Minute, 10, []string{"b", "a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var store tombstoneStore[*testConfig, int]
+			for _, entry := range test.entries {
+				store.add(entry, test.ttl, test.limit)
+			}
+			if got := ids(store.snapshot(test.ttl, test.limit)); !slices.Equal(got, test.want) {
+				t.Errorf("kept %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPurgeTombstones(t *testing.T) {
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	now := time.Now()
+	for _, entry := range []Tombstone{
+		{ID: "old", FinishedAt: now.Add(-time.Hour)},
+		{ID: "recent", FinishedAt: now.Add(-time.Second)},
+		{ID: "other", FinishedAt: now.Add(-time.Hour)},
+	} {
+		s.tombstones.add(&tombstone[*testConfig, int]{Tombstone: entry}, time.Hour*2, 10)
+	}
+	left := func() []string {
+		var ids []string
+		for _, entry := range s.Tombstones() {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+
+	if purged := s.PurgeTombstones([]string{"old"}, 0); purged != 1 || !slices.Equal(left(), []string{"recent", "other"}) {
+		t.Errorf("purging old removed %d, left %v", purged, left())
+	}
+	if purged := s.PurgeTombstones(nil, time.Minute); purged != 1 || !slices.Equal(left(), []string{"recent"}) {
+		t.Errorf("purging those older than a minute removed %d, left %v", purged, left())
+	}
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/tombstones/purge", strings.NewReader(`["recent"]`)))
+	if w.Code != http.StatusOK || len(left()) != 0 {
+		t.Errorf("purge by ID answered %d and left %v: %s", w.Code, left(), w.Body)
+	}
+}
+
+func TestBuryKeepsWhatDependentsRead(t *testing.T) {
+	s := newTestScheduler(t, func(ctrl *RoutineControl[*testConfig, int]) (int, error) {
+		return ctrl.Config.Load().(*testConfig).Value, nil
+	})
+	id, err := s.StartRoutineWithOptions(&testConfig{Value: 7}, StartOptions{
+		Name:   "buried",
+		Labels: Labels{"team": "a"},
+		Bounds: RunBounds{MaxIterations: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, err := s.loadControl(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, ctrl)
+
+	entry, ok := s.loadTombstone(id)
+	if !ok {
+		t.Fatal("no tombstone")
+	}
+	if entry.State != StateCompleted || entry.ExitReason != CompletedMaxIterations || entry.Iterations != 2 ||
+		entry.Output != "7" || entry.Config != `{"value":7}` || entry.Labels["team"] != "a" {
+		t.Errorf("tombstone %+v", entry.Tombstone)
+	}
+	if !entry.reached[StateRunning] || !entry.reached[StateCompleted] || entry.reached[StateFailed] {
+		t.Errorf("reached %v, want running and completed", entry.reached)
+	}
+	if upstream := entry.upstream(); upstream.Output != 7 || upstream.State != StateCompleted {
+		t.Errorf("upstream %+v", upstream)
+	}
+}
+
+func TestLiveRoutineHidesTombstone(t *testing.T) {
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	s.tombstones.add(&tombstone[*testConfig, int]{Tombstone: Tombstone{ID: "reused", State: StateCompleted, FinishedAt: time.Now()}}, time.Hour, 10)
+	if _, err := s.StartRoutineWithOptions(&testConfig{}, StartOptions{Name: "reused", StartAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+	if w := get("/result?id=reused"); w.Code != http.StatusAccepted {
+		t.Errorf("/result answered %d for a live routine, want 202: %s", w.Code, w.Body)
+	}
+	var detail struct{ State RoutineState }
+	if w := get("/routine?id=reused"); json.Unmarshal(w.Body.Bytes(), &detail) != nil || detail.State != StateScheduled {
+		t.Errorf("/routine shows %s, want the live routine %s", detail.State, StateScheduled)
+	}
+	if exists, reached := s.dependencyReached("reused", StateCompleted); !exists || reached {
+		t.Errorf("the dependency on the live routine exists %v, reached %v; want it pending", exists, reached)
+	}
+}
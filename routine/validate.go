@@ -0,0 +1,151 @@
+package routine
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FieldError describes a problem with one field of a config
+type FieldError struct {
+	// ID names the routine whose config was rejected, for bulk updates
+	ID      string `json:"id,omitempty"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	if e.ID != "" {
+		return e.ID + ": " + e.Field + ": " + e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// ValidateTags checks a config against the same `validate` tags SchemaFor reads:
+// required, min=N, max=N and oneof/enum. Nested structs are checked too and
+// reported with dotted field names.
+func ValidateTags(config any) []FieldError {
+	value := reflect.ValueOf(config)
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return []FieldError{{Field: "", Message: "config is required"}}
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	return validateStruct(value, "")
+}
+
+func validateStruct(value reflect.Value, prefix string) []FieldError {
+	var errs []FieldError
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := jsonFieldName(field)
+		if !ok {
+			continue
+		}
+		fieldValue := value.Field(i)
+
+		if field.Anonymous && field.Tag.Get("json") == "" {
+			embedded := fieldValue
+			for embedded.Kind() == reflect.Pointer && !embedded.IsNil() {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				errs = append(errs, validateStruct(embedded, prefix)...)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		path := prefix + name
+		errs = append(errs, validateField(fieldValue, path, field.Tag.Get("validate"))...)
+
+		// Descend into nested structs
+		nested := fieldValue
+		for nested.Kind() == reflect.Pointer && !nested.IsNil() {
+			nested = nested.Elem()
+		}
+		if nested.Kind() == reflect.Struct && nested.Type() != timeType {
+			errs = append(errs, validateStruct(nested, path+".")...)
+		}
+	}
+	return errs
+}
+
+// validateField applies the rules of one validate tag to a field value
+func validateField(value reflect.Value, path, tag string) []FieldError {
+	var errs []FieldError
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			if slices.Contains(strings.Split(tag, ","), "required") {
+				errs = append(errs, FieldError{Field: path, Message: "is required"})
+			}
+			return errs
+		}
+		value = value.Elem()
+	}
+
+	for _, rule := range strings.Split(tag, ",") {
+		key, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch key {
+		case "required":
+			if value.IsZero() {
+				errs = append(errs, FieldError{Field: path, Message: "is required"})
+			}
+		case "min", "max":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				continue
+			}
+			measure, unit, ok := measureField(value)
+			if !ok {
+				continue
+			}
+			if key == "min" && measure < limit {
+				errs = append(errs, FieldError{Field: path, Message: fmt.Sprintf("must be at least %v%s", arg, unit)})
+			}
+			if key == "max" && measure > limit {
+				errs = append(errs, FieldError{Field: path, Message: fmt.Sprintf("must be at most %v%s", arg, unit)})
+			}
+		case "oneof", "enum":
+			allowed := strings.FieldsFunc(arg, func(r rune) bool { return r == ' ' || r == '|' })
+			if !slices.Contains(allowed, fmt.Sprint(value.Interface())) {
+				errs = append(errs, FieldError{Field: path, Message: "must be one of " + strings.Join(allowed, ", ")})
+			}
+		}
+	}
+	return errs
+}
+
+// measureField returns what min/max compare against: the number itself, or the length of strings and collections
+func measureField(value reflect.Value) (float64, string, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), "", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), "", true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), "", true
+	case reflect.String:
+		return float64(len([]rune(value.String()))), " characters", true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()), " items", true
+	}
+	return 0, "", false
+}
+
+// validateConfig runs the routine's validation hook, if it has one
+func (s *RoutineScheduler[TConfig, TOutput]) validateConfig(config TConfig) []FieldError {
+	if s.Routine.ValidateConfig == nil {
+		return nil
+	}
+	return s.Routine.ValidateConfig(config)
+}
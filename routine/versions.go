@@ -0,0 +1,463 @@
+package routine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SystemActor is recorded for config changes made through the Go API rather than a caller
+const SystemActor = "system"
+
+// maxConfigVersions is how many versions each routine keeps; the oldest are dropped first
+const maxConfigVersions = 50
+
+// ConfigVersion is one recorded value of a routine's config
+type ConfigVersion struct {
+	Version int64           `json:"version"`
+	Time    time.Time       `json:"time"`
+	Actor   string          `json:"actor"`
+	Action  string          `json:"action"`
+	Config  json.RawMessage `json:"config"`
+}
+
+// configVersions is the config history of one routine.
+// Its mutex also serializes config writes so each version matches what was stored.
+type configVersions struct {
+	mu       sync.Mutex
+	versions []ConfigVersion
+	latest   int64
+}
+
+// record appends config as a new version unless it equals the latest one.
+// The caller must hold mu.
+func (v *configVersions) record(config any, actor, action string) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(config))
+	}
+	if n := len(v.versions); n > 0 && bytes.Equal(v.versions[n-1].Config, data) {
+		return
+	}
+	v.latest++
+	v.versions = append(v.versions, ConfigVersion{
+		Version: v.latest,
+		Time:    time.Now(),
+		Actor:   actor,
+		Action:  action,
+		Config:  data,
+	})
+	if len(v.versions) > maxConfigVersions {
+		v.versions = v.versions[len(v.versions)-maxConfigVersions:]
+	}
+}
+
+// list returns a copy of the recorded versions, oldest first
+func (v *configVersions) list() []ConfigVersion {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]ConfigVersion(nil), v.versions...)
+}
+
+// find returns a recorded version
+func (v *configVersions) find(version int64) (ConfigVersion, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, candidate := range v.versions {
+		if candidate.Version == version {
+			return candidate, true
+		}
+	}
+	return ConfigVersion{}, false
+}
+
+// revision returns the latest version number
+func (v *configVersions) revision() int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.latest
+}
+
+// storeConfig stores a new config and records it as a version
+func (ctrl *RoutineControl[TConfig, TOutput]) storeConfig(config TConfig, actor, action string) {
+	_ = ctrl.storeConfigIf(config, 0, actor, action)
+}
+
+// configAt returns the config with its revision, read under the lock that serializes config writes
+func (ctrl *RoutineControl[TConfig, TOutput]) configAt() (TConfig, int64) {
+	ctrl.versions.mu.Lock()
+	defer ctrl.versions.mu.Unlock()
+	return ctrl.Config.Load().(TConfig), ctrl.versions.latest
+}
+
+// storeConfigIf stores a new config only if the latest version is still expected.
+// An expected revision of 0 skips the check.
+func (ctrl *RoutineControl[TConfig, TOutput]) storeConfigIf(config TConfig, expected int64, actor, action string) error {
+	ctrl.versions.mu.Lock()
+	defer ctrl.versions.mu.Unlock()
+	if expected != 0 && expected != ctrl.versions.latest {
+		return &ConflictError{Expected: expected, Actual: ctrl.versions.latest}
+	}
+	ctrl.Config.Store(config)
+	ctrl.versions.record(config, actor, action)
+	return nil
+}
+
+// Revisions maps routine IDs to the config revision a caller last saw.
+// Writes to a listed routine fail with a *ConflictError if its config changed since;
+// routines that are not listed are written unconditionally.
+type Revisions map[string]int64
+
+// ConflictError reports a routine whose config changed since the revision the caller expected
+type ConflictError struct {
+	ID       string
+	Expected int64
+	Actual   int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("routine %s: config is at revision %d, expected %d", e.ID, e.Actual, e.Expected)
+}
+
+// revisionETag formats a config revision as a strong entity tag
+func revisionETag(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// parseIfMatch reads the revision from an If-Match header.
+// An absent header or "*" means no check. Only one strong tag is accepted
+// because a bulk update is checked against the same revision for every routine;
+// per-routine revisions go in the request body instead.
+func parseIfMatch(header string) (int64, error) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+	if strings.Contains(header, ",") {
+		return 0, errors.New("If-Match must hold a single entity tag; send per-routine revisions in the body")
+	}
+	if strings.HasPrefix(header, "W/") {
+		return 0, errors.New("If-Match requires a strong entity tag")
+	}
+	revision, err := strconv.ParseInt(strings.Trim(header, `"`), 10, 64)
+	if err != nil || revision <= 0 {
+		return 0, fmt.Errorf("invalid If-Match entity tag %s", header)
+	}
+	return revision, nil
+}
+
+// expectedRevisions combines the revisions of a request body with its If-Match header,
+// which applies to every target the body does not list
+func expectedRevisions(r *http.Request, ids []string, revisions Revisions) (Revisions, error) {
+	ifMatch, err := parseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		return nil, err
+	}
+	expected := make(Revisions, len(ids))
+	for _, id := range ids {
+		if revision, ok := revisions[id]; ok {
+			expected[id] = revision
+		} else if ifMatch != 0 {
+			expected[id] = ifMatch
+		}
+	}
+	return expected, nil
+}
+
+// conflictsIn collects the conflicts from an error returned by a bulk config write
+func conflictsIn(err error) []*ConflictError {
+	var conflicts []*ConflictError
+	var walk func(error)
+	walk = func(err error) {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, inner := range joined.Unwrap() {
+				walk(inner)
+			}
+			return
+		}
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	if err != nil {
+		walk(err)
+	}
+	return conflicts
+}
+
+// changeConfig runs a hook that may change the config itself, such as Suspend,
+// and records the result as a version if it changed
+func (ctrl *RoutineControl[TConfig, TOutput]) changeConfig(actor, action string, hook func()) {
+	ctrl.versions.mu.Lock()
+	defer ctrl.versions.mu.Unlock()
+	hook()
+	ctrl.versions.record(ctrl.Config.Load(), actor, action)
+}
+
+// ConfigChange is one difference between two config versions
+type ConfigChange struct {
+	Path string `json:"path"`
+	Old  any    `json:"old,omitempty"`
+	New  any    `json:"new,omitempty"`
+}
+
+// diffConfigs lists the leaf values that differ between two JSON documents, keyed by JSON Pointer
+func diffConfigs(oldConfig, newConfig json.RawMessage) ([]ConfigChange, error) {
+	oldValue, err := decodeJSON(oldConfig)
+	if err != nil {
+		return nil, err
+	}
+	newValue, err := decodeJSON(newConfig)
+	if err != nil {
+		return nil, err
+	}
+	changes := []ConfigChange{}
+	diffValues(&changes, "", oldValue, newValue)
+	return changes, nil
+}
+
+func diffValues(changes *[]ConfigChange, path string, oldValue, newValue any) {
+	oldObject, oldIsObject := oldValue.(map[string]any)
+	newObject, newIsObject := newValue.(map[string]any)
+	if oldIsObject && newIsObject {
+		keys := make(map[string]bool)
+		for key := range oldObject {
+			keys[key] = true
+		}
+		for key := range newObject {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			diffValues(changes, path+"/"+escapePointerToken(key), oldObject[key], newObject[key])
+		}
+		return
+	}
+	if !reflect.DeepEqual(oldValue, newValue) {
+		*changes = append(*changes, ConfigChange{Path: path, Old: oldValue, New: newValue})
+	}
+}
+
+func escapePointerToken(token string) string {
+	var buf bytes.Buffer
+	for _, r := range token {
+		switch r {
+		case '~':
+			buf.WriteString("~0")
+		case '/':
+			buf.WriteString("~1")
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// RollbackRoutines restores each routine's config to an earlier version.
+// A positive version is an absolute version number; otherwise steps counts back from the latest.
+func (s *RoutineScheduler[TConfig, TOutput]) RollbackRoutines(ids []string, version int64, steps int) (int, []FieldError, error) {
+	return s.rollbackRoutines(SystemActor, nil, ids, version, steps)
+}
+
+func (s *RoutineScheduler[TConfig, TOutput]) rollbackRoutines(actor string, expected Revisions, ids []string, version int64, steps int) (int, []FieldError, error) {
+	type pending struct {
+		id      string
+		ctrl    *RoutineControl[TConfig, TOutput]
+		config  TConfig
+		version int64
+	}
+	var err error
+	var fieldErrors []FieldError
+	updates := make([]pending, 0, len(ids))
+
+	for _, id := range ids {
+		ctrl, errLoad := s.loadControl(id)
+		if errLoad != nil {
+			err = errors.Join(err, errLoad)
+			continue
+		}
+
+		target := version
+		if target <= 0 {
+			target = ctrl.versions.revision() - int64(steps)
+		}
+		recorded, ok := ctrl.versions.find(target)
+		if !ok {
+			err = errors.Join(err, fmt.Errorf("routine %s has no config version %d", id, target))
+			continue
+		}
+		config, errConfig := s.Routine.DeserializeConfig(string(recorded.Config))
+		if errConfig != nil {
+			err = errors.Join(err, fmt.Errorf("routine %s: could not deserialize version %d: %v", id, target, errConfig))
+			continue
+		}
+		for _, fieldError := range s.validateConfig(config) {
+			fieldError.ID = id
+			fieldErrors = append(fieldErrors, fieldError)
+		}
+		updates = append(updates, pending{id: id, ctrl: ctrl, config: config, version: target})
+	}
+
+	if len(fieldErrors) > 0 {
+		return 0, fieldErrors, err
+	}
+	rolledBack := 0
+	for _, update := range updates {
+		action := fmt.Sprintf("rollback to v%d", update.version)
+		if errStore := update.ctrl.storeConfigIf(update.config, expected[update.id], actor, action); errStore != nil {
+			var conflict *ConflictError
+			if errors.As(errStore, &conflict) {
+				conflict.ID = update.id
+			}
+			err = errors.Join(err, errStore)
+			continue
+		}
+		update.ctrl.history.event("", "config-rolled-back", action)
+		rolledBack++
+	}
+	return rolledBack, nil, err
+}
+
+// loadControl returns the control of a routine owned by this scheduler
+func (s *RoutineScheduler[TConfig, TOutput]) loadControl(id string) (*RoutineControl[TConfig, TOutput], error) {
+	val, ok := routineMap.Load(id)
+	if !ok {
+		return nil, fmt.Errorf("routine %s not found", id)
+	}
+	ctrl, ok := val.(*RoutineControl[TConfig, TOutput])
+	if !ok {
+		return nil, fmt.Errorf("could not convert routine %s to expected type", id)
+	}
+	return ctrl, nil
+}
+
+// loadViewable returns the control of a routine the caller may view, writing the error response otherwise
+func (s *RoutineScheduler[TConfig, TOutput]) loadViewable(w http.ResponseWriter, r *http.Request, id string) (*RoutineControl[TConfig, TOutput], bool) {
+	ctrl, err := s.loadControl(id)
+	if err != nil {
+		NewHandleResult(1, "Failed to load routine").SetError(err).Status(http.StatusNotFound).Response(w)
+		return nil, false
+	}
+	if !s.can(r, PermViewStatus, ctrl.Tags) {
+		denied(w, &PermissionError{Permission: PermViewStatus, ID: id})
+		return nil, false
+	}
+	return ctrl, true
+}
+
+// handleConfigVersions lists the config versions of a routine
+func (s *RoutineScheduler[TConfig, TOutput]) handleConfigVersions(w http.ResponseWriter, r *http.Request) {
+	ctrl, ok := s.loadViewable(w, r, r.URL.Query().Get("id"))
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ctrl.versions.list())
+}
+
+// handleConfigDiff compares two config versions of a routine.
+// "to" defaults to the latest version and "from" to the one before it.
+func (s *RoutineScheduler[TConfig, TOutput]) handleConfigDiff(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	result := NewHandleResult(1, "Failed to diff config versions")
+	ctrl, ok := s.loadViewable(w, r, query.Get("id"))
+	if !ok {
+		return
+	}
+
+	to := ctrl.versions.revision()
+	if value := query.Get("to"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			result.SetError(fmt.Errorf("invalid to parameter: %v", err)).Response(w)
+			return
+		}
+		to = parsed
+	}
+	from := to - 1
+	if value := query.Get("from"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			result.SetError(fmt.Errorf("invalid from parameter: %v", err)).Response(w)
+			return
+		}
+		from = parsed
+	}
+
+	fromVersion, okFrom := ctrl.versions.find(from)
+	toVersion, okTo := ctrl.versions.find(to)
+	if !okFrom || !okTo {
+		result.SetError(fmt.Errorf("versions %d and %d are not both recorded", from, to)).Status(http.StatusNotFound).Response(w)
+		return
+	}
+	changes, err := diffConfigs(fromVersion.Config, toVersion.Config)
+	if err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"from":    fromVersion,
+		"to":      toVersion,
+		"changes": changes,
+	})
+}
+
+// handleRollback restores the config of routines to an earlier version
+func (s *RoutineScheduler[TConfig, TOutput]) handleRollback(w http.ResponseWriter, r *http.Request) {
+	type RollbackPayload struct {
+		IDs       []string  `json:"ids"`
+		Version   int64     `json:"version"`
+		Steps     int       `json:"steps"`
+		Revisions Revisions `json:"revisions"`
+	}
+
+	var payload RollbackPayload
+	result := NewHandleResult(0, "Failed to roll back all requested routines")
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		result.SetError(fmt.Errorf("invalid request format: %v", err)).Response(w)
+		return
+	}
+	if payload.Version <= 0 && payload.Steps <= 0 {
+		result.SetError(errors.New("either version or steps must be greater than 0")).Response(w)
+		return
+	}
+	ids, err := s.selectTargets(r, PermUpdateConfig, payload.IDs)
+	if err != nil {
+		targetError(w, result, err)
+		return
+	}
+	payload.IDs = ids
+	expected, err := expectedRevisions(r, payload.IDs, payload.Revisions)
+	if err != nil {
+		result.SetError(err).Response(w)
+		return
+	}
+
+	audit := auditFrom(r)
+	audit.IDs = payload.IDs
+	audit.OldConfig = s.snapshotConfigs(payload.IDs)
+
+	rolledBack, fieldErrors, err := s.rollbackRoutines(callerIdentity(r), expected, payload.IDs, payload.Version, payload.Steps)
+	audit.NewConfig = s.snapshotConfigs(payload.IDs)
+	if len(fieldErrors) > 0 {
+		result.Set(0, len(payload.IDs)).SetFieldErrors(fieldErrors).Response(w)
+		return
+	}
+	result.SetError(err).SetConflicts(err)
+	result.Set(rolledBack, len(payload.IDs)).Response(w)
+}
@@ -0,0 +1,139 @@
+package routine
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigVersionsRecord(t *testing.T) {
+	var v configVersions
+	v.record(testConfig{Value: 1}, "alice", "start")
+	v.record(testConfig{Value: 1}, "bob", "update-config")
+	if v.latest != 1 || len(v.versions) != 1 {
+		t.Fatalf("an identical config made revision %d with %d versions, want 1 and 1", v.latest, len(v.versions))
+	}
+	v.record(testConfig{Value: 2}, "bob", "update-config")
+	if v.latest != 2 || v.versions[1].Actor != "bob" || string(v.versions[1].Config) != `{"value":2}` {
+		t.Fatalf("latest version %+v at revision %d", v.versions[len(v.versions)-1], v.latest)
+	}
+	// Switching back is a change too
+	v.record(testConfig{Value: 1}, "bob", "update-config")
+	if v.latest != 3 {
+		t.Errorf("revision %d, want 3", v.latest)
+	}
+
+	for i := range maxConfigVersions {
+		v.record(testConfig{Value: 10 + i}, "carol", "update-config")
+	}
+	if len(v.versions) != maxConfigVersions || v.versions[0].Version != v.latest-maxConfigVersions+1 {
+		t.Errorf("kept %d versions from %d, want the last %d", len(v.versions), v.versions[0].Version, maxConfigVersions)
+	}
+	if _, ok := v.find(1); ok {
+		t.Error("the oldest version was kept past the limit")
+	}
+}
+
+func TestParseIfMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int64
+		err    bool
+	}{
+		{"", 0, false},
+		{"*", 0, false},
+		{`"3"`, 3, false},
+		{` "3" `, 3, false},
+		{`W/"3"`, 0, true},
+		{`"3", "4"`, 0, true},
+		{`"0"`, 0, true},
+		{`"-1"`, 0, true},
+		{`"abc"`, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			got, err := parseIfMatch(test.header)
+			if got != test.want || (err != nil) != test.err {
+				t.Errorf("got (%d, %v), want %d with error %v", got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+// versionStep is one request against a routine's config and the outcome it should have
+type versionStep struct {
+	name, path, ifMatch, body string
+	status                    int
+	revision                  int64 // Latest revision afterwards
+	value                     int   // Config value afterwards
+	conflictAt                int64 // Revision reported by a 409, if any
+}
+
+func TestConfigRevisions(t *testing.T) {
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	// A routine scheduled far ahead never runs, so only the requests change its config
+	id, err := s.StartRoutineWithOptions(&testConfig{Value: 1}, StartOptions{Name: "versioned", StartAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, err := s.loadControl(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []versionStep{
+		{"update at the expected revision", "/update-config", `"1"`, `{"ids":["versioned"],"config":"{\"value\":2}"}`, http.StatusOK, 2, 2, 0},
+		{"an identical config keeps the revision", "/update-config", "", `{"ids":["versioned"],"config":"{\"value\":2}"}`, http.StatusOK, 2, 2, 0},
+		{"update at a stale revision conflicts", "/update-config", `"1"`, `{"ids":["versioned"],"config":"{\"value\":3}"}`, http.StatusConflict, 2, 2, 2},
+		{"body revisions override If-Match", "/update-config", `"1"`, `{"ids":["versioned"],"config":"{\"value\":3}","revisions":{"versioned":2}}`, http.StatusOK, 3, 3, 0},
+		{"a weak tag is refused", "/update-config", `W/"3"`, `{"ids":["versioned"],"config":"{\"value\":4}"}`, http.StatusBadRequest, 3, 3, 0},
+		{"a patch at a stale revision conflicts", "/update-config", `"2"`, `{"ids":["versioned"],"merge_patch":{"value":4}}`, http.StatusConflict, 3, 3, 3},
+		{"rollback by steps", "/rollback", "", `{"ids":["versioned"],"steps":2}`, http.StatusOK, 4, 1, 0},
+		{"rollback at a stale revision conflicts", "/rollback", "", `{"ids":["versioned"],"version":2,"revisions":{"versioned":3}}`, http.StatusConflict, 4, 1, 4},
+		{"rollback to a version", "/rollback", `"4"`, `{"ids":["versioned"],"version":2}`, http.StatusOK, 5, 2, 0},
+		{"rollback past the history fails", "/rollback", "", `{"ids":["versioned"],"steps":10}`, http.StatusBadRequest, 5, 2, 0},
+		{"rollback needs a target", "/rollback", "", `{"ids":["versioned"]}`, http.StatusBadRequest, 5, 2, 0},
+	}
+	for _, step := range steps {
+		r := httptest.NewRequest(http.MethodPost, step.path, strings.NewReader(step.body))
+		if step.ifMatch != "" {
+			r.Header.Set("If-Match", step.ifMatch)
+		}
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, r)
+		if w.Code != step.status {
+			t.Fatalf("%s: status %d, want %d: %s", step.name, w.Code, step.status, w.Body)
+		}
+		var result HandleResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if step.conflictAt != 0 && (len(result.Failures) != 1 || result.Failures[0].ID != id || result.Failures[0].Revision != step.conflictAt) {
+			t.Errorf("%s: failures %+v, want a conflict on %s at revision %d", step.name, result.Failures, id, step.conflictAt)
+		}
+		config, revision := ctrl.configAt()
+		if revision != step.revision || config.Value != step.value {
+			t.Errorf("%s: value %d at revision %d, want %d at %d", step.name, config.Value, revision, step.value, step.revision)
+		}
+	}
+}
+
+func TestUpdateRoutineConfigIfMatchConflict(t *testing.T) {
+	s := newTestScheduler(t, func(*RoutineControl[*testConfig, int]) (int, error) { return 1, nil })
+	id, err := s.StartRoutineWithOptions(&testConfig{Value: 1}, StartOptions{StartAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := s.UpdateRoutineConfigIfMatch([]string{id}, &testConfig{Value: 2}, Revisions{id: 5})
+	var conflict *ConflictError
+	if updated != 0 || !errors.As(err, &conflict) {
+		t.Fatalf("got (%d, %v), want a conflict", updated, err)
+	}
+	if conflict.ID != id || conflict.Expected != 5 || conflict.Actual != 1 {
+		t.Errorf("conflict %+v, want %s expected at 5 and found at 1", conflict, id)
+	}
+}